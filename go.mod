@@ -1,10 +1,10 @@
 module github.com/ghousemohamed/simple-tunnel
 
-go 1.22.1
+go 1.24
+
+require github.com/spf13/cobra v1.8.1
 
 require (
-	github.com/gorilla/websocket v1.5.3
 	github.com/inconshreveable/mousetrap v1.1.0 // indirect
-	github.com/spf13/cobra v1.8.1 // indirect
 	github.com/spf13/pflag v1.0.5 // indirect
 )
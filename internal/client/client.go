@@ -2,9 +2,9 @@ package client
 
 import (
 	"bufio"
-	"crypto/sha1"
-	"encoding/base64"
-	"encoding/binary"
+	"context"
+	"crypto/tls"
+	"errors"
 	"fmt"
 	"io"
 	"log"
@@ -12,10 +12,10 @@ import (
 	"net/http"
 	"net/url"
 	"strings"
-	"sync"
 	"time"
 
-	"github.com/gorilla/websocket"
+	"github.com/ghousemohamed/simple-tunnel/internal/mux"
+	"github.com/ghousemohamed/simple-tunnel/internal/proxyproto"
 )
 
 const (
@@ -24,351 +24,540 @@ const (
 	reset  = "\033[0m"
 )
 
-// WebSocket opcodes
 const (
-	WebSocketContinuationFrame = 0
-	WebSocketTextFrame         = 1
-	WebSocketBinaryFrame       = 2
-	WebSocketCloseFrame        = 8
-	WebSocketPingFrame         = 9
-	WebSocketPongFrame         = 10
+	// remoteAddrHeader is set by the server to the visitor's address.
+	remoteAddrHeader = "X-Simple-Tunnel-Remote-Addr"
+	// domainStatusHeader reports each requested custom hostname on the
+	// tunnel handshake.
+	domainStatusHeader = "X-Simple-Tunnel-Domain"
+	// publicURLHeader carries the tunnel's public address when the server
+	// knows its own base domain.
+	publicURLHeader = "X-Simple-Tunnel-URL"
+	// protocolVersion is the tunnel protocol this client speaks.
+	protocolVersion = "2"
+	// errorHeader marks responses the client made up because the local
+	// origin failed, so the server can show an error page instead.
+	errorHeader = "X-Simple-Tunnel-Error"
 )
 
+// Values of errorHeader
+const (
+	errorOriginRefused = "origin-refused"
+	errorOriginTimeout = "origin-timeout"
+	errorBadGateway    = "bad-gateway"
+)
+
+const (
+	minReconnectDelay = time.Second
+	maxReconnectDelay = 30 * time.Second
+)
+
+type Config struct {
+	HTTPPort        string
+	ServerAddr      string
+	TLS             bool
+	Subdomain       string
+	ProxyProtocol   string
+	Hostnames       []string
+	Group           bool
+	Broadcast       bool
+	Primary         bool
+	Inbox           bool
+	Token           string
+	HeaderTimeout   time.Duration
+	IdleTimeout     time.Duration
+	Timeout         time.Duration
+	MaxHeaderBytes  int
+	MaxRequestBody  int64
+	MaxResponseBody int64
+	MaxMessageSize  int64
+	OriginProto     string
+	Proto           string
+}
+
 type Client struct {
 	httpPort string
 	serverAddr string
+	useTLS bool
 	subdomain string
+	hostnames []string
+	group bool
+	broadcast bool
+	primary bool
+	inbox bool
+	token string
+	headerTimeout time.Duration
+	idleTimeout time.Duration
+	timeout time.Duration
+	maxHeaderBytes int
+	maxRequestBody int64
+	maxResponseBody int64
+	maxMessageSize int64
+	originTLS bool
+	originHTTP2 bool
+	proxyProtocol int
+	httpClient *http.Client
 }
 
+type contextKey int
+
+const remoteAddrKey contextKey = iota
+
 func init() {
 	log.SetFlags(0)
 }
 
-func NewClient(httpPort string, serverAddr string, subdomain string) *Client {
-	return &Client{
-		httpPort: httpPort,
-		serverAddr: serverAddr,
-		subdomain: subdomain,
+func NewClient(config Config) (*Client, error) {
+	c := &Client{
+		httpPort: config.HTTPPort,
+		serverAddr: config.ServerAddr,
+		useTLS: config.TLS,
+		subdomain: config.Subdomain,
+		hostnames: config.Hostnames,
+		group: config.Group,
+		broadcast: config.Broadcast,
+		primary: config.Primary,
+		inbox: config.Inbox,
+		token: config.Token,
+		headerTimeout: config.HeaderTimeout,
+		idleTimeout: config.IdleTimeout,
+		timeout: config.Timeout,
+		maxHeaderBytes: config.MaxHeaderBytes,
+		maxRequestBody: config.MaxRequestBody,
+		maxResponseBody: config.MaxResponseBody,
+		maxMessageSize: config.MaxMessageSize,
+		httpClient: &http.Client{
+			// Redirects are for the visitor's browser to follow
+			CheckRedirect: func(*http.Request, []*http.Request) error {
+				return http.ErrUseLastResponse
+			},
+		},
+	}
+
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+	transport.ResponseHeaderTimeout = c.headerTimeout
+	transport.MaxResponseHeaderBytes = int64(c.maxHeaderBytes)
+	switch config.Proto {
+	case "", "http":
+	case "grpc":
+		// gRPC only runs over HTTP/2
+		switch config.OriginProto {
+		case "":
+			config.OriginProto = "h2c"
+		case "http1":
+			return nil, fmt.Errorf("gRPC needs HTTP/2 to the local server, use --origin-proto h2c or h2")
+		}
+	default:
+		return nil, fmt.Errorf("unknown protocol %q (want http or grpc)", config.Proto)
+	}
+	switch config.OriginProto {
+	case "", "http1":
+	case "h2c":
+		c.originHTTP2 = true
+		transport.Protocols = new(http.Protocols)
+		transport.Protocols.SetUnencryptedHTTP2(true)
+	case "h2":
+		c.originTLS, c.originHTTP2 = true, true
+		transport.Protocols = new(http.Protocols)
+		transport.Protocols.SetHTTP2(true)
+		// Local servers rarely have a certificate for localhost that
+		// verifies
+		transport.TLSClientConfig = &tls.Config{InsecureSkipVerify: true}
+	default:
+		return nil, fmt.Errorf("unknown origin protocol %q (want http1, h2c or h2)", config.OriginProto)
+	}
+	if config.ProxyProtocol != "" {
+		version, err := proxyproto.ParseVersion(config.ProxyProtocol)
+		if err != nil {
+			return nil, err
+		}
+		c.proxyProtocol = version
+		// Every request carries its own visitor address, so connections
+		// to the origin cannot be reused.
+		transport.DialContext = c.dialLocal
+		transport.DisableKeepAlives = true
+	}
+	c.httpClient.Transport = transport
+
+	return c, nil
+}
+
+// dialLocal connects to the local origin, prepending a PROXY protocol header
+// with the visitor's address when enabled.
+func (c *Client) dialLocal(ctx context.Context, network, addr string) (net.Conn, error) {
+	var d net.Dialer
+	conn, err := d.DialContext(ctx, "tcp", fmt.Sprintf("localhost:%s", c.httpPort))
+	if err != nil || c.proxyProtocol == 0 {
+		return conn, err
 	}
+
+	header := &proxyproto.Header{Version: c.proxyProtocol}
+	if remoteAddr, ok := ctx.Value(remoteAddrKey).(string); ok {
+		if src, err := net.ResolveTCPAddr("tcp", remoteAddr); err == nil {
+			header.Source = src
+			header.Destination, _ = conn.RemoteAddr().(*net.TCPAddr)
+		}
+	}
+	if _, err := header.WriteTo(conn); err != nil {
+		conn.Close()
+		return nil, fmt.Errorf("writing PROXY protocol header: %v", err)
+	}
+	return conn, nil
 }
 
+// StartClient keeps a tunnel open, reconnecting with backoff whenever the
+// connection drops or the server asks clients to go away.
 func (c *Client) StartClient() error {
-	tunnelURL := fmt.Sprintf("http://%s/_tunnel?subdomain=%s", c.serverAddr, c.subdomain)
+	backoff := minReconnectDelay
+	for {
+		session, err := c.connect()
+		if err != nil {
+			if _, ok := err.(*rejectedError); ok {
+				log.Printf("%s%v%s", red, err, reset)
+				return err
+			}
+			log.Printf("Failed to open tunnel: %v (retrying in %s)", err, backoff)
+			time.Sleep(backoff)
+			backoff = min(backoff*2, maxReconnectDelay)
+			continue
+		}
+		backoff = minReconnectDelay
+
+		done := make(chan struct{})
+		go func() {
+			defer close(done)
+			c.serveTunnel(session)
+		}()
+
+		select {
+		case <-session.GoneAway():
+			// Keep answering on the old connection until the server
+			// closes it, while a new one is opened
+			log.Println("Server is going away, reconnecting")
+		case <-done:
+			log.Println("Tunnel closed, reconnecting")
+			time.Sleep(minReconnectDelay)
+		}
+	}
+}
 
-	var conn net.Conn
-	conn, err := net.Dial("tcp", c.serverAddr)
+// rejectedError is returned when the server refuses the tunnel for a reason
+// retrying won't fix.
+type rejectedError struct {
+	status string
+	reason string
+}
+
+func (e *rejectedError) Error() string {
+	return fmt.Sprintf("Server rejected tunnel: %s %s", e.status, e.reason)
+}
+
+func (c *Client) connect() (*mux.Session, error) {
+	query := url.Values{"subdomain": {c.subdomain}, "v": {protocolVersion}}
+	for _, hostname := range c.hostnames {
+		query.Add("hostname", hostname)
+	}
+	if c.group {
+		query.Set("group", "1")
+	}
+	if c.broadcast {
+		query.Set("mode", "broadcast")
+	}
+	if c.primary {
+		query.Set("primary", "1")
+	}
+	if c.inbox {
+		query.Set("inbox", "1")
+	}
+	// The server applies our timeouts to requests for this tunnel too, as
+	// far as its own limits allow
+	if c.headerTimeout > 0 {
+		query.Set("header_timeout", c.headerTimeout.String())
+	}
+	if c.idleTimeout > 0 {
+		query.Set("idle_timeout", c.idleTimeout.String())
+	}
+	if c.timeout > 0 {
+		query.Set("timeout", c.timeout.String())
+	}
+	tunnelURL := fmt.Sprintf("%s/_tunnel?%s", serverURL(c.serverAddr, c.useTLS), query.Encode())
+
+	var rawConn net.Conn
+	var err error
+	if c.useTLS {
+		// Only HTTP/1.1 can be upgraded to a tunnel, so no ALPN is offered
+		rawConn, err = tls.Dial("tcp", c.serverAddr, &tls.Config{MinVersion: tls.VersionTLS12})
+	} else {
+		rawConn, err = net.Dial("tcp", c.serverAddr)
+	}
 	if err != nil {
-		log.Fatalf("Failed to connect to server: %v", err)
+		return nil, fmt.Errorf("failed to connect to server: %v", err)
 	}
-	defer conn.Close()
 
 	req, err := http.NewRequest("GET", tunnelURL, nil)
 	if err != nil {
-		log.Fatalf("Failed to create request: %v", err)
+		rawConn.Close()
+		return nil, fmt.Errorf("failed to create request: %v", err)
 	}
+	setToken(req, c.token)
 
-	if err := req.Write(conn); err != nil {
-		log.Fatalf("Failed to send request: %v", err)
+	if err := req.Write(rawConn); err != nil {
+		rawConn.Close()
+		return nil, fmt.Errorf("failed to send request: %v", err)
 	}
 
-	resp, err := http.ReadResponse(bufio.NewReader(conn), req)
+	// Requests can arrive right behind the handshake response, so every
+	// read from here on goes through the same buffer
+	conn := &bufferedConn{Conn: rawConn, reader: bufio.NewReader(rawConn)}
+
+	resp, err := http.ReadResponse(conn.reader, req)
 	if err != nil {
-		log.Fatalf("Failed to read response: %v", err)
+		conn.Close()
+		return nil, fmt.Errorf("failed to read response: %v", err)
 	}
 	defer resp.Body.Close()
 
 	if resp.StatusCode != http.StatusSwitchingProtocols {
-		log.Fatalf("Unexpected status code: %d", resp.StatusCode)
+		conn.Close()
+		reason, _ := io.ReadAll(io.LimitReader(resp.Body, 1024))
+		if !c.useTLS && strings.HasPrefix(resp.Header.Get("Location"), "https://") {
+			return nil, &rejectedError{status: resp.Status, reason: "the server only opens tunnels over TLS, connect with --tls"}
+		}
+		if resp.StatusCode >= 400 && resp.StatusCode < 500 {
+			return nil, &rejectedError{status: resp.Status, reason: strings.TrimSpace(string(reason))}
+		}
+		return nil, fmt.Errorf("unexpected status code: %d", resp.StatusCode)
 	}
 
 	// Check if the connection has been upgraded
 	if strings.ToLower(resp.Header.Get("Upgrade")) != "websocket" {
-		log.Fatalf("Server did not upgrade to WebSocket")
+		conn.Close()
+		return nil, fmt.Errorf("server did not upgrade to WebSocket")
+	}
+
+	publicURL := resp.Header.Get(publicURLHeader)
+	if publicURL == "" {
+		publicURL = fmt.Sprintf("https://%s.%s", c.subdomain, c.serverAddr)
 	}
+	log.Printf("Your site is now available at: %s", publicURL)
+	logDomainStatuses(resp.Header.Values(domainStatusHeader))
+
+	return mux.Client(conn, conn.reader), nil
+}
 
-	log.Printf("Your site is now available at: https://%s.%s", c.subdomain, c.serverAddr)
+// serveTunnel answers requests from the server, each on its own stream,
+// until the connection closes.
+func (c *Client) serveTunnel(session *mux.Session) {
+	defer session.Close()
 
 	for {
-		log.Println("Waiting for request from server")
-		req, err := http.ReadRequest(bufio.NewReader(conn))
+		stream, err := session.Accept()
 		if err != nil {
-			if err == io.EOF {
-				log.Println("Tunnel closed by server")
-				return nil
-			}
-			log.Printf("Error reading request: %v", err)
-			return err
+			log.Printf("Tunnel closed by server: %v", session.Err())
+			return
 		}
+		go c.serveStream(stream)
+	}
+}
 
-		log.Printf("Received request: %s %s", req.Method, req.URL.Path)
+func (c *Client) serveStream(stream *mux.Stream) {
+	defer stream.Close()
 
-		if websocket.IsWebSocketUpgrade(req) {
-			log.Println("Handling WebSocket upgrade request")
-			c.handleWebSocketRequest(conn, req)
-		} else {
-			c.handleHTTPRequest(conn, req)
+	header := newHeaderLimiter(stream, c.maxHeaderBytes)
+	reader := bufio.NewReader(header)
+	req, err := http.ReadRequest(reader)
+	if err != nil {
+		log.Printf("Error reading request: %v", err)
+		stream.Reset()
+		return
+	}
+	header.disarmed = true
+
+	log.Printf("Received request: %s %s", req.Method, req.URL.Path)
+
+	// The server resets the stream when the visitor goes away or it gives
+	// up waiting, which cancels the local request
+	ctx, cancel := context.WithCancel(req.Context())
+	defer cancel()
+	go func() {
+		select {
+		case <-stream.Done():
+			cancel()
+		case <-ctx.Done():
 		}
+	}()
+
+	remoteAddr := req.Header.Get(remoteAddrHeader)
+	req.Header.Del(remoteAddrHeader)
+	req = req.WithContext(context.WithValue(ctx, remoteAddrKey, remoteAddr))
+
+	if isUpgrade(req) {
+		c.handleUpgradeRequest(stream, reader, req)
+	} else {
+		c.handleHTTPRequest(stream, req)
 	}
 }
 
-func (c *Client) handleHTTPRequest(conn net.Conn, req *http.Request) {
+type bufferedConn struct {
+	net.Conn
+	reader *bufio.Reader
+}
+
+func (b *bufferedConn) Read(p []byte) (int, error) {
+	return b.reader.Read(p)
+}
+
+func logDomainStatuses(statuses []string) {
+	for _, status := range statuses {
+		parts := strings.Split(status, "; ")
+		hostname, fields := parts[0], make(map[string]string)
+		for _, part := range parts[1:] {
+			if k, v, ok := strings.Cut(part, "="); ok {
+				fields[k] = v
+			}
+		}
+
+		switch fields["status"] {
+		case "verified":
+			log.Printf("%sCustom domain https://%s is active%s", green, hostname, reset)
+		case "pending":
+			log.Printf("Custom domain %s is awaiting verification. Publish this DNS TXT record:", hostname)
+			log.Printf("  _simple-tunnel.%s  \"%s\"", hostname, fields["token"])
+		default:
+			log.Printf("%sCustom domain %s was rejected: %s%s", red, hostname, fields["status"], reset)
+		}
+	}
+}
+
+func (c *Client) handleHTTPRequest(stream *mux.Stream, req *http.Request) {
 	// Create a new URL for the local server
-	localURL := fmt.Sprintf("http://localhost:%s%s", c.httpPort, req.URL.Path)
+	scheme := "http"
+	if c.originTLS {
+		scheme = "https"
+	}
+	localURL := fmt.Sprintf("%s://localhost:%s%s", scheme, c.httpPort, req.URL.Path)
 	if req.URL.RawQuery != "" {
 		localURL += "?" + req.URL.RawQuery
 	}
 
 	log.Printf("Forwarding request to local server: %s", localURL)
 
+	ctx, cancel := context.WithCancel(req.Context())
+	defer cancel()
+	if c.timeout > 0 {
+		ctx, cancel = context.WithTimeout(ctx, c.timeout)
+		defer cancel()
+	}
+
+	var body *limitedBody
+	if c.maxRequestBody > 0 {
+		if req.ContentLength > c.maxRequestBody {
+			sendErrorResponse(stream, http.StatusRequestEntityTooLarge, "", "Request body too large")
+			return
+		}
+		body = newLimitedBody(req.Body, c.maxRequestBody, errRequestTooLarge)
+		req.Body = body
+	}
+
 	// Create a new request for the local server
-	localReq, err := http.NewRequest(req.Method, localURL, req.Body)
+	localReq, err := http.NewRequestWithContext(ctx, req.Method, localURL, req.Body)
 	if err != nil {
 		log.Printf("Error creating local request: %v", err)
-		sendErrorResponse(conn, fmt.Sprintf("Error creating local request: %v", err))
+		sendErrorResponse(stream, http.StatusBadGateway, errorBadGateway, fmt.Sprintf("Error creating local request: %v", err))
 		return
 	}
 
 	// Copy headers from the original request
 	localReq.Header = req.Header.Clone()
+	localReq.Trailer = req.Trailer
+	if c.originHTTP2 {
+		removeConnectionHeaders(localReq.Header)
+	}
 
 	// Send the request to the local server
-	resp, err := http.DefaultClient.Do(localReq)
+	resp, err := c.httpClient.Do(localReq)
 	if err != nil {
+		if req.Context().Err() != nil {
+			log.Printf("Request cancelled: %s %s", req.Method, req.URL.Path)
+			return
+		}
+		if body.tooLarge() {
+			sendErrorResponse(stream, http.StatusRequestEntityTooLarge, "", "Request body too large")
+			return
+		}
 		log.Printf("Error sending request to local server: %v", err)
-		sendErrorResponse(conn, fmt.Sprintf("Error sending request to local server: %v", err))
+		status, kind := originFailure(err)
+		sendErrorResponse(stream, status, kind, fmt.Sprintf("Error sending request to local server: %v", err))
 		return
 	}
 	defer resp.Body.Close()
+	// Only responses this client makes up may carry errorHeader, or an origin
+	// could have the server replace its answers with error pages
+	resp.Header.Del(errorHeader)
+	if c.idleTimeout > 0 {
+		resp.Body = newIdleBody(resp.Body, c.idleTimeout, cancel)
+	}
+	if c.maxResponseBody > 0 {
+		if resp.ContentLength > c.maxResponseBody {
+			log.Printf("Response from local server is too large: %d bytes", resp.ContentLength)
+			sendErrorResponse(stream, http.StatusBadGateway, errorBadGateway, "Response from local server is too large")
+			return
+		}
+		resp.Body = newLimitedBody(resp.Body, c.maxResponseBody, errResponseTooLarge)
+	}
 
 	log.Printf("Received response from local server: %d", resp.StatusCode)
 
 	// Write the response back to the tunnel
-	if err := resp.Write(conn); err != nil {
+	if err := writeResponse(stream, resp, req.Method); err != nil {
 		log.Printf("Error writing response to tunnel: %v", err)
+		stream.Reset()
+		return
 	}
 
 	log.Printf("Response sent back through tunnel")
 }
 
-func sendErrorResponse(conn net.Conn, message string) {
-	resp := &http.Response{
-		Status:     "500 Internal Server Error",
-		StatusCode: http.StatusInternalServerError,
-		Proto:      "HTTP/1.1",
-		ProtoMajor: 1,
-		ProtoMinor: 1,
-		Header:     make(http.Header),
-		Body:       io.NopCloser(strings.NewReader(message)),
+// removeConnectionHeaders drops the headers that only apply to a single
+// HTTP/1.1 connection, which HTTP/2 doesn't allow.
+func removeConnectionHeaders(h http.Header) {
+	for _, v := range h.Values("Connection") {
+		for _, name := range strings.Split(v, ",") {
+			h.Del(strings.TrimSpace(name))
+		}
 	}
-	resp.Header.Set("Content-Type", "text/plain")
-	if err := resp.Write(conn); err != nil {
-		log.Printf("Error sending error response: %v", err)
+	for _, name := range []string{"Connection", "Keep-Alive", "Proxy-Connection", "Transfer-Encoding", "Upgrade"} {
+		h.Del(name)
 	}
-}
-
-func (c *Client) handleWebSocketRequest(conn net.Conn, req *http.Request) {
-	dialer := websocket.Dialer{
-		NetDial: func(network, addr string) (net.Conn, error) {
-			return net.Dial("tcp", fmt.Sprintf("localhost:%s", c.httpPort))
-		},
-	}
-
-	u, err := url.Parse(fmt.Sprintf("ws://localhost:%s%s", c.httpPort, req.URL.Path))
-	if err != nil {
-		log.Printf("Failed to parse WebSocket URL: %v", err)
-		return
-	}
-
-	u.RawQuery = req.URL.RawQuery
-
-	header := make(http.Header)
-	for k, v := range req.Header {
-		switch k {
-		case "Upgrade", "Connection", "Sec-Websocket-Key",
-			 "Sec-Websocket-Version", "Sec-Websocket-Extensions",
-			 "Sec-Websocket-Protocol":
-		default:
-			header[k] = v
-		}
+	if te := h.Get("Te"); te != "" && !strings.EqualFold(te, "trailers") {
+		h.Del("Te")
 	}
+}
 
-	localWS, resp, err := dialer.Dial(u.String(), header)
-	if err != nil {
-		log.Printf("Failed to connect to local WebSocket server: %v", err)
-		if resp != nil {
-			log.Printf("Response status: %s", resp.Status)
-		}
-		return
+// originFailure classifies an error talking to the local origin.
+func originFailure(err error) (int, string) {
+	var netErr net.Error
+	if errors.Is(err, context.DeadlineExceeded) || (errors.As(err, &netErr) && netErr.Timeout()) {
+		return http.StatusGatewayTimeout, errorOriginTimeout
 	}
-	defer localWS.Close()
+	return http.StatusBadGateway, errorOriginRefused
+}
 
-	upgradeResp := &http.Response{
-		Status:     "101 Switching Protocols",
-		StatusCode: http.StatusSwitchingProtocols,
+func sendErrorResponse(conn net.Conn, status int, kind, message string) {
+	resp := &http.Response{
+		Status:     fmt.Sprintf("%d %s", status, http.StatusText(status)),
+		StatusCode: status,
 		Proto:      "HTTP/1.1",
 		ProtoMajor: 1,
 		ProtoMinor: 1,
 		Header:     make(http.Header),
+		Body:       io.NopCloser(strings.NewReader(message)),
 	}
-	upgradeResp.Header.Set("Upgrade", "websocket")
-	upgradeResp.Header.Set("Connection", "Upgrade")
-	upgradeResp.Header.Set("Sec-WebSocket-Accept", computeAccept(req.Header.Get("Sec-WebSocket-Key")))
-
-	if err := upgradeResp.Write(conn); err != nil {
-		log.Printf("Failed to send upgrade response: %v", err)
-		return
-	}
-
-	var wg sync.WaitGroup
-	wg.Add(2)
-
-	go func() {
-		defer wg.Done()
-		for {
-			messageType, p, err := localWS.ReadMessage()
-			if err != nil {
-				log.Printf("Error reading from local WebSocket: %v", err)
-				return
-			}
-			log.Printf("Client received message from local WebSocket: %s", string(p))
-			var wsMessageType int
-			switch messageType {
-			case websocket.TextMessage:
-				wsMessageType = WebSocketTextFrame
-			case websocket.BinaryMessage:
-				wsMessageType = WebSocketBinaryFrame
-			case websocket.CloseMessage:
-				wsMessageType = WebSocketCloseFrame
-			case websocket.PingMessage:
-				wsMessageType = WebSocketPingFrame
-			case websocket.PongMessage:
-				wsMessageType = WebSocketPongFrame
-			default:
-				log.Printf("Unknown message type: %d", messageType)
-				continue
-			}
-			if err := writeWebSocketMessage(conn, wsMessageType, p); err != nil {
-				log.Printf("Error writing to tunnel: %v", err)
-				return
-			}
-			log.Printf("Client forwarded message to tunnel: %s", string(p))
-		}
-	}()
-
-	go func() {
-		defer wg.Done()
-		for {
-			messageType, p, err := readWebSocketMessage(conn)
-			if err != nil {
-				log.Printf("Error reading from tunnel: %v", err)
-				return
-			}
-			if messageType == 0 && p == nil {
-				continue
-			}
-			log.Printf("Client received message from tunnel: %s", string(p))
-			if err := localWS.WriteMessage(messageType, p); err != nil {
-				log.Printf("Error writing to local WebSocket: %v", err)
-				return
-			}
-		}
-	}()
-
-	wg.Wait()
-}
-
-func computeAccept(key string) string {
-	h := sha1.New()
-	h.Write([]byte(key))
-	h.Write([]byte("258EAFA5-E914-47DA-95CA-C5AB0DC85B11"))
-	return base64.StdEncoding.EncodeToString(h.Sum(nil))
-}
-
-func writeWebSocketMessage(conn net.Conn, messageType int, payload []byte) error {
-	// https://tools.ietf.org/html/rfc6455#section-5.2
-	var header []byte
-	if len(payload) < 126 {
-		header = make([]byte, 2)
-		header[1] = byte(len(payload))
-	} else if len(payload) < 65536 {
-		header = make([]byte, 4)
-		header[1] = 126
-		binary.BigEndian.PutUint16(header[2:], uint16(len(payload)))
-	} else {
-		header = make([]byte, 10)
-		header[1] = 127
-		binary.BigEndian.PutUint64(header[2:], uint64(len(payload)))
-	}
-
-	header[0] = byte(messageType) | 0x80
-
-	if _, err := conn.Write(header); err != nil {
-		log.Printf("Error writing WebSocket header to tunnel: %v", err)
-		return err
+	resp.Header.Set("Content-Type", "text/plain")
+	if kind != "" {
+		resp.Header.Set(errorHeader, kind)
 	}
-	if _, err := conn.Write(payload); err != nil {
-		log.Printf("Error writing WebSocket payload to tunnel: %v", err)
-		return err
+	if err := resp.Write(conn); err != nil {
+		log.Printf("Error sending error response: %v", err)
 	}
-	log.Printf("Successfully wrote WebSocket message to tunnel. Type: %d, Payload length: %d", messageType, len(payload))
-	return nil
 }
-
-func readWebSocketMessage(conn net.Conn) (int, []byte, error) {
-	if err := conn.SetReadDeadline(time.Now().Add(30 * time.Second)); err != nil {
-		log.Printf("Error setting read deadline: %v", err)
-		return 0, nil, err
-	}
-	defer conn.SetReadDeadline(time.Time{})
-
-	header := make([]byte, 2)
-	_, err := io.ReadFull(conn, header)
-	if err != nil {
-		if netErr, ok := err.(net.Error); ok && netErr.Timeout() {
-			return 0, nil, nil
-		}
-		log.Printf("Error reading WebSocket header from tunnel: %v", err)
-		return 0, nil, err
-	}
-
-	fin := header[0]&0x80 != 0
-	opcode := int(header[0] & 0x0F)
-
-	payloadLen := int(header[1] & 0x7F)
-	if payloadLen == 126 {
-		extendedLen := make([]byte, 2)
-		if _, err := io.ReadFull(conn, extendedLen); err != nil {
-			return 0, nil, err
-		}
-		payloadLen = int(binary.BigEndian.Uint16(extendedLen))
-	} else if payloadLen == 127 {
-		extendedLen := make([]byte, 8)
-		if _, err := io.ReadFull(conn, extendedLen); err != nil {
-			return 0, nil, err
-		}
-		payloadLen = int(binary.BigEndian.Uint64(extendedLen))
-	}
-
-	payload := make([]byte, payloadLen)
-	if _, err := io.ReadFull(conn, payload); err != nil {
-		return 0, nil, err
-	}
-
-	if !fin {
-		for {
-			nextOpcode, nextPayload, err := readWebSocketMessage(conn)
-			if err != nil {
-				return 0, nil, err
-			}
-			if nextOpcode != WebSocketContinuationFrame {
-				return 0, nil, fmt.Errorf("expected continuation frame")
-			}
-			payload = append(payload, nextPayload...)
-			if nextOpcode&0x80 != 0 {
-				break
-			}
-		}
-	}
-
-	return opcode, payload, nil
-}
\ No newline at end of file
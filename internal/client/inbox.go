@@ -0,0 +1,90 @@
+package client
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+)
+
+type InboxEntry struct {
+	ID       string    `json:"id"`
+	Method   string    `json:"method"`
+	Path     string    `json:"path"`
+	Size     int64     `json:"size"`
+	Received time.Time `json:"received"`
+}
+
+type InboxResult struct {
+	ID     string `json:"id"`
+	Status int    `json:"status,omitempty"`
+	Error  string `json:"error,omitempty"`
+}
+
+// ListInbox returns the requests the server stored for subdomain while it
+// was offline.
+func ListInbox(serverAddr string, useTLS bool, token, subdomain string) ([]InboxEntry, error) {
+	var entries []InboxEntry
+	err := inboxCall(http.MethodGet, serverURL(serverAddr, useTLS), token, "", subdomain, nil, &entries)
+	return entries, err
+}
+
+// ReplayInbox delivers stored requests through the connected tunnel. With no
+// ids every stored request is replayed.
+func ReplayInbox(serverAddr string, useTLS bool, token, subdomain string, ids []string) ([]InboxResult, error) {
+	var results []InboxResult
+	err := inboxCall(http.MethodPost, serverURL(serverAddr, useTLS), token, "/replay", subdomain, ids, &results)
+	return results, err
+}
+
+// DiscardInbox deletes stored requests. With no ids the inbox is emptied.
+func DiscardInbox(serverAddr string, useTLS bool, token, subdomain string, ids []string) ([]InboxResult, error) {
+	var results []InboxResult
+	err := inboxCall(http.MethodPost, serverURL(serverAddr, useTLS), token, "/discard", subdomain, ids, &results)
+	return results, err
+}
+
+func inboxCall(method, server, token, action, subdomain string, ids []string, out any) error {
+	query := url.Values{"subdomain": {subdomain}, "id": ids}
+	return apiCall(method, fmt.Sprintf("%s/_tunnel/inbox%s?%s", server, action, query.Encode()), token, out)
+}
+
+// serverURL is where the server's API is reached, over HTTPS when the
+// server was given TLS certificates.
+func serverURL(serverAddr string, useTLS bool) string {
+	if useTLS {
+		return "https://" + serverAddr
+	}
+	return "http://" + serverAddr
+}
+
+// apiCall sends a request to the server's API and decodes its JSON answer
+// into out.
+func apiCall(method, apiURL, token string, out any) error {
+	req, err := http.NewRequest(method, apiURL, nil)
+	if err != nil {
+		return err
+	}
+	setToken(req, token)
+
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		body, _ := io.ReadAll(io.LimitReader(resp.Body, 1024))
+		return fmt.Errorf("server returned %s: %s", resp.Status, strings.TrimSpace(string(body)))
+	}
+	return json.NewDecoder(resp.Body).Decode(out)
+}
+
+func setToken(req *http.Request, token string) {
+	if token != "" {
+		req.Header.Set("Authorization", "Bearer "+token)
+	}
+}
@@ -0,0 +1,74 @@
+package client
+
+import (
+	"errors"
+	"io"
+	"sync/atomic"
+)
+
+var (
+	errHeaderTooLarge   = errors.New("request headers exceed the size limit")
+	errRequestTooLarge  = errors.New("request body exceeds the size limit")
+	errResponseTooLarge = errors.New("response body exceeds the size limit")
+)
+
+// headerLimiter fails reads past n bytes until it is disarmed once the
+// headers have been parsed.
+type headerLimiter struct {
+	r        io.Reader
+	n        int64
+	disarmed bool
+}
+
+func newHeaderLimiter(r io.Reader, limit int) *headerLimiter {
+	if limit <= 0 {
+		return &headerLimiter{r: r, disarmed: true}
+	}
+	// Reading headers buffers a little of the body too
+	return &headerLimiter{r: r, n: int64(limit) + 4096}
+}
+
+func (l *headerLimiter) Read(p []byte) (int, error) {
+	if l.disarmed {
+		return l.r.Read(p)
+	}
+	if l.n <= 0 {
+		return 0, errHeaderTooLarge
+	}
+	if int64(len(p)) > l.n {
+		p = p[:l.n]
+	}
+	n, err := l.r.Read(p)
+	l.n -= int64(n)
+	return n, err
+}
+
+// limitedBody fails with err once more than remaining bytes are read, and
+// remembers that it did.
+type limitedBody struct {
+	io.ReadCloser
+	remaining int64
+	err       error
+	exceeded  atomic.Bool
+}
+
+func newLimitedBody(body io.ReadCloser, limit int64, err error) *limitedBody {
+	return &limitedBody{ReadCloser: body, remaining: limit, err: err}
+}
+
+func (l *limitedBody) Read(p []byte) (int, error) {
+	if int64(len(p)) > l.remaining+1 {
+		p = p[:l.remaining+1]
+	}
+	n, err := l.ReadCloser.Read(p)
+	l.remaining -= int64(n)
+	if l.remaining < 0 {
+		l.exceeded.Store(true)
+		return n + int(l.remaining), l.err
+	}
+	return n, err
+}
+
+func (l *limitedBody) tooLarge() bool {
+	return l != nil && l.exceeded.Load()
+}
@@ -0,0 +1,33 @@
+package client
+
+import (
+	"net/http"
+	"time"
+)
+
+type Reservation struct {
+	Subdomain string    `json:"subdomain"`
+	Connected bool      `json:"connected"`
+	LastSeen  time.Time `json:"last_seen"`
+}
+
+// ListReservations returns the subdomains reserved to token's account.
+func ListReservations(serverAddr string, useTLS bool, token string) ([]Reservation, error) {
+	var reservations []Reservation
+	err := apiCall(http.MethodGet, serverURL(serverAddr, useTLS)+"/_tunnel/reservations", token, &reservations)
+	return reservations, err
+}
+
+// Reserve reserves subdomain to token's account, so only clients presenting
+// the same token can serve it.
+func Reserve(serverAddr string, useTLS bool, token, subdomain string) (*Reservation, error) {
+	var reservation Reservation
+	err := apiCall(http.MethodPost, serverURL(serverAddr, useTLS)+"/_tunnel/reservations/"+subdomain, token, &reservation)
+	return &reservation, err
+}
+
+// Release gives up a reservation held by token's account.
+func Release(serverAddr string, useTLS bool, token, subdomain string) error {
+	var reservation Reservation
+	return apiCall(http.MethodDelete, serverURL(serverAddr, useTLS)+"/_tunnel/reservations/"+subdomain, token, &reservation)
+}
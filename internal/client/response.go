@@ -0,0 +1,51 @@
+package client
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httputil"
+	"strings"
+)
+
+// writeResponse passes resp on to the server as HTTP/1.1. Bodies of
+// unknown length are chunked, so that trailers make it through even when
+// the local server didn't announce them, as gRPC servers do. gRPC responses
+// over HTTP/2 are always chunked, as a short one comes with a length and
+// its status only shows up once the body has been read.
+func writeResponse(w io.Writer, resp *http.Response, method string) error {
+	grpc := resp.ProtoMajor == 2 && strings.HasPrefix(resp.Header.Get("Content-Type"), "application/grpc")
+	resp.Proto, resp.ProtoMajor, resp.ProtoMinor = "HTTP/1.1", 1, 1
+	noBody := method == http.MethodHead || resp.StatusCode < 200 ||
+		resp.StatusCode == http.StatusNoContent || resp.StatusCode == http.StatusNotModified
+	if noBody || (resp.ContentLength >= 0 && len(resp.Trailer) == 0 && !grpc) {
+		return resp.Write(w)
+	}
+
+	var head bytes.Buffer
+	fmt.Fprintf(&head, "HTTP/1.1 %s\r\n", resp.Status)
+	header := resp.Header.Clone()
+	header.Del("Content-Length")
+	header.Set("Transfer-Encoding", "chunked")
+	header.Write(&head)
+	head.WriteString("\r\n")
+	if _, err := w.Write(head.Bytes()); err != nil {
+		return err
+	}
+
+	chunked := httputil.NewChunkedWriter(w)
+	if _, err := io.Copy(chunked, resp.Body); err != nil {
+		return err
+	}
+	if err := chunked.Close(); err != nil {
+		return err
+	}
+
+	// The trailers are only complete once the body has been read
+	var trailer bytes.Buffer
+	resp.Trailer.Write(&trailer)
+	trailer.WriteString("\r\n")
+	_, err := w.Write(trailer.Bytes())
+	return err
+}
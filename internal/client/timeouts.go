@@ -0,0 +1,30 @@
+package client
+
+import (
+	"context"
+	"io"
+	"time"
+)
+
+// idleBody cancels the local request when its response body stalls for
+// longer than the idle timeout.
+type idleBody struct {
+	io.ReadCloser
+	timeout time.Duration
+	timer   *time.Timer
+}
+
+func newIdleBody(body io.ReadCloser, timeout time.Duration, cancel context.CancelFunc) *idleBody {
+	return &idleBody{ReadCloser: body, timeout: timeout, timer: time.AfterFunc(timeout, cancel)}
+}
+
+func (b *idleBody) Read(p []byte) (int, error) {
+	n, err := b.ReadCloser.Read(p)
+	b.timer.Reset(b.timeout)
+	return n, err
+}
+
+func (b *idleBody) Close() error {
+	b.timer.Stop()
+	return b.ReadCloser.Close()
+}
@@ -0,0 +1,97 @@
+package client
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/tls"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/ghousemohamed/simple-tunnel/internal/mux"
+	"github.com/ghousemohamed/simple-tunnel/internal/relay"
+)
+
+// isUpgrade reports whether req asks to switch protocols.
+func isUpgrade(req *http.Request) bool {
+	return req.Header.Get("Upgrade") != "" && headerHasToken(req.Header, "Connection", "upgrade")
+}
+
+func headerHasToken(h http.Header, name, token string) bool {
+	for _, v := range h.Values(name) {
+		for _, t := range strings.Split(v, ",") {
+			if strings.EqualFold(strings.TrimSpace(t), token) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// handleUpgradeRequest passes an upgrade request to the local server over
+// a connection of its own and, once it switches protocols, relays bytes
+// both ways untouched. reader holds what the server sent after the request.
+func (c *Client) handleUpgradeRequest(stream *mux.Stream, reader io.Reader, req *http.Request) {
+	origin, err := c.dialLocal(req.Context(), "tcp", "")
+	if err != nil {
+		log.Printf("Error connecting to local server: %v", err)
+		status, kind := originFailure(err)
+		sendErrorResponse(stream, status, kind, fmt.Sprintf("Error connecting to local server: %v", err))
+		return
+	}
+	defer origin.Close()
+	if c.originTLS {
+		// Upgrades only exist in HTTP/1.1
+		origin = tls.Client(origin, &tls.Config{InsecureSkipVerify: true, NextProtos: []string{"http/1.1"}})
+	}
+
+	if err := req.Write(origin); err != nil {
+		log.Printf("Error sending upgrade request to local server: %v", err)
+		sendErrorResponse(stream, http.StatusBadGateway, errorOriginRefused, fmt.Sprintf("Error sending request to local server: %v", err))
+		return
+	}
+	if c.headerTimeout > 0 {
+		origin.SetReadDeadline(time.Now().Add(c.headerTimeout))
+	}
+	originReader := bufio.NewReader(origin)
+	resp, err := http.ReadResponse(originReader, req)
+	if err != nil {
+		log.Printf("Error reading upgrade response from local server: %v", err)
+		status, kind := originFailure(err)
+		sendErrorResponse(stream, status, kind, fmt.Sprintf("Error reading response from local server: %v", err))
+		return
+	}
+	origin.SetReadDeadline(time.Time{})
+
+	if resp.StatusCode != http.StatusSwitchingProtocols {
+		defer resp.Body.Close()
+		if err := resp.Write(stream); err != nil {
+			log.Printf("Error writing response to tunnel: %v", err)
+			stream.Reset()
+		}
+		return
+	}
+
+	var head bytes.Buffer
+	fmt.Fprintf(&head, "HTTP/1.1 %s\r\n", resp.Status)
+	resp.Header.Write(&head)
+	head.WriteString("\r\n")
+	if _, err := stream.Write(head.Bytes()); err != nil {
+		log.Printf("Error writing response to tunnel: %v", err)
+		return
+	}
+
+	protocol := resp.Header.Get("Upgrade")
+	log.Printf("Relaying %s connection: %s", protocol, req.URL.Path)
+	// We stand in for the server towards the tunnel and for the client
+	// towards the local server, so only frames to the latter are masked
+	result := relay.Relay(
+		relay.Side{Name: "visitor", Conn: stream, Reader: reader},
+		relay.Side{Name: "local server", Conn: origin, Reader: originReader, Mask: true},
+		relay.Options{WebSocket: strings.EqualFold(protocol, "websocket"), Limit: c.maxMessageSize},
+	)
+	log.Printf("%s connection %s %s", protocol, req.URL.Path, result)
+}
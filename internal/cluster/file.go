@@ -0,0 +1,180 @@
+package cluster
+
+import (
+	"context"
+	"encoding/hex"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// fileStore keeps one file per key in a directory, so nodes sharing a
+// filesystem can share state without running another service. Files hold
+// the value and its expiry (0 for none), and are replaced atomically by
+// rename. Changes to a key are made while holding its lock file, so a
+// conditional delete can't remove a value written after it checked.
+type fileStore struct {
+	dir string
+}
+
+const (
+	lockSuffix = ".lock"
+	// lockStale is how old a lock file has to be before it is taken to be
+	// left behind by a node that crashed while holding it. Locks are only
+	// held for a read and a rename.
+	lockStale = 10 * time.Second
+	lockRetry = 5 * time.Millisecond
+)
+
+func NewFileStore(dir string) (Store, error) {
+	if err := os.MkdirAll(dir, 0o700); err != nil {
+		return nil, err
+	}
+	return &fileStore{dir: dir}, nil
+}
+
+func (s *fileStore) path(key string) string {
+	return filepath.Join(s.dir, hex.EncodeToString([]byte(key)))
+}
+
+// lock takes key's lock file, waiting for another holder until ctx is done.
+func (s *fileStore) lock(ctx context.Context, key string) (func(), error) {
+	path := s.path(key) + lockSuffix
+	for {
+		f, err := os.OpenFile(path, os.O_CREATE|os.O_EXCL|os.O_WRONLY, 0o600)
+		if err == nil {
+			f.Close()
+			return func() { os.Remove(path) }, nil
+		}
+		if !os.IsExist(err) {
+			return nil, err
+		}
+		if info, err := os.Stat(path); err == nil && time.Since(info.ModTime()) > lockStale {
+			os.Remove(path)
+			continue
+		}
+
+		select {
+		case <-ctx.Done():
+			return nil, fmt.Errorf("waiting for lock on %q: %v", key, ctx.Err())
+		case <-time.After(lockRetry):
+		}
+	}
+}
+
+func (s *fileStore) Set(ctx context.Context, key, value string, ttl time.Duration) error {
+	unlock, err := s.lock(ctx, key)
+	if err != nil {
+		return err
+	}
+	defer unlock()
+	return s.write(key, value, ttl)
+}
+
+// write replaces key's file. The caller holds the key's lock.
+func (s *fileStore) write(key, value string, ttl time.Duration) error {
+	tmp, err := os.CreateTemp(s.dir, ".tmp-*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+
+	var expires int64
+	if ttl > 0 {
+		expires = time.Now().Add(ttl).UnixNano()
+	}
+	if _, err := fmt.Fprintf(tmp, "%d\n%s", expires, value); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+	return os.Rename(tmp.Name(), s.path(key))
+}
+
+func (s *fileStore) Get(ctx context.Context, key string) (string, bool, error) {
+	data, err := os.ReadFile(s.path(key))
+	if os.IsNotExist(err) {
+		return "", false, nil
+	}
+	if err != nil {
+		return "", false, err
+	}
+
+	expires, value, ok := strings.Cut(string(data), "\n")
+	if !ok {
+		return "", false, fmt.Errorf("corrupt entry for %q", key)
+	}
+	nanos, err := strconv.ParseInt(expires, 10, 64)
+	if err != nil {
+		return "", false, fmt.Errorf("corrupt entry for %q", key)
+	}
+	if nanos != 0 && time.Now().UnixNano() > nanos {
+		return "", false, nil
+	}
+	return value, true, nil
+}
+
+func (s *fileStore) Delete(ctx context.Context, key, value string) error {
+	unlock, err := s.lock(ctx, key)
+	if err != nil {
+		return err
+	}
+	defer unlock()
+
+	current, ok, err := s.Get(ctx, key)
+	if err != nil || !ok || current != value {
+		return err
+	}
+	if err := os.Remove(s.path(key)); err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	return nil
+}
+
+func (s *fileStore) CompareAndSwap(ctx context.Context, key, old, new string) (bool, error) {
+	unlock, err := s.lock(ctx, key)
+	if err != nil {
+		return false, err
+	}
+	defer unlock()
+
+	current, _, err := s.Get(ctx, key)
+	if err != nil || current != old {
+		return false, err
+	}
+	if new == "" {
+		if err := os.Remove(s.path(key)); err != nil && !os.IsNotExist(err) {
+			return false, err
+		}
+		return true, nil
+	}
+	return true, s.write(key, new, 0)
+}
+
+func (s *fileStore) List(ctx context.Context, prefix string) ([]string, error) {
+	files, err := os.ReadDir(s.dir)
+	if err != nil {
+		return nil, err
+	}
+	var keys []string
+	for _, file := range files {
+		name, err := hex.DecodeString(file.Name())
+		if err != nil || !strings.HasPrefix(string(name), prefix) {
+			continue
+		}
+		if _, ok, err := s.Get(ctx, string(name)); err != nil || !ok {
+			continue
+		}
+		keys = append(keys, string(name))
+	}
+	return keys, nil
+}
+
+func (s *fileStore) Close() error {
+	return nil
+}
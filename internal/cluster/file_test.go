@@ -0,0 +1,165 @@
+package cluster
+
+import (
+	"context"
+	"os"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestFileStoreDelete(t *testing.T) {
+	store, err := NewFileStore(t.TempDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+	ctx := context.Background()
+
+	store.Set(ctx, "tunnel/app/a", "node-a", 0)
+	if err := store.Delete(ctx, "tunnel/app/a", "node-b"); err != nil {
+		t.Fatal(err)
+	}
+	if value, ok, _ := store.Get(ctx, "tunnel/app/a"); !ok || value != "node-a" {
+		t.Fatalf("Delete with another value removed the key: %q, %v", value, ok)
+	}
+	if err := store.Delete(ctx, "tunnel/app/a", "node-a"); err != nil {
+		t.Fatal(err)
+	}
+	if _, ok, _ := store.Get(ctx, "tunnel/app/a"); ok {
+		t.Fatal("Delete with the stored value kept the key")
+	}
+}
+
+// TestFileStoreDeleteRace checks that a conditional delete never removes a
+// value written after the one it was asked to delete.
+func TestFileStoreDeleteRace(t *testing.T) {
+	store, err := NewFileStore(t.TempDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+	ctx := context.Background()
+
+	for i := 0; i < 50; i++ {
+		store.Set(ctx, "key", "old", 0)
+		var wg sync.WaitGroup
+		wg.Add(2)
+		go func() {
+			defer wg.Done()
+			store.Delete(ctx, "key", "old")
+		}()
+		go func() {
+			defer wg.Done()
+			store.Set(ctx, "key", "new", 0)
+		}()
+		wg.Wait()
+
+		// Whichever ran first, the new value must survive
+		if value, ok, _ := store.Get(ctx, "key"); !ok || value != "new" {
+			t.Fatalf("round %d: key = %q, %v; want new", i, value, ok)
+		}
+	}
+}
+
+func TestFileStoreLock(t *testing.T) {
+	dir := t.TempDir()
+	s := &fileStore{dir: dir}
+
+	unlock, err := s.lock(context.Background(), "key")
+	if err != nil {
+		t.Fatal(err)
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	if err := s.Set(ctx, "key", "value", 0); err == nil {
+		t.Error("Set succeeded while the key was locked")
+	}
+	unlock()
+	if err := s.Set(context.Background(), "key", "value", 0); err != nil {
+		t.Errorf("Set after unlock: %v", err)
+	}
+
+	// A lock left behind by a crashed node is taken over once stale
+	lockPath := s.path("key") + lockSuffix
+	os.WriteFile(lockPath, nil, 0o600)
+	stale := time.Now().Add(-2 * lockStale)
+	os.Chtimes(lockPath, stale, stale)
+	if err := s.Set(context.Background(), "key", "again", 0); err != nil {
+		t.Errorf("Set with a stale lock: %v", err)
+	}
+
+	keys, _ := s.List(context.Background(), "")
+	if len(keys) != 1 || keys[0] != "key" {
+		t.Errorf("List = %q; want only key", keys)
+	}
+}
+
+func TestCompareAndSwap(t *testing.T) {
+	fileStore, err := NewFileStore(t.TempDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+	stores := map[string]Store{"memory": NewMemoryStore(), "file": fileStore}
+	for name, store := range stores {
+		t.Run(name, func(t *testing.T) {
+			ctx := context.Background()
+			steps := []struct {
+				old, new string
+				swapped  bool
+				want     string
+			}{
+				{"x", "a", false, ""},
+				{"", "a", true, "a"},
+				{"", "b", false, "a"},
+				{"b", "c", false, "a"},
+				{"a", "b", true, "b"},
+				{"a", "", false, "b"},
+				{"b", "", true, ""},
+			}
+			for i, step := range steps {
+				swapped, err := store.CompareAndSwap(ctx, "key", step.old, step.new)
+				if err != nil {
+					t.Fatal(err)
+				}
+				value, _, _ := store.Get(ctx, "key")
+				if swapped != step.swapped || value != step.want {
+					t.Fatalf("step %d: swapped %v, value %q; want %v, %q", i, swapped, value, step.swapped, step.want)
+				}
+			}
+		})
+	}
+}
+
+// TestFileStoreCompareAndSwapRace checks that of several swaps from the same
+// value only one succeeds.
+func TestFileStoreCompareAndSwapRace(t *testing.T) {
+	store, err := NewFileStore(t.TempDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+	ctx := context.Background()
+
+	var (
+		wg      sync.WaitGroup
+		mu      sync.Mutex
+		swapped int
+	)
+	for i := 0; i < 10; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			ok, err := store.CompareAndSwap(ctx, "key", "", "taken")
+			if err != nil {
+				t.Error(err)
+			}
+			if ok {
+				mu.Lock()
+				swapped++
+				mu.Unlock()
+			}
+		}()
+	}
+	wg.Wait()
+	if swapped != 1 {
+		t.Fatalf("%d swaps succeeded, want 1", swapped)
+	}
+}
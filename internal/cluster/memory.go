@@ -0,0 +1,91 @@
+package cluster
+
+import (
+	"context"
+	"strings"
+	"sync"
+	"time"
+)
+
+type memoryEntry struct {
+	value   string
+	expires time.Time
+}
+
+func (e memoryEntry) expired() bool {
+	return !e.expires.IsZero() && time.Now().After(e.expires)
+}
+
+type memoryStore struct {
+	mu      sync.Mutex
+	entries map[string]memoryEntry
+}
+
+func NewMemoryStore() Store {
+	return &memoryStore{entries: make(map[string]memoryEntry)}
+}
+
+func (s *memoryStore) Set(ctx context.Context, key, value string, ttl time.Duration) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	entry := memoryEntry{value: value}
+	if ttl > 0 {
+		entry.expires = time.Now().Add(ttl)
+	}
+	s.entries[key] = entry
+	return nil
+}
+
+func (s *memoryStore) Get(ctx context.Context, key string) (string, bool, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	entry, ok := s.entries[key]
+	if !ok || entry.expired() {
+		delete(s.entries, key)
+		return "", false, nil
+	}
+	return entry.value, true, nil
+}
+
+func (s *memoryStore) Delete(ctx context.Context, key, value string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if entry, ok := s.entries[key]; ok && entry.value == value {
+		delete(s.entries, key)
+	}
+	return nil
+}
+
+func (s *memoryStore) CompareAndSwap(ctx context.Context, key, old, new string) (bool, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	var current string
+	if entry, ok := s.entries[key]; ok && !entry.expired() {
+		current = entry.value
+	}
+	if current != old {
+		return false, nil
+	}
+	if new == "" {
+		delete(s.entries, key)
+	} else {
+		s.entries[key] = memoryEntry{value: new}
+	}
+	return true, nil
+}
+
+func (s *memoryStore) List(ctx context.Context, prefix string) ([]string, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	var keys []string
+	for key, entry := range s.entries {
+		if strings.HasPrefix(key, prefix) && !entry.expired() {
+			keys = append(keys, key)
+		}
+	}
+	return keys, nil
+}
+
+func (s *memoryStore) Close() error {
+	return nil
+}
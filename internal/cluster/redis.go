@@ -0,0 +1,228 @@
+package cluster
+
+import (
+	"bufio"
+	"context"
+	"fmt"
+	"io"
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+const redisKeyPrefix = "simple-tunnel:"
+
+// redisGlobEscaper keeps key prefixes from being read as SCAN patterns.
+var redisGlobEscaper = strings.NewReplacer(`\`, `\\`, "*", `\*`, "?", `\?`, "[", `\[`, "]", `\]`)
+
+// deleteIfEquals removes a key only while it still holds the given value.
+const deleteIfEquals = `if redis.call("GET", KEYS[1]) == ARGV[1] then return redis.call("DEL", KEYS[1]) else return 0 end`
+
+// compareAndSwap sets or, given an empty value, deletes a key only while it
+// still holds the expected value, where an empty one means it doesn't exist.
+const compareAndSwap = `local v = redis.call("GET", KEYS[1]) or ""
+if v ~= ARGV[1] then return 0 end
+if ARGV[2] == "" then redis.call("DEL", KEYS[1]) else redis.call("SET", KEYS[1], ARGV[2]) end
+return 1`
+
+// redisStore speaks just enough RESP to keep entries in a Redis-compatible
+// server. Commands share one connection, which is re-dialed after errors.
+type redisStore struct {
+	addr     string
+	password string
+	db       int
+
+	mu     sync.Mutex
+	conn   net.Conn
+	reader *bufio.Reader
+}
+
+type redisError string
+
+func (e redisError) Error() string {
+	return "redis: " + string(e)
+}
+
+func NewRedisStore(addr, password string, db int) Store {
+	return &redisStore{addr: addr, password: password, db: db}
+}
+
+func (s *redisStore) Set(ctx context.Context, key, value string, ttl time.Duration) error {
+	args := []string{"SET", redisKeyPrefix + key, value}
+	if ttl > 0 {
+		args = append(args, "PX", strconv.FormatInt(ttl.Milliseconds(), 10))
+	}
+	_, err := s.do(ctx, args...)
+	return err
+}
+
+func (s *redisStore) Get(ctx context.Context, key string) (string, bool, error) {
+	reply, err := s.do(ctx, "GET", redisKeyPrefix+key)
+	if err != nil || reply == nil {
+		return "", false, err
+	}
+	value, ok := reply.(string)
+	if !ok {
+		return "", false, fmt.Errorf("redis: unexpected reply %v", reply)
+	}
+	return value, true, nil
+}
+
+func (s *redisStore) Delete(ctx context.Context, key, value string) error {
+	_, err := s.do(ctx, "EVAL", deleteIfEquals, "1", redisKeyPrefix+key, value)
+	return err
+}
+
+func (s *redisStore) CompareAndSwap(ctx context.Context, key, old, new string) (bool, error) {
+	reply, err := s.do(ctx, "EVAL", compareAndSwap, "1", redisKeyPrefix+key, old, new)
+	if err != nil {
+		return false, err
+	}
+	return reply == int64(1), nil
+}
+
+func (s *redisStore) List(ctx context.Context, prefix string) ([]string, error) {
+	pattern := redisKeyPrefix + redisGlobEscaper.Replace(prefix) + "*"
+	var keys []string
+	cursor := "0"
+	for {
+		reply, err := s.do(ctx, "SCAN", cursor, "MATCH", pattern, "COUNT", "100")
+		if err != nil {
+			return nil, err
+		}
+		items, ok := reply.([]any)
+		if !ok || len(items) != 2 {
+			return nil, fmt.Errorf("redis: unexpected reply %v", reply)
+		}
+		cursor, _ = items[0].(string)
+		batch, _ := items[1].([]any)
+		for _, item := range batch {
+			if key, ok := item.(string); ok {
+				keys = append(keys, strings.TrimPrefix(key, redisKeyPrefix))
+			}
+		}
+		if cursor == "0" || cursor == "" {
+			return keys, nil
+		}
+	}
+}
+
+func (s *redisStore) Close() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.conn == nil {
+		return nil
+	}
+	err := s.conn.Close()
+	s.conn = nil
+	return err
+}
+
+func (s *redisStore) do(ctx context.Context, args ...string) (any, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.conn == nil {
+		if err := s.dial(ctx); err != nil {
+			return nil, err
+		}
+	}
+
+	reply, err := s.roundTrip(ctx, args)
+	if err != nil {
+		if _, ok := err.(redisError); !ok {
+			// The connection is in an unknown state
+			s.conn.Close()
+			s.conn = nil
+		}
+		return nil, err
+	}
+	return reply, nil
+}
+
+func (s *redisStore) dial(ctx context.Context) error {
+	var d net.Dialer
+	conn, err := d.DialContext(ctx, "tcp", s.addr)
+	if err != nil {
+		return err
+	}
+	s.conn, s.reader = conn, bufio.NewReader(conn)
+
+	if s.password != "" {
+		if _, err := s.roundTrip(ctx, []string{"AUTH", s.password}); err != nil {
+			s.conn.Close()
+			s.conn = nil
+			return err
+		}
+	}
+	if s.db != 0 {
+		if _, err := s.roundTrip(ctx, []string{"SELECT", strconv.Itoa(s.db)}); err != nil {
+			s.conn.Close()
+			s.conn = nil
+			return err
+		}
+	}
+	return nil
+}
+
+func (s *redisStore) roundTrip(ctx context.Context, args []string) (any, error) {
+	deadline, ok := ctx.Deadline()
+	if !ok {
+		deadline = time.Now().Add(5 * time.Second)
+	}
+	s.conn.SetDeadline(deadline)
+
+	buf := fmt.Appendf(nil, "*%d\r\n", len(args))
+	for _, arg := range args {
+		buf = fmt.Appendf(buf, "$%d\r\n%s\r\n", len(arg), arg)
+	}
+	if _, err := s.conn.Write(buf); err != nil {
+		return nil, err
+	}
+	return readRESP(s.reader)
+}
+
+func readRESP(r *bufio.Reader) (any, error) {
+	line, err := r.ReadString('\n')
+	if err != nil {
+		return nil, err
+	}
+	if len(line) < 3 {
+		return nil, fmt.Errorf("redis: malformed reply %q", line)
+	}
+	kind, body := line[0], line[1:len(line)-2]
+
+	switch kind {
+	case '+':
+		return body, nil
+	case '-':
+		return nil, redisError(body)
+	case ':':
+		return strconv.ParseInt(body, 10, 64)
+	case '$':
+		n, err := strconv.Atoi(body)
+		if err != nil || n < 0 {
+			return nil, err
+		}
+		data := make([]byte, n+2)
+		if _, err := io.ReadFull(r, data); err != nil {
+			return nil, err
+		}
+		return string(data[:n]), nil
+	case '*':
+		n, err := strconv.Atoi(body)
+		if err != nil || n < 0 {
+			return nil, err
+		}
+		items := make([]any, n)
+		for i := range items {
+			if items[i], err = readRESP(r); err != nil {
+				return nil, err
+			}
+		}
+		return items, nil
+	}
+	return nil, fmt.Errorf("redis: unknown reply type %q", kind)
+}
@@ -0,0 +1,63 @@
+package cluster
+
+import (
+	"context"
+	"fmt"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Store is the shared state several tunnel servers use to find out which
+// node a tunnel is connected to, and the backend of the tunnel registry.
+// Entries stored with a ttl expire unless they are refreshed.
+type Store interface {
+	// Set stores value under key for ttl, or for good if ttl is 0.
+	Set(ctx context.Context, key, value string, ttl time.Duration) error
+	// Get returns the value under key, if it exists and hasn't expired.
+	Get(ctx context.Context, key string) (string, bool, error)
+	// Delete removes key, but only while it still holds value, so a node
+	// never removes an entry another node has since taken over.
+	Delete(ctx context.Context, key, value string) error
+	// CompareAndSwap stores new under key for good, but only while key
+	// holds old, and reports whether it did. An empty old means the key
+	// must not exist, and an empty new removes it.
+	CompareAndSwap(ctx context.Context, key, old, new string) (bool, error)
+	// List returns the keys starting with prefix that haven't expired.
+	List(ctx context.Context, prefix string) ([]string, error)
+	Close() error
+}
+
+// Open creates a store from a URL:
+//
+//	memory://                           in-process, for a single node
+//	file:///var/lib/simple-tunnel/reg   a directory, e.g. on shared storage
+//	redis://[:password@]host:port[/db]  a Redis-compatible server
+func Open(rawURL string) (Store, error) {
+	u, err := url.Parse(rawURL)
+	if err != nil {
+		return nil, fmt.Errorf("invalid store URL %q: %v", rawURL, err)
+	}
+
+	switch u.Scheme {
+	case "memory":
+		return NewMemoryStore(), nil
+	case "file":
+		path := u.Path
+		if u.Host != "" {
+			path = u.Host + path
+		}
+		return NewFileStore(path)
+	case "redis":
+		password, _ := u.User.Password()
+		db := 0
+		if p := strings.Trim(u.Path, "/"); p != "" {
+			if db, err = strconv.Atoi(p); err != nil {
+				return nil, fmt.Errorf("invalid redis database %q", p)
+			}
+		}
+		return NewRedisStore(u.Host, password, db), nil
+	}
+	return nil, fmt.Errorf("unsupported store %q", u.Scheme)
+}
@@ -0,0 +1,104 @@
+package cmd
+
+import (
+	"fmt"
+	"os"
+	"text/tabwriter"
+
+	"github.com/ghousemohamed/simple-tunnel/internal/client"
+	"github.com/spf13/cobra"
+)
+
+type inboxCommand struct {
+	cmd        *cobra.Command
+	subdomain  string
+	serverAddr string
+	useTLS     bool
+	token      string
+}
+
+func InboxCommand() *inboxCommand {
+	inboxCommand := &inboxCommand{}
+	inboxCommand.cmd = &cobra.Command{
+		Use:   "inbox",
+		Short: "Manage requests stored while your tunnel was offline",
+	}
+
+	inboxCommand.cmd.PersistentFlags().StringVar(&inboxCommand.subdomain, "subdomain", "", "Subdomain whose inbox to manage")
+	inboxCommand.cmd.PersistentFlags().StringVar(&inboxCommand.serverAddr, "server", "simpletunnel.me:80", "Server through which tunnels are routed")
+	inboxCommand.cmd.PersistentFlags().BoolVar(&inboxCommand.useTLS, "tls", false, "Connect to the server over TLS")
+	inboxCommand.cmd.PersistentFlags().StringVar(&inboxCommand.token, "token", "", "Token the tunnel was started with, or of the account the subdomain is reserved to")
+	inboxCommand.cmd.MarkPersistentFlagRequired("subdomain")
+
+	inboxCommand.cmd.AddCommand(&cobra.Command{
+		Use:   "list",
+		Short: "List stored requests",
+		Args:  cobra.NoArgs,
+		RunE:  inboxCommand.list,
+	})
+	inboxCommand.cmd.AddCommand(&cobra.Command{
+		Use:   "replay [id...]",
+		Short: "Deliver stored requests through the connected tunnel (all if no ids are given)",
+		RunE:  inboxCommand.replay,
+	})
+	inboxCommand.cmd.AddCommand(&cobra.Command{
+		Use:   "discard [id...]",
+		Short: "Delete stored requests (all if no ids are given)",
+		RunE:  inboxCommand.discard,
+	})
+
+	return inboxCommand
+}
+
+func (c *inboxCommand) list(cmd *cobra.Command, args []string) error {
+	entries, err := client.ListInbox(c.serverAddr, c.useTLS, c.token, c.subdomain)
+	if err != nil {
+		return err
+	}
+	if len(entries) == 0 {
+		fmt.Println("Inbox is empty")
+		return nil
+	}
+
+	w := tabwriter.NewWriter(os.Stdout, 0, 4, 2, ' ', 0)
+	fmt.Fprintln(w, "ID\tRECEIVED\tMETHOD\tPATH\tSIZE")
+	for _, e := range entries {
+		fmt.Fprintf(w, "%s\t%s\t%s\t%s\t%d\n", e.ID, e.Received.Local().Format("2006-01-02 15:04:05"), e.Method, e.Path, e.Size)
+	}
+	return w.Flush()
+}
+
+func (c *inboxCommand) replay(cmd *cobra.Command, args []string) error {
+	results, err := client.ReplayInbox(c.serverAddr, c.useTLS, c.token, c.subdomain, args)
+	if err != nil {
+		return err
+	}
+	return printInboxResults(results, "replayed")
+}
+
+func (c *inboxCommand) discard(cmd *cobra.Command, args []string) error {
+	results, err := client.DiscardInbox(c.serverAddr, c.useTLS, c.token, c.subdomain, args)
+	if err != nil {
+		return err
+	}
+	return printInboxResults(results, "discarded")
+}
+
+func printInboxResults(results []client.InboxResult, verb string) error {
+	failed := 0
+	for _, r := range results {
+		switch {
+		case r.Error != "":
+			failed++
+			fmt.Printf("%s: %s\n", r.ID, r.Error)
+		case r.Status != 0:
+			fmt.Printf("%s: %s (%d)\n", r.ID, verb, r.Status)
+		default:
+			fmt.Printf("%s: %s\n", r.ID, verb)
+		}
+	}
+	if failed > 0 {
+		return fmt.Errorf("%d of %d requests failed", failed, len(results))
+	}
+	return nil
+}
@@ -0,0 +1,99 @@
+package cmd
+
+import (
+	"fmt"
+	"os"
+	"text/tabwriter"
+
+	"github.com/ghousemohamed/simple-tunnel/internal/client"
+	"github.com/spf13/cobra"
+)
+
+type reservationCommand struct {
+	cmd        *cobra.Command
+	serverAddr string
+	useTLS     bool
+	token      string
+}
+
+func newReservationCommand(cmd *cobra.Command) *reservationCommand {
+	reservationCommand := &reservationCommand{cmd: cmd}
+	cmd.Flags().StringVar(&reservationCommand.serverAddr, "server", "simpletunnel.me:80", "Server through which tunnels are routed")
+	cmd.Flags().BoolVar(&reservationCommand.useTLS, "tls", false, "Connect to the server over TLS")
+	cmd.Flags().StringVar(&reservationCommand.token, "token", "", "Token identifying your account")
+	cmd.MarkFlagRequired("token")
+	return reservationCommand
+}
+
+func ReserveCommand() *reservationCommand {
+	c := newReservationCommand(&cobra.Command{
+		Use:   "reserve <subdomain>",
+		Short: "Reserve a subdomain so only your account can serve it",
+		Args:  cobra.ExactArgs(1),
+	})
+	c.cmd.RunE = c.reserve
+	return c
+}
+
+func ReleaseCommand() *reservationCommand {
+	c := newReservationCommand(&cobra.Command{
+		Use:   "release <subdomain>",
+		Short: "Give up a reserved subdomain",
+		Args:  cobra.ExactArgs(1),
+	})
+	c.cmd.RunE = c.release
+	return c
+}
+
+func ListCommand() *reservationCommand {
+	c := newReservationCommand(&cobra.Command{
+		Use:   "list",
+		Short: "List the subdomains reserved to your account",
+		Args:  cobra.NoArgs,
+	})
+	c.cmd.RunE = c.list
+	return c
+}
+
+func (c *reservationCommand) reserve(cmd *cobra.Command, args []string) error {
+	reservation, err := client.Reserve(c.serverAddr, c.useTLS, c.token, args[0])
+	if err != nil {
+		return err
+	}
+	fmt.Printf("Reserved %s\n", reservation.Subdomain)
+	return nil
+}
+
+func (c *reservationCommand) release(cmd *cobra.Command, args []string) error {
+	if err := client.Release(c.serverAddr, c.useTLS, c.token, args[0]); err != nil {
+		return err
+	}
+	fmt.Printf("Released %s\n", args[0])
+	return nil
+}
+
+func (c *reservationCommand) list(cmd *cobra.Command, args []string) error {
+	reservations, err := client.ListReservations(c.serverAddr, c.useTLS, c.token)
+	if err != nil {
+		return err
+	}
+	if len(reservations) == 0 {
+		fmt.Println("No reserved subdomains")
+		return nil
+	}
+
+	w := tabwriter.NewWriter(os.Stdout, 0, 4, 2, ' ', 0)
+	fmt.Fprintln(w, "SUBDOMAIN\tSTATUS\tLAST SEEN")
+	for _, r := range reservations {
+		status := "offline"
+		if r.Connected {
+			status = "connected"
+		}
+		lastSeen := "-"
+		if !r.LastSeen.IsZero() {
+			lastSeen = r.LastSeen.Local().Format("2006-01-02 15:04:05")
+		}
+		fmt.Fprintf(w, "%s\t%s\t%s\n", r.Subdomain, status, lastSeen)
+	}
+	return w.Flush()
+}
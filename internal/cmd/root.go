@@ -7,14 +7,18 @@ import (
 )
 
 var rootCmd = &cobra.Command{
-	Use: "simple-tunnel",
-	Short: "Simple HTTP Tunnel",
+	Use:          "simple-tunnel",
+	Short:        "Simple HTTP Tunnel",
 	SilenceUsage: true,
 }
 
 func Execute() {
 	rootCmd.AddCommand(StartCommand().cmd)
 	rootCmd.AddCommand(ServeCommand().cmd)
+	rootCmd.AddCommand(InboxCommand().cmd)
+	rootCmd.AddCommand(ReserveCommand().cmd)
+	rootCmd.AddCommand(ReleaseCommand().cmd)
+	rootCmd.AddCommand(ListCommand().cmd)
 
 	err := rootCmd.Execute()
 	if err != nil {
@@ -1,15 +1,34 @@
 package cmd
 
 import (
+	"time"
+
 	"github.com/ghousemohamed/simple-tunnel/internal/client"
 	"github.com/spf13/cobra"
 )
 
 type serveCommand struct {
-	cmd      *cobra.Command
-	httpPort string
-	subdomain string
-	serverAddr string
+	cmd             *cobra.Command
+	httpPort        string
+	subdomain       string
+	serverAddr      string
+	useTLS          bool
+	proxyProtocol   string
+	hostnames       []string
+	group           bool
+	broadcast       bool
+	primary         bool
+	inbox           bool
+	token           string
+	headerTimeout   time.Duration
+	idleTimeout     time.Duration
+	timeout         time.Duration
+	maxHeaderBytes  int
+	maxRequestBody  int64
+	maxResponseBody int64
+	maxMessageSize  int64
+	originProto     string
+	proto           string
 }
 
 func ServeCommand() *serveCommand {
@@ -23,11 +42,58 @@ func ServeCommand() *serveCommand {
 	serveCommand.cmd.Flags().StringVar(&serveCommand.httpPort, "port", "8080", "Port to start server tunnel on")
 	serveCommand.cmd.Flags().StringVar(&serveCommand.subdomain, "subdomain", GenerateRandomSubdomain(10), "Custom subdomain to serve on")
 	serveCommand.cmd.Flags().StringVar(&serveCommand.serverAddr, "server", "simpletunnel.me:80", "Server through which tunnels are routed")
+	serveCommand.cmd.Flags().BoolVar(&serveCommand.useTLS, "tls", false, "Connect to the server over TLS")
+	serveCommand.cmd.Flags().StringVar(&serveCommand.proxyProtocol, "proxy-protocol", "", "Send a PROXY protocol header (v1 or v2) with the visitor's address to the local port")
+
+	serveCommand.cmd.Flags().StringSliceVar(&serveCommand.hostnames, "hostname", nil, "Custom domain to route to this tunnel once ownership is verified")
+
+	serveCommand.cmd.Flags().BoolVar(&serveCommand.group, "group", false, "Share the subdomain with other clients started with --group instead of taking it over")
+
+	serveCommand.cmd.Flags().BoolVar(&serveCommand.broadcast, "broadcast", false, "Subscribe to the subdomain so every request is delivered to all subscribed clients")
+	serveCommand.cmd.Flags().BoolVar(&serveCommand.primary, "primary", false, "With --broadcast, answer senders with this client's response")
+
+	serveCommand.cmd.Flags().BoolVar(&serveCommand.inbox, "inbox", false, "Have the server store requests while this tunnel is offline and redeliver them on reconnect")
+
+	serveCommand.cmd.Flags().StringVar(&serveCommand.token, "token", "", "Token identifying your account, required for subdomains reserved to it")
+
+	serveCommand.cmd.Flags().DurationVar(&serveCommand.headerTimeout, "header-timeout", 0, "How long to wait for the local server's response headers (0 uses the server's limit)")
+	serveCommand.cmd.Flags().DurationVar(&serveCommand.idleTimeout, "idle-timeout", 0, "How long a response body may stall before the request is aborted (0 uses the server's limit)")
+	serveCommand.cmd.Flags().DurationVar(&serveCommand.timeout, "timeout", 0, "Limit on the whole request (0 uses the server's limit)")
+	serveCommand.cmd.Flags().IntVar(&serveCommand.maxHeaderBytes, "max-header-bytes", 0, "Maximum size of request and response headers (0 disables)")
+	serveCommand.cmd.Flags().Int64Var(&serveCommand.maxRequestBody, "max-request-body", 0, "Maximum size of a request body in bytes, answered with 413 when exceeded (0 disables)")
+	serveCommand.cmd.Flags().Int64Var(&serveCommand.maxResponseBody, "max-response-body", 0, "Maximum size of a response body in bytes (0 disables)")
+	serveCommand.cmd.Flags().Int64Var(&serveCommand.maxMessageSize, "max-message-size", 0, "Maximum size of a WebSocket message in bytes (0 disables)")
+	serveCommand.cmd.Flags().StringVar(&serveCommand.originProto, "origin-proto", "", "Protocol to speak to the local server: http1, h2c or h2 (HTTP/2 over TLS); defaults to http1, or h2c with --proto grpc")
+	serveCommand.cmd.Flags().StringVar(&serveCommand.proto, "proto", "http", "What the local server serves: http or grpc")
 
 	return serveCommand
 }
 
 func (c *serveCommand) run(cmd *cobra.Command, args []string) error {
-	client.NewClient(c.httpPort, c.serverAddr, c.subdomain).StartClient()
-	return nil
+	tunnelClient, err := client.NewClient(client.Config{
+		HTTPPort:        c.httpPort,
+		ServerAddr:      c.serverAddr,
+		TLS:             c.useTLS,
+		Subdomain:       c.subdomain,
+		ProxyProtocol:   c.proxyProtocol,
+		Hostnames:       c.hostnames,
+		Group:           c.group,
+		Broadcast:       c.broadcast,
+		Primary:         c.primary,
+		Inbox:           c.inbox,
+		Token:           c.token,
+		HeaderTimeout:   c.headerTimeout,
+		IdleTimeout:     c.idleTimeout,
+		Timeout:         c.timeout,
+		MaxHeaderBytes:  c.maxHeaderBytes,
+		MaxRequestBody:  c.maxRequestBody,
+		MaxResponseBody: c.maxResponseBody,
+		MaxMessageSize:  c.maxMessageSize,
+		OriginProto:     c.originProto,
+		Proto:           c.proto,
+	})
+	if err != nil {
+		return err
+	}
+	return tunnelClient.StartClient()
 }
@@ -2,14 +2,47 @@ package cmd
 
 import (
 	"log"
+	"time"
 
 	"github.com/ghousemohamed/simple-tunnel/internal/server"
 	"github.com/spf13/cobra"
 )
 
 type startCommand struct {
-	cmd              *cobra.Command
-	httpPort         string
+	cmd               *cobra.Command
+	httpPort          string
+	trustedProxies    []string
+	proxyProtocolFrom []string
+	domainSecret      string
+	baseDomains       []string
+	pathRouting       bool
+	loadBalancing     string
+	reconnectGrace    time.Duration
+	queueMaxRequests  int
+	queueMaxBytes     int64
+	inboxDir          string
+	inboxStatus       int
+	inboxMaxRequests  int
+	inboxMaxBytes     int64
+	drainTimeout      time.Duration
+	clusterStore      string
+	clusterAdvertise  string
+	clusterSecret     string
+	registryDir       string
+	maxReservations   int
+	errorPagesDir     string
+	headerTimeout     time.Duration
+	idleTimeout       time.Duration
+	requestTimeout    time.Duration
+	maxHeaderBytes    int
+	maxRequestBody    int64
+	maxResponseBody   int64
+	maxMessageSize    int64
+	h2c               bool
+	tlsCert           string
+	tlsKey            string
+	tlsCertDir        string
+	httpRedirectPort  string
 }
 
 func StartCommand() *startCommand {
@@ -21,12 +54,90 @@ func StartCommand() *startCommand {
 	}
 
 	startCommand.cmd.Flags().StringVar(&startCommand.httpPort, "port", "8080", "Port to start tunnel server on")
+	startCommand.cmd.Flags().StringSliceVar(&startCommand.trustedProxies, "trusted-proxy", []string{"127.0.0.1/8", "::1/128"}, "Proxies (IPs or CIDRs) whose X-Forwarded-* and Forwarded headers are extended instead of replaced")
+	startCommand.cmd.Flags().StringSliceVar(&startCommand.proxyProtocolFrom, "proxy-protocol-from", nil, "Accept PROXY protocol v1/v2 headers from these load balancer IPs or CIDRs")
+
+	startCommand.cmd.Flags().StringVar(&startCommand.domainSecret, "domain-secret", "", "Secret used to derive custom domain verification tokens (generated and kept in the registry if empty)")
+
+	startCommand.cmd.Flags().StringSliceVar(&startCommand.baseDomains, "base-domain", nil, "Domain(s) tunnels are served under, e.g. tunnels.example.com (default: first label of the Host)")
+
+	startCommand.cmd.Flags().BoolVar(&startCommand.pathRouting, "path-routing", false, "Also expose tunnels at /t/<subdomain>/ on the base domain for networks without wildcard DNS")
+
+	startCommand.cmd.Flags().StringVar(&startCommand.loadBalancing, "load-balancing", server.RoundRobin, "How requests are spread across clients sharing a subdomain: round-robin or least-outstanding")
+
+	startCommand.cmd.Flags().DurationVar(&startCommand.reconnectGrace, "reconnect-grace", 10*time.Second, "How long to hold requests for a subdomain whose client just disconnected (0 disables)")
+	startCommand.cmd.Flags().IntVar(&startCommand.queueMaxRequests, "queue-max-requests", 100, "Maximum requests held per subdomain while its client reconnects")
+	startCommand.cmd.Flags().Int64Var(&startCommand.queueMaxBytes, "queue-max-bytes", 10<<20, "Maximum request body bytes held per subdomain while its client reconnects")
+
+	startCommand.cmd.Flags().StringVar(&startCommand.inboxDir, "inbox-dir", "", "Directory for storing requests to offline tunnels started with --inbox (disabled if empty)")
+	startCommand.cmd.Flags().IntVar(&startCommand.inboxStatus, "inbox-status", 202, "Status code returned to senders when a request is stored in the inbox")
+	startCommand.cmd.Flags().IntVar(&startCommand.inboxMaxRequests, "inbox-max-requests", 1000, "Maximum requests stored per subdomain, after which senders get 507 (0 disables)")
+	startCommand.cmd.Flags().Int64Var(&startCommand.inboxMaxBytes, "inbox-max-bytes", 100<<20, "Maximum bytes of requests stored per subdomain, after which senders get 507 (0 disables)")
+
+	startCommand.cmd.Flags().DurationVar(&startCommand.drainTimeout, "drain-timeout", 30*time.Second, "How long to wait for in-flight requests when shutting down")
+
+	startCommand.cmd.Flags().StringVar(&startCommand.clusterStore, "cluster-store", "", "Registry shared by cluster nodes: memory://, file:///path or redis://[:password@]host:port[/db] (disabled if empty)")
+	startCommand.cmd.Flags().StringVar(&startCommand.clusterAdvertise, "cluster-advertise", "", "Address other nodes use to reach this node, e.g. http://10.0.0.5:8080")
+	startCommand.cmd.Flags().StringVar(&startCommand.clusterSecret, "cluster-secret", "", "Secret shared by cluster nodes to authenticate forwarded requests")
+
+	startCommand.cmd.Flags().StringVar(&startCommand.registryDir, "registry-dir", "", "Directory that keeps tunnel metadata and reservations across restarts (in memory, without reservations, if empty; in the cluster store with --cluster-store)")
+	startCommand.cmd.Flags().IntVar(&startCommand.maxReservations, "max-reservations", 10, "Maximum subdomains one account can reserve (0 disables)")
+
+	startCommand.cmd.Flags().StringVar(&startCommand.errorPagesDir, "error-pages", "", "Directory of HTML templates replacing the built-in error pages, with optional per-subdomain subdirectories")
+
+	startCommand.cmd.Flags().DurationVar(&startCommand.headerTimeout, "header-timeout", 60*time.Second, "How long to wait for a client's response headers before answering 504 (0 disables)")
+	startCommand.cmd.Flags().DurationVar(&startCommand.idleTimeout, "idle-timeout", 5*time.Minute, "How long a response body may stall before the request is aborted (0 disables)")
+	startCommand.cmd.Flags().DurationVar(&startCommand.requestTimeout, "request-timeout", 0, "Limit on a whole request, including streaming the response (0 disables)")
+	startCommand.cmd.Flags().IntVar(&startCommand.maxHeaderBytes, "max-header-bytes", 1<<20, "Maximum size of request and response headers")
+	startCommand.cmd.Flags().Int64Var(&startCommand.maxRequestBody, "max-request-body", 0, "Maximum size of a request body in bytes, answered with 413 when exceeded (0 disables)")
+	startCommand.cmd.Flags().Int64Var(&startCommand.maxResponseBody, "max-response-body", 0, "Maximum size of a response body in bytes (0 disables)")
+	startCommand.cmd.Flags().Int64Var(&startCommand.maxMessageSize, "max-message-size", 16<<20, "Maximum size of a WebSocket message in bytes (0 disables)")
+	startCommand.cmd.Flags().BoolVar(&startCommand.h2c, "h2c", false, "Accept HTTP/2 without TLS from visitors that use it with prior knowledge")
+
+	startCommand.cmd.Flags().StringVar(&startCommand.tlsCert, "tls-cert", "", "Certificate file (e.g. a wildcard for the base domain) to serve HTTPS with on --port")
+	startCommand.cmd.Flags().StringVar(&startCommand.tlsKey, "tls-key", "", "Private key file for --tls-cert")
+	startCommand.cmd.Flags().StringVar(&startCommand.tlsCertDir, "tls-cert-dir", "", "Directory of <name>.crt/<name>.key pairs, e.g. for custom domains, picked by SNI over --tls-cert")
+	startCommand.cmd.Flags().StringVar(&startCommand.httpRedirectPort, "http-redirect-port", "", "Port on which plain HTTP is redirected to HTTPS (disabled if empty)")
 
 	return startCommand
 }
 
 func (c *startCommand) run(cmd *cobra.Command, args []string) error {
-	tunnel_server := server.NewServer(c.httpPort)
+	tunnel_server := server.NewServer(server.Config{
+		HTTPPort:          c.httpPort,
+		TrustedProxies:    c.trustedProxies,
+		ProxyProtocolFrom: c.proxyProtocolFrom,
+		DomainSecret:      c.domainSecret,
+		BaseDomains:       c.baseDomains,
+		PathRouting:       c.pathRouting,
+		LoadBalancing:     c.loadBalancing,
+		ReconnectGrace:    c.reconnectGrace,
+		QueueMaxRequests:  c.queueMaxRequests,
+		QueueMaxBytes:     c.queueMaxBytes,
+		InboxDir:          c.inboxDir,
+		InboxStatus:       c.inboxStatus,
+		InboxMaxRequests:  c.inboxMaxRequests,
+		InboxMaxBytes:     c.inboxMaxBytes,
+		DrainTimeout:      c.drainTimeout,
+		ClusterStore:      c.clusterStore,
+		ClusterAdvertise:  c.clusterAdvertise,
+		ClusterSecret:     c.clusterSecret,
+		RegistryDir:       c.registryDir,
+		MaxReservations:   c.maxReservations,
+		ErrorPagesDir:     c.errorPagesDir,
+		HeaderTimeout:     c.headerTimeout,
+		IdleTimeout:       c.idleTimeout,
+		RequestTimeout:    c.requestTimeout,
+		MaxHeaderBytes:    c.maxHeaderBytes,
+		MaxRequestBody:    c.maxRequestBody,
+		MaxResponseBody:   c.maxResponseBody,
+		MaxMessageSize:    c.maxMessageSize,
+		H2C:               c.h2c,
+		TLSCert:           c.tlsCert,
+		TLSKey:            c.tlsKey,
+		TLSCertDir:        c.tlsCertDir,
+		HTTPRedirectPort:  c.httpRedirectPort,
+	})
 	err := tunnel_server.StartServer()
 
 	if err != nil {
@@ -0,0 +1,366 @@
+// Package mux runs many independent byte streams over one connection, so a
+// tunnel can carry concurrent requests and abort one without disturbing the
+// others.
+//
+// Every frame starts with a 9 byte header: the frame type, a 4 byte stream
+// id and a 4 byte length, both big endian. Only data frames carry a payload
+// of that length; window, ping and pong frames use the length field as their
+// value instead. Streams opened by the dialing side have odd ids, streams
+// opened by the accepting side even ones.
+package mux
+
+import (
+	"bufio"
+	"context"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"sync"
+	"time"
+)
+
+const (
+	frameOpen byte = iota
+	frameData
+	frameClose
+	frameReset
+	frameWindow
+	framePing
+	framePong
+	frameGoAway
+)
+
+const (
+	headerSize = 9
+	// initialWindow is how much unread data a stream buffers before its
+	// sender has to wait.
+	initialWindow = 256 << 10
+	maxFrameSize  = 32 << 10
+	acceptBacklog = 256
+)
+
+var (
+	ErrSessionClosed = errors.New("mux: session closed")
+	ErrStreamReset   = errors.New("mux: stream reset")
+)
+
+type Session struct {
+	conn   net.Conn
+	reader io.Reader
+
+	writeMu sync.Mutex
+	writer  *bufio.Writer
+
+	mu       sync.Mutex
+	streams  map[uint32]*Stream
+	nextID   uint32
+	pings    map[uint32]chan struct{}
+	nextPing uint32
+	// pong is the latest ping to answer; only one pong waits to be written
+	// at a time, however fast the peer pings
+	pong       uint32
+	pongQueued bool
+
+	accept     chan *Stream
+	goAway     chan struct{}
+	goAwayOnce sync.Once
+	closed     chan struct{}
+	closeOnce  sync.Once
+	err        error
+}
+
+// Client starts a session on a connection this side dialed. Bytes already
+// buffered from conn can be handed over in reader; nil reads from conn.
+// Streams the peer opens are handed out by Accept.
+func Client(conn net.Conn, reader io.Reader) *Session {
+	return newSession(conn, reader, 1, true)
+}
+
+// Server starts a session on a connection this side accepted. The server
+// only opens streams, so streams the peer opens are reset straight away
+// rather than waiting for an Accept that never comes.
+func Server(conn net.Conn, reader io.Reader) *Session {
+	return newSession(conn, reader, 2, false)
+}
+
+func newSession(conn net.Conn, reader io.Reader, firstID uint32, accepting bool) *Session {
+	if reader == nil {
+		reader = conn
+	}
+	s := &Session{
+		conn:    conn,
+		reader:  reader,
+		writer:  bufio.NewWriter(conn),
+		streams: make(map[uint32]*Stream),
+		nextID:  firstID,
+		pings:   make(map[uint32]chan struct{}),
+		goAway:  make(chan struct{}),
+		closed:  make(chan struct{}),
+	}
+	if accepting {
+		s.accept = make(chan *Stream, acceptBacklog)
+	}
+	go s.readLoop()
+	return s
+}
+
+// Open starts a new stream to the peer.
+func (s *Session) Open() (*Stream, error) {
+	s.mu.Lock()
+	if s.isClosed() {
+		s.mu.Unlock()
+		return nil, ErrSessionClosed
+	}
+	id := s.nextID
+	s.nextID += 2
+	stream := newStream(s, id)
+	s.streams[id] = stream
+	s.mu.Unlock()
+
+	if err := s.writeFrame(frameOpen, id, 0, nil); err != nil {
+		s.removeStream(id)
+		return nil, err
+	}
+	return stream, nil
+}
+
+// Accept waits for the peer to open a stream. On a session started with
+// Server it only returns once the session is closed.
+func (s *Session) Accept() (*Stream, error) {
+	select {
+	case stream := <-s.accept:
+		return stream, nil
+	case <-s.closed:
+		return nil, ErrSessionClosed
+	}
+}
+
+// GoAway tells the peer this side is shutting down. Streams keep working
+// until the session is closed.
+func (s *Session) GoAway() error {
+	return s.writeFrame(frameGoAway, 0, 0, nil)
+}
+
+// GoneAway is closed once the peer has sent GoAway.
+func (s *Session) GoneAway() <-chan struct{} {
+	return s.goAway
+}
+
+// Ping measures the round trip to the peer.
+func (s *Session) Ping(ctx context.Context) (time.Duration, error) {
+	s.mu.Lock()
+	id := s.nextPing
+	s.nextPing++
+	pong := make(chan struct{})
+	s.pings[id] = pong
+	s.mu.Unlock()
+	defer func() {
+		s.mu.Lock()
+		delete(s.pings, id)
+		s.mu.Unlock()
+	}()
+
+	start := time.Now()
+	if err := s.writeFrame(framePing, 0, id, nil); err != nil {
+		return 0, err
+	}
+	select {
+	case <-pong:
+		return time.Since(start), nil
+	case <-ctx.Done():
+		return 0, ctx.Err()
+	case <-s.closed:
+		return 0, ErrSessionClosed
+	}
+}
+
+// Close ends the session and every stream on it.
+func (s *Session) Close() error {
+	s.closeWithError(ErrSessionClosed)
+	return nil
+}
+
+// Closed is closed when the session ends.
+func (s *Session) Closed() <-chan struct{} {
+	return s.closed
+}
+
+// Err returns why the session ended.
+func (s *Session) Err() error {
+	<-s.closed
+	return s.err
+}
+
+func (s *Session) LocalAddr() net.Addr {
+	return s.conn.LocalAddr()
+}
+
+func (s *Session) RemoteAddr() net.Addr {
+	return s.conn.RemoteAddr()
+}
+
+func (s *Session) isClosed() bool {
+	select {
+	case <-s.closed:
+		return true
+	default:
+		return false
+	}
+}
+
+func (s *Session) closeWithError(err error) {
+	s.closeOnce.Do(func() {
+		s.mu.Lock()
+		s.err = err
+		close(s.closed)
+		streams := s.streams
+		s.streams = make(map[uint32]*Stream)
+		s.mu.Unlock()
+
+		s.conn.Close()
+		for _, stream := range streams {
+			stream.finish()
+		}
+	})
+}
+
+func (s *Session) removeStream(id uint32) {
+	s.mu.Lock()
+	delete(s.streams, id)
+	s.mu.Unlock()
+}
+
+func (s *Session) stream(id uint32) *Stream {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.streams[id]
+}
+
+func (s *Session) writeFrame(typ byte, id, length uint32, payload []byte) error {
+	var header [headerSize]byte
+	header[0] = typ
+	binary.BigEndian.PutUint32(header[1:5], id)
+	binary.BigEndian.PutUint32(header[5:9], length)
+
+	s.writeMu.Lock()
+	defer s.writeMu.Unlock()
+	if s.isClosed() {
+		return ErrSessionClosed
+	}
+
+	s.writer.Write(header[:])
+	s.writer.Write(payload)
+	if err := s.writer.Flush(); err != nil {
+		s.closeWithError(err)
+		return err
+	}
+	return nil
+}
+
+// writePong answers the latest ping off the read loop, so a blocked writer
+// cannot stall reading.
+func (s *Session) writePong() {
+	s.mu.Lock()
+	id := s.pong
+	s.pongQueued = false
+	s.mu.Unlock()
+	s.writeFrame(framePong, 0, id, nil)
+}
+
+func (s *Session) readLoop() {
+	var header [headerSize]byte
+	for {
+		if _, err := io.ReadFull(s.reader, header[:]); err != nil {
+			s.closeWithError(err)
+			return
+		}
+		typ := header[0]
+		id := binary.BigEndian.Uint32(header[1:5])
+		length := binary.BigEndian.Uint32(header[5:9])
+
+		if err := s.handleFrame(typ, id, length); err != nil {
+			s.closeWithError(err)
+			return
+		}
+	}
+}
+
+func (s *Session) handleFrame(typ byte, id, length uint32) error {
+	switch typ {
+	case frameData:
+		if length > maxFrameSize {
+			return fmt.Errorf("mux: frame of %d bytes exceeds limit", length)
+		}
+		payload := make([]byte, length)
+		if _, err := io.ReadFull(s.reader, payload); err != nil {
+			return err
+		}
+		if stream := s.stream(id); stream != nil {
+			return stream.receive(payload)
+		}
+
+	case frameOpen:
+		s.mu.Lock()
+		_, exists := s.streams[id]
+		// The peer's ids have the other parity from ours
+		if exists || id == 0 || id%2 == s.nextID%2 {
+			s.mu.Unlock()
+			return fmt.Errorf("mux: invalid stream id %d", id)
+		}
+		if s.accept == nil {
+			s.mu.Unlock()
+			return s.writeFrame(frameReset, id, 0, nil)
+		}
+		stream := newStream(s, id)
+		s.streams[id] = stream
+		s.mu.Unlock()
+
+		select {
+		case s.accept <- stream:
+		default:
+			stream.Reset()
+		}
+
+	case frameClose:
+		if stream := s.stream(id); stream != nil {
+			stream.remoteClose()
+		}
+
+	case frameReset:
+		if stream := s.stream(id); stream != nil {
+			stream.remoteReset()
+		}
+
+	case frameWindow:
+		if stream := s.stream(id); stream != nil {
+			stream.addCredit(length)
+		}
+
+	case framePing:
+		s.mu.Lock()
+		s.pong = length
+		queued := s.pongQueued
+		s.pongQueued = true
+		s.mu.Unlock()
+		if !queued {
+			go s.writePong()
+		}
+
+	case framePong:
+		s.mu.Lock()
+		if pong, ok := s.pings[length]; ok {
+			close(pong)
+			delete(s.pings, length)
+		}
+		s.mu.Unlock()
+
+	case frameGoAway:
+		s.goAwayOnce.Do(func() { close(s.goAway) })
+
+	default:
+		return fmt.Errorf("mux: unknown frame type %d", typ)
+	}
+	return nil
+}
@@ -0,0 +1,80 @@
+package mux
+
+import (
+	"errors"
+	"io"
+	"net"
+	"testing"
+	"time"
+)
+
+func pipe(t *testing.T) (client, server *Session) {
+	t.Helper()
+	a, b := net.Pipe()
+	client, server = Client(a, nil), Server(b, nil)
+	t.Cleanup(func() {
+		client.Close()
+		server.Close()
+	})
+	return client, server
+}
+
+func TestServerOpensStreams(t *testing.T) {
+	client, server := pipe(t)
+
+	go func() {
+		stream, err := server.Open()
+		if err != nil {
+			t.Error(err)
+			return
+		}
+		stream.Write([]byte("hello"))
+		stream.CloseWrite()
+	}()
+
+	stream, err := client.Accept()
+	if err != nil {
+		t.Fatal(err)
+	}
+	got, err := io.ReadAll(stream)
+	if err != nil || string(got) != "hello" {
+		t.Fatalf("read %q, %v; want hello", got, err)
+	}
+}
+
+// TestServerResetsPeerStreams checks that streams opened by the client are
+// reset rather than left buffering on a server that never accepts them.
+func TestServerResetsPeerStreams(t *testing.T) {
+	client, server := pipe(t)
+
+	for i := 0; i < 2*acceptBacklog; i++ {
+		stream, err := client.Open()
+		if err != nil {
+			t.Fatal(err)
+		}
+		stream.SetDeadline(time.Now().Add(5 * time.Second))
+		if _, err := stream.Read(make([]byte, 1)); !errors.Is(err, ErrStreamReset) {
+			t.Fatalf("stream %d: read returned %v, want a reset", i, err)
+		}
+		if _, err := stream.Write([]byte("ignored")); !errors.Is(err, ErrStreamReset) {
+			t.Fatalf("stream %d: write returned %v, want a reset", i, err)
+		}
+	}
+
+	server.mu.Lock()
+	held := len(server.streams)
+	server.mu.Unlock()
+	if held != 0 {
+		t.Fatalf("server holds %d streams the client opened", held)
+	}
+
+	// The session still works for the streams the server opens
+	go func() {
+		if stream, err := server.Open(); err == nil {
+			stream.CloseWrite()
+		}
+	}()
+	if _, err := client.Accept(); err != nil {
+		t.Fatal(err)
+	}
+}
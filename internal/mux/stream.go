@@ -0,0 +1,287 @@
+package mux
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"sync"
+	"time"
+)
+
+// Stream is one bidirectional byte stream of a session. It implements
+// net.Conn; Close finishes the stream cleanly once everything the peer sent
+// has been read and resets it otherwise.
+type Stream struct {
+	id      uint32
+	session *Session
+
+	mu            sync.Mutex
+	buf           bytes.Buffer
+	unacked       uint32
+	sendWindow    uint32
+	readClosed    bool // the peer won't send more
+	writeClosed   bool // we won't send more
+	closed        bool
+	reset         bool
+	readDeadline  time.Time
+	writeDeadline time.Time
+
+	readNotify  chan struct{}
+	writeNotify chan struct{}
+	done        chan struct{}
+	doneOnce    sync.Once
+}
+
+func newStream(s *Session, id uint32) *Stream {
+	return &Stream{
+		id:          id,
+		session:     s,
+		sendWindow:  initialWindow,
+		readNotify:  make(chan struct{}, 1),
+		writeNotify: make(chan struct{}, 1),
+		done:        make(chan struct{}),
+	}
+}
+
+// Done is closed when the stream is reset by either side or its session
+// ends.
+func (st *Stream) Done() <-chan struct{} {
+	return st.done
+}
+
+func (st *Stream) Read(p []byte) (int, error) {
+	for {
+		st.mu.Lock()
+		if st.closed {
+			st.mu.Unlock()
+			return 0, io.ErrClosedPipe
+		}
+		if st.buf.Len() > 0 {
+			n, _ := st.buf.Read(p)
+			st.unacked += uint32(n)
+			var credit uint32
+			if st.unacked >= initialWindow/2 && !st.readClosed {
+				credit, st.unacked = st.unacked, 0
+			}
+			st.mu.Unlock()
+			if credit > 0 {
+				st.session.writeFrame(frameWindow, st.id, credit, nil)
+			}
+			return n, nil
+		}
+		if st.reset {
+			st.mu.Unlock()
+			return 0, ErrStreamReset
+		}
+		if st.readClosed {
+			st.mu.Unlock()
+			return 0, io.EOF
+		}
+		deadline := st.readDeadline
+		st.mu.Unlock()
+
+		if err := st.wait(st.readNotify, deadline); err != nil {
+			return 0, err
+		}
+	}
+}
+
+func (st *Stream) Write(p []byte) (int, error) {
+	total := 0
+	for len(p) > 0 {
+		st.mu.Lock()
+		switch {
+		case st.reset:
+			st.mu.Unlock()
+			return total, ErrStreamReset
+		case st.writeClosed || st.closed:
+			st.mu.Unlock()
+			return total, io.ErrClosedPipe
+		case !st.writeDeadline.IsZero() && time.Now().After(st.writeDeadline):
+			st.mu.Unlock()
+			return total, os.ErrDeadlineExceeded
+		}
+		if st.sendWindow == 0 {
+			deadline := st.writeDeadline
+			st.mu.Unlock()
+			if err := st.wait(st.writeNotify, deadline); err != nil {
+				return total, err
+			}
+			continue
+		}
+		n := min(uint32(len(p)), st.sendWindow, maxFrameSize)
+		st.sendWindow -= n
+		st.mu.Unlock()
+
+		if err := st.session.writeFrame(frameData, st.id, n, p[:n]); err != nil {
+			return total, err
+		}
+		total += int(n)
+		p = p[n:]
+	}
+	return total, nil
+}
+
+// CloseWrite tells the peer no more data will be sent. Reading continues
+// until the peer closes its side.
+func (st *Stream) CloseWrite() error {
+	st.mu.Lock()
+	if st.writeClosed || st.reset {
+		st.mu.Unlock()
+		return nil
+	}
+	st.writeClosed = true
+	finished := st.readClosed
+	st.mu.Unlock()
+
+	err := st.session.writeFrame(frameClose, st.id, 0, nil)
+	if finished {
+		st.session.removeStream(st.id)
+	}
+	return err
+}
+
+func (st *Stream) Close() error {
+	st.mu.Lock()
+	if st.closed {
+		st.mu.Unlock()
+		return nil
+	}
+	st.closed = true
+	drained := st.readClosed && st.buf.Len() == 0
+	st.mu.Unlock()
+
+	if !drained {
+		return st.Reset()
+	}
+	return st.CloseWrite()
+}
+
+// Reset aborts the stream in both directions.
+func (st *Stream) Reset() error {
+	st.mu.Lock()
+	if st.reset {
+		st.mu.Unlock()
+		return nil
+	}
+	st.reset = true
+	st.mu.Unlock()
+
+	st.finish()
+	st.session.removeStream(st.id)
+	return st.session.writeFrame(frameReset, st.id, 0, nil)
+}
+
+func (st *Stream) SetDeadline(t time.Time) error {
+	st.SetReadDeadline(t)
+	return st.SetWriteDeadline(t)
+}
+
+func (st *Stream) SetReadDeadline(t time.Time) error {
+	st.mu.Lock()
+	st.readDeadline = t
+	st.mu.Unlock()
+	poke(st.readNotify)
+	return nil
+}
+
+func (st *Stream) SetWriteDeadline(t time.Time) error {
+	st.mu.Lock()
+	st.writeDeadline = t
+	st.mu.Unlock()
+	poke(st.writeNotify)
+	return nil
+}
+
+func (st *Stream) LocalAddr() net.Addr {
+	return st.session.LocalAddr()
+}
+
+func (st *Stream) RemoteAddr() net.Addr {
+	return st.session.RemoteAddr()
+}
+
+func (st *Stream) receive(payload []byte) error {
+	st.mu.Lock()
+	if st.reset || st.closed {
+		st.mu.Unlock()
+		return nil
+	}
+	if st.buf.Len()+len(payload) > initialWindow {
+		st.mu.Unlock()
+		return fmt.Errorf("mux: stream %d exceeded its window", st.id)
+	}
+	st.buf.Write(payload)
+	st.mu.Unlock()
+	poke(st.readNotify)
+	return nil
+}
+
+func (st *Stream) remoteClose() {
+	st.mu.Lock()
+	st.readClosed = true
+	finished := st.writeClosed
+	st.mu.Unlock()
+	if finished {
+		st.session.removeStream(st.id)
+	}
+	poke(st.readNotify)
+}
+
+func (st *Stream) remoteReset() {
+	st.mu.Lock()
+	st.reset = true
+	st.mu.Unlock()
+	st.finish()
+	st.session.removeStream(st.id)
+}
+
+func (st *Stream) addCredit(n uint32) {
+	st.mu.Lock()
+	st.sendWindow += n
+	st.mu.Unlock()
+	poke(st.writeNotify)
+}
+
+// finish wakes everything waiting on the stream for good.
+func (st *Stream) finish() {
+	st.doneOnce.Do(func() { close(st.done) })
+	poke(st.readNotify)
+	poke(st.writeNotify)
+}
+
+func (st *Stream) wait(notify chan struct{}, deadline time.Time) error {
+	var timeout <-chan time.Time
+	if !deadline.IsZero() {
+		d := time.Until(deadline)
+		if d <= 0 {
+			return os.ErrDeadlineExceeded
+		}
+		timer := time.NewTimer(d)
+		defer timer.Stop()
+		timeout = timer.C
+	}
+
+	select {
+	case <-notify:
+		return nil
+	case <-st.done:
+		if st.session.isClosed() {
+			return ErrSessionClosed
+		}
+		return nil
+	case <-timeout:
+		return os.ErrDeadlineExceeded
+	case <-st.session.closed:
+		return ErrSessionClosed
+	}
+}
+
+func poke(ch chan struct{}) {
+	select {
+	case ch <- struct{}{}:
+	default:
+	}
+}
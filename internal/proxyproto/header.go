@@ -0,0 +1,120 @@
+package proxyproto
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"net"
+)
+
+// HAProxy PROXY protocol versions
+// https://www.haproxy.org/download/2.9/doc/proxy-protocol.txt
+const (
+	Version1 = 1
+	Version2 = 2
+)
+
+var v2Signature = []byte("\r\n\r\n\x00\r\nQUIT\n")
+
+const (
+	v2CommandLocal = 0x20
+	v2CommandProxy = 0x21
+
+	v2FamilyUnspec = 0x00
+	v2FamilyTCP4   = 0x11
+	v2FamilyTCP6   = 0x21
+)
+
+// Header describes a connection as seen by the proxy. A nil Source or
+// Destination is sent as UNKNOWN (v1) or LOCAL (v2).
+type Header struct {
+	Version     int
+	Source      *net.TCPAddr
+	Destination *net.TCPAddr
+}
+
+// ParseVersion maps the flag values "v1"/"1" and "v2"/"2" to a version.
+func ParseVersion(v string) (int, error) {
+	switch v {
+	case "v1", "1":
+		return Version1, nil
+	case "v2", "2":
+		return Version2, nil
+	}
+	return 0, fmt.Errorf("unsupported PROXY protocol version %q", v)
+}
+
+func (h *Header) Format() ([]byte, error) {
+	switch h.Version {
+	case Version1:
+		return h.formatV1(), nil
+	case Version2:
+		return h.formatV2(), nil
+	}
+	return nil, fmt.Errorf("unsupported PROXY protocol version %d", h.Version)
+}
+
+func (h *Header) WriteTo(w io.Writer) (int64, error) {
+	b, err := h.Format()
+	if err != nil {
+		return 0, err
+	}
+	n, err := w.Write(b)
+	return int64(n), err
+}
+
+func (h *Header) formatV1() []byte {
+	src, dst, v4, ok := h.addresses()
+	if !ok {
+		return []byte("PROXY UNKNOWN\r\n")
+	}
+	family := "TCP6"
+	if v4 {
+		family = "TCP4"
+	}
+	return []byte(fmt.Sprintf("PROXY %s %s %s %d %d\r\n", family, v1Address(src, v4), v1Address(dst, v4), h.Source.Port, h.Destination.Port))
+}
+
+func v1Address(ip net.IP, v4 bool) string {
+	if ip4 := ip.To4(); ip4 != nil && !v4 {
+		return "::ffff:" + ip4.String()
+	}
+	return ip.String()
+}
+
+func (h *Header) formatV2() []byte {
+	var buf bytes.Buffer
+	buf.Write(v2Signature)
+
+	src, dst, v4, ok := h.addresses()
+	if !ok {
+		buf.Write([]byte{v2CommandLocal, v2FamilyUnspec, 0, 0})
+		return buf.Bytes()
+	}
+
+	family := byte(v2FamilyTCP6)
+	if v4 {
+		family = v2FamilyTCP4
+	}
+	buf.Write([]byte{v2CommandProxy, family})
+	binary.Write(&buf, binary.BigEndian, uint16(len(src)+len(dst)+4))
+	buf.Write(src)
+	buf.Write(dst)
+	binary.Write(&buf, binary.BigEndian, uint16(h.Source.Port))
+	binary.Write(&buf, binary.BigEndian, uint16(h.Destination.Port))
+	return buf.Bytes()
+}
+
+// addresses returns both IPs in a common family, mapping IPv4 into IPv6
+// when the two sides differ.
+func (h *Header) addresses() (src, dst net.IP, v4 bool, ok bool) {
+	if h.Source == nil || h.Destination == nil || h.Source.IP == nil || h.Destination.IP == nil {
+		return nil, nil, false, false
+	}
+	src4, dst4 := h.Source.IP.To4(), h.Destination.IP.To4()
+	if src4 != nil && dst4 != nil {
+		return src4, dst4, true, true
+	}
+	return h.Source.IP.To16(), h.Destination.IP.To16(), false, true
+}
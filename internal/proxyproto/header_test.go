@@ -0,0 +1,84 @@
+package proxyproto
+
+import (
+	"bytes"
+	"net"
+	"testing"
+)
+
+func tcpAddr(ip string, port int) *net.TCPAddr {
+	return &net.TCPAddr{IP: net.ParseIP(ip), Port: port}
+}
+
+func TestFormatV1(t *testing.T) {
+	tests := []struct {
+		name     string
+		src, dst *net.TCPAddr
+		want     string
+	}{
+		{"tcp4", tcpAddr("203.0.113.7", 51234), tcpAddr("10.0.0.1", 8080), "PROXY TCP4 203.0.113.7 10.0.0.1 51234 8080\r\n"},
+		{"tcp6", tcpAddr("2001:db8::1", 443), tcpAddr("2001:db8::2", 8443), "PROXY TCP6 2001:db8::1 2001:db8::2 443 8443\r\n"},
+		{"mixed families", tcpAddr("203.0.113.7", 1), tcpAddr("::1", 2), "PROXY TCP6 ::ffff:203.0.113.7 ::1 1 2\r\n"},
+		{"unknown source", nil, tcpAddr("10.0.0.1", 8080), "PROXY UNKNOWN\r\n"},
+	}
+	for _, tt := range tests {
+		h := &Header{Version: Version1, Source: tt.src, Destination: tt.dst}
+		got, err := h.Format()
+		if err != nil || string(got) != tt.want {
+			t.Errorf("%s: Format() = %q, %v; want %q", tt.name, got, err, tt.want)
+		}
+	}
+}
+
+func TestFormatV2(t *testing.T) {
+	h := &Header{Version: Version2, Source: tcpAddr("203.0.113.7", 0x1234), Destination: tcpAddr("10.0.0.1", 0x1F90)}
+	got, err := h.Format()
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := append(append([]byte{}, v2Signature...),
+		0x21, 0x11, 0x00, 0x0C,
+		203, 0, 113, 7,
+		10, 0, 0, 1,
+		0x12, 0x34,
+		0x1F, 0x90,
+	)
+	if !bytes.Equal(got, want) {
+		t.Errorf("TCP4 header = %x; want %x", got, want)
+	}
+
+	h = &Header{Version: Version2, Source: tcpAddr("2001:db8::1", 1), Destination: tcpAddr("2001:db8::2", 2)}
+	got, _ = h.Format()
+	if len(got) != 16+36 || got[13] != v2FamilyTCP6 {
+		t.Errorf("TCP6 header = %x; want a 36 byte TCP6 address block", got)
+	}
+
+	got, _ = (&Header{Version: Version2}).Format()
+	want = append(append([]byte{}, v2Signature...), 0x20, 0x00, 0x00, 0x00)
+	if !bytes.Equal(got, want) {
+		t.Errorf("LOCAL header = %x; want %x", got, want)
+	}
+}
+
+func TestFormatUnsupportedVersion(t *testing.T) {
+	if _, err := (&Header{Version: 3}).Format(); err == nil {
+		t.Error("formatted a version 3 header")
+	}
+	var buf bytes.Buffer
+	if _, err := (&Header{}).WriteTo(&buf); err == nil || buf.Len() != 0 {
+		t.Errorf("WriteTo without a version wrote %q, %v", buf.Bytes(), err)
+	}
+}
+
+func TestParseVersion(t *testing.T) {
+	for in, want := range map[string]int{"v1": Version1, "1": Version1, "v2": Version2, "2": Version2} {
+		if got, err := ParseVersion(in); err != nil || got != want {
+			t.Errorf("ParseVersion(%q) = %d, %v; want %d", in, got, err, want)
+		}
+	}
+	for _, in := range []string{"", "v3", "V1"} {
+		if _, err := ParseVersion(in); err == nil {
+			t.Errorf("ParseVersion(%q) succeeded", in)
+		}
+	}
+}
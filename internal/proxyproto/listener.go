@@ -0,0 +1,214 @@
+package proxyproto
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+const maxV1HeaderLen = 107
+
+// Listener accepts PROXY protocol v1/v2 headers on connections coming from
+// one of the Allowed networks. Connections from anywhere else are passed
+// through untouched, so a forged header is never trusted.
+type Listener struct {
+	net.Listener
+	Allowed       []*net.IPNet
+	HeaderTimeout time.Duration
+}
+
+func (l *Listener) Accept() (net.Conn, error) {
+	conn, err := l.Listener.Accept()
+	if err != nil {
+		return nil, err
+	}
+	if !l.allowed(conn.RemoteAddr()) {
+		return conn, nil
+	}
+	return &Conn{
+		Conn:    conn,
+		reader:  bufio.NewReader(conn),
+		timeout: l.HeaderTimeout,
+	}, nil
+}
+
+func (l *Listener) allowed(addr net.Addr) bool {
+	tcpAddr, ok := addr.(*net.TCPAddr)
+	if !ok {
+		return false
+	}
+	for _, n := range l.Allowed {
+		if n.Contains(tcpAddr.IP) {
+			return true
+		}
+	}
+	return false
+}
+
+// Conn reads an optional PROXY protocol header the first time it is read
+// from or asked for its addresses.
+type Conn struct {
+	net.Conn
+	reader  *bufio.Reader
+	timeout time.Duration
+
+	once   sync.Once
+	header *Header
+	err    error
+}
+
+func (c *Conn) Read(b []byte) (int, error) {
+	c.once.Do(c.readHeader)
+	if c.err != nil {
+		return 0, c.err
+	}
+	return c.reader.Read(b)
+}
+
+func (c *Conn) RemoteAddr() net.Addr {
+	c.once.Do(c.readHeader)
+	if c.header != nil && c.header.Source != nil {
+		return c.header.Source
+	}
+	return c.Conn.RemoteAddr()
+}
+
+func (c *Conn) LocalAddr() net.Addr {
+	c.once.Do(c.readHeader)
+	if c.header != nil && c.header.Destination != nil {
+		return c.header.Destination
+	}
+	return c.Conn.LocalAddr()
+}
+
+func (c *Conn) readHeader() {
+	if c.timeout > 0 {
+		c.Conn.SetReadDeadline(time.Now().Add(c.timeout))
+		defer c.Conn.SetReadDeadline(time.Time{})
+	}
+	c.header, c.err = Read(c.reader)
+	if c.err != nil {
+		c.Conn.Close()
+	}
+}
+
+// Read parses a PROXY protocol header from r if one is present. It returns a
+// nil Header when the stream does not start with one.
+func Read(r *bufio.Reader) (*Header, error) {
+	first, err := r.Peek(1)
+	if err != nil {
+		return nil, nil
+	}
+	switch first[0] {
+	case 'P':
+		prefix, err := r.Peek(6)
+		if string(prefix) == "PROXY " {
+			return readV1(r)
+		}
+		if err != nil && strings.HasPrefix("PROXY ", string(prefix)) {
+			// The header was cut off before it could be recognized
+			return nil, err
+		}
+	case '\r':
+		sig, err := r.Peek(len(v2Signature))
+		if bytes.Equal(sig, v2Signature) {
+			return readV2(r)
+		}
+		if err != nil && bytes.HasPrefix(v2Signature, sig) {
+			return nil, err
+		}
+	}
+	return nil, nil
+}
+
+func readV1(r *bufio.Reader) (*Header, error) {
+	var line []byte
+	for len(line) < maxV1HeaderLen {
+		b, err := r.ReadByte()
+		if err != nil {
+			return nil, err
+		}
+		line = append(line, b)
+		if b == '\n' {
+			break
+		}
+	}
+	if !bytes.HasSuffix(line, []byte("\r\n")) {
+		return nil, fmt.Errorf("proxyproto: v1 header too long")
+	}
+
+	fields := strings.Fields(string(line))
+	header := &Header{Version: Version1}
+	if len(fields) >= 2 && fields[1] == "UNKNOWN" {
+		return header, nil
+	}
+	if len(fields) != 6 || (fields[1] != "TCP4" && fields[1] != "TCP6") {
+		return nil, fmt.Errorf("proxyproto: malformed v1 header %q", strings.TrimSpace(string(line)))
+	}
+
+	src, err := v1Addr(fields[2], fields[4])
+	if err != nil {
+		return nil, err
+	}
+	dst, err := v1Addr(fields[3], fields[5])
+	if err != nil {
+		return nil, err
+	}
+	header.Source, header.Destination = src, dst
+	return header, nil
+}
+
+func v1Addr(ip, port string) (*net.TCPAddr, error) {
+	parsed := net.ParseIP(ip)
+	if parsed == nil {
+		return nil, fmt.Errorf("proxyproto: invalid address %q", ip)
+	}
+	p, err := strconv.ParseUint(port, 10, 16)
+	if err != nil {
+		return nil, fmt.Errorf("proxyproto: invalid port %q", port)
+	}
+	return &net.TCPAddr{IP: parsed, Port: int(p)}, nil
+}
+
+func readV2(r *bufio.Reader) (*Header, error) {
+	fixed := make([]byte, 16)
+	if _, err := io.ReadFull(r, fixed); err != nil {
+		return nil, err
+	}
+	if fixed[12]>>4 != 2 {
+		return nil, fmt.Errorf("proxyproto: unsupported v2 version %d", fixed[12]>>4)
+	}
+
+	body := make([]byte, binary.BigEndian.Uint16(fixed[14:]))
+	if _, err := io.ReadFull(r, body); err != nil {
+		return nil, err
+	}
+
+	header := &Header{Version: Version2}
+	if fixed[12] != v2CommandProxy {
+		return header, nil
+	}
+
+	switch fixed[13] {
+	case v2FamilyTCP4:
+		if len(body) < 12 {
+			return nil, fmt.Errorf("proxyproto: short v2 TCP4 address block")
+		}
+		header.Source = &net.TCPAddr{IP: net.IP(body[0:4]), Port: int(binary.BigEndian.Uint16(body[8:10]))}
+		header.Destination = &net.TCPAddr{IP: net.IP(body[4:8]), Port: int(binary.BigEndian.Uint16(body[10:12]))}
+	case v2FamilyTCP6:
+		if len(body) < 36 {
+			return nil, fmt.Errorf("proxyproto: short v2 TCP6 address block")
+		}
+		header.Source = &net.TCPAddr{IP: net.IP(body[0:16]), Port: int(binary.BigEndian.Uint16(body[32:34]))}
+		header.Destination = &net.TCPAddr{IP: net.IP(body[16:32]), Port: int(binary.BigEndian.Uint16(body[34:36]))}
+	}
+	return header, nil
+}
@@ -0,0 +1,232 @@
+package proxyproto
+
+import (
+	"bufio"
+	"bytes"
+	"io"
+	"net"
+	"strings"
+	"testing"
+	"time"
+)
+
+func read(data []byte) (*Header, string, error) {
+	r := bufio.NewReader(bytes.NewReader(data))
+	h, err := Read(r)
+	rest, _ := io.ReadAll(r)
+	return h, string(rest), err
+}
+
+func v2Header(command, family byte, body ...byte) []byte {
+	b := append(append([]byte{}, v2Signature...), command, family, byte(len(body)>>8), byte(len(body)))
+	return append(b, body...)
+}
+
+func TestRead(t *testing.T) {
+	tcp6Body := append(append(net.ParseIP("2001:db8::1").To16(), net.ParseIP("2001:db8::2").To16()...), 0x01, 0xBB, 0x20, 0xFB)
+
+	tests := []struct {
+		name     string
+		data     []byte
+		version  int    // 0 if no header is expected
+		src, dst string // "" if the address is unknown
+	}{
+		{"no header", []byte("GET / HTTP/1.1\r\n"), 0, "", ""},
+		{"empty", nil, 0, "", ""},
+		{"almost v1", []byte("PROXYGET"), 0, "", ""},
+		{"almost v2", []byte("\r\n\r\nGET"), 0, "", ""},
+		{"v1 tcp4", []byte("PROXY TCP4 203.0.113.7 10.0.0.1 51234 8080\r\nGET"), Version1, "203.0.113.7:51234", "10.0.0.1:8080"},
+		{"v1 tcp6", []byte("PROXY TCP6 2001:db8::1 2001:db8::2 443 8443\r\nGET"), Version1, "[2001:db8::1]:443", "[2001:db8::2]:8443"},
+		{"v1 unknown", []byte("PROXY UNKNOWN ffff::1 ffff::2 1 2\r\nGET"), Version1, "", ""},
+		{"v2 tcp4", append(v2Header(0x21, 0x11, 203, 0, 113, 7, 10, 0, 0, 1, 0xC8, 0x22, 0x1F, 0x90), 'G'), Version2, "203.0.113.7:51234", "10.0.0.1:8080"},
+		{"v2 tcp6", append(v2Header(0x21, 0x21, tcp6Body...), 'G'), Version2, "[2001:db8::1]:443", "[2001:db8::2]:8443"},
+		{"v2 local", append(v2Header(0x20, 0x00), 'G'), Version2, "", ""},
+		{"v2 unspec", append(v2Header(0x21, 0x00, 1, 2, 3), 'G'), Version2, "", ""},
+		{"v2 with TLVs", v2Header(0x21, 0x11, 203, 0, 113, 7, 10, 0, 0, 1, 0xC8, 0x22, 0x1F, 0x90, 0x04, 0x00, 0x01, 'x'), Version2, "203.0.113.7:51234", "10.0.0.1:8080"},
+	}
+	for _, tt := range tests {
+		h, rest, err := read(tt.data)
+		if err != nil {
+			t.Errorf("%s: %v", tt.name, err)
+			continue
+		}
+		if tt.version == 0 {
+			if h != nil {
+				t.Errorf("%s: got header %+v; want none", tt.name, h)
+			}
+			if rest != string(tt.data) {
+				t.Errorf("%s: stream = %q; want it untouched", tt.name, rest)
+			}
+			continue
+		}
+		if h == nil || h.Version != tt.version {
+			t.Errorf("%s: header = %+v; want version %d", tt.name, h, tt.version)
+			continue
+		}
+		if got := addrString(h.Source); got != tt.src {
+			t.Errorf("%s: source = %q; want %q", tt.name, got, tt.src)
+		}
+		if got := addrString(h.Destination); got != tt.dst {
+			t.Errorf("%s: destination = %q; want %q", tt.name, got, tt.dst)
+		}
+		if tt.name != "v2 with TLVs" && rest != "GET" && rest != "G" {
+			t.Errorf("%s: data after the header = %q", tt.name, rest)
+		}
+	}
+}
+
+func addrString(addr *net.TCPAddr) string {
+	if addr == nil {
+		return ""
+	}
+	return addr.String()
+}
+
+func TestReadMalformed(t *testing.T) {
+	for name, data := range map[string][]byte{
+		"v1 too long":       []byte("PROXY TCP4 " + strings.Repeat("1", 120) + "\r\n"),
+		"v1 no CRLF":        []byte("PROXY TCP4 1.2.3.4 5.6.7.8 1 2\n"),
+		"v1 truncated":      []byte("PROXY TCP4 1.2.3.4"),
+		"v1 bad family":     []byte("PROXY UDP4 1.2.3.4 5.6.7.8 1 2\r\n"),
+		"v1 missing port":   []byte("PROXY TCP4 1.2.3.4 5.6.7.8 1\r\n"),
+		"v1 bad address":    []byte("PROXY TCP4 1.2.3 5.6.7.8 1 2\r\n"),
+		"v1 port too large": []byte("PROXY TCP4 1.2.3.4 5.6.7.8 65536 2\r\n"),
+		"v1 signed port":    []byte("PROXY TCP4 1.2.3.4 5.6.7.8 +1 2\r\n"),
+		"v1 cut off":        []byte("PROX"),
+		"v2 cut off":        v2Signature[:5],
+		"v2 version 1":      append(append([]byte{}, v2Signature...), 0x11, 0x11, 0, 0),
+		"v2 truncated":      append(append([]byte{}, v2Signature...), 0x21, 0x11),
+		"v2 short body":     append(append([]byte{}, v2Signature...), 0x21, 0x11, 0, 12, 1, 2, 3),
+		"v2 short tcp4":     v2Header(0x21, 0x11, 1, 2, 3, 4),
+		"v2 short tcp6":     v2Header(0x21, 0x21, make([]byte, 35)...),
+	} {
+		if h, _, err := read(data); err == nil {
+			t.Errorf("%s: got header %+v; want an error", name, h)
+		}
+	}
+}
+
+// TestFormatRead checks that headers written for the origin read back the
+// same.
+func TestFormatRead(t *testing.T) {
+	for _, version := range []int{Version1, Version2} {
+		for _, addrs := range [][2]*net.TCPAddr{
+			{tcpAddr("203.0.113.7", 51234), tcpAddr("10.0.0.1", 8080)},
+			{tcpAddr("2001:db8::1", 443), tcpAddr("2001:db8::2", 8443)},
+			{tcpAddr("203.0.113.7", 1), tcpAddr("::1", 2)},
+		} {
+			want := &Header{Version: version, Source: addrs[0], Destination: addrs[1]}
+			data, _ := want.Format()
+			got, rest, err := read(append(data, "GET"...))
+			if err != nil || rest != "GET" {
+				t.Fatalf("v%d %v: Read = %v, rest %q", version, addrs, err, rest)
+			}
+			if !sameAddr(got.Source, want.Source) || !sameAddr(got.Destination, want.Destination) {
+				t.Errorf("v%d: read %v -> %v; want %v -> %v", version, got.Source, got.Destination, want.Source, want.Destination)
+			}
+		}
+	}
+}
+
+func sameAddr(a, b *net.TCPAddr) bool {
+	if a == nil || b == nil {
+		return a == b
+	}
+	return a.IP.Equal(b.IP) && a.Port == b.Port
+}
+
+func TestListener(t *testing.T) {
+	for _, tt := range []struct {
+		name    string
+		allowed string
+		want    string
+	}{
+		{"trusted source", "127.0.0.0/8", "203.0.113.7:51234"},
+		{"untrusted source", "10.0.0.0/8", ""},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			_, allowed, _ := net.ParseCIDR(tt.allowed)
+			inner, err := net.Listen("tcp", "127.0.0.1:0")
+			if err != nil {
+				t.Fatal(err)
+			}
+			ln := &Listener{Listener: inner, Allowed: []*net.IPNet{allowed}, HeaderTimeout: time.Second}
+			defer ln.Close()
+
+			go func() {
+				conn, err := net.Dial("tcp", inner.Addr().String())
+				if err != nil {
+					return
+				}
+				defer conn.Close()
+				conn.Write([]byte("PROXY TCP4 203.0.113.7 10.0.0.1 51234 8080\r\nhello"))
+				io.Copy(io.Discard, conn)
+			}()
+
+			conn, err := ln.Accept()
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer conn.Close()
+
+			want := tt.want
+			if want == "" {
+				want = conn.(*net.TCPConn).RemoteAddr().String()
+			}
+			if got := conn.RemoteAddr().String(); got != want {
+				t.Errorf("RemoteAddr = %s; want %s", got, want)
+			}
+
+			// An untrusted header is left in the stream for the server to reject
+			wantData := "hello"
+			if tt.want == "" {
+				wantData = "PROXY TCP4 203.0.113.7 10.0.0.1 51234 8080\r\nhello"
+			}
+			buf := make([]byte, len(wantData))
+			if _, err := io.ReadFull(conn, buf); err != nil || string(buf) != wantData {
+				t.Errorf("read %q, %v; want %q", buf, err, wantData)
+			}
+		})
+	}
+}
+
+func TestConnHeaderTimeout(t *testing.T) {
+	client, server := net.Pipe()
+	defer client.Close()
+	conn := &Conn{Conn: server, reader: bufio.NewReader(server), timeout: 50 * time.Millisecond}
+
+	go client.Write([]byte("PROX"))
+	if _, err := conn.Read(make([]byte, 1)); err == nil {
+		t.Error("read succeeded without a complete header")
+	}
+}
+
+func FuzzRead(f *testing.F) {
+	f.Add([]byte("PROXY TCP4 203.0.113.7 10.0.0.1 51234 8080\r\nGET"))
+	f.Add([]byte("PROXY TCP6 2001:db8::1 2001:db8::2 443 8443\r\n"))
+	f.Add([]byte("PROXY UNKNOWN\r\n"))
+	f.Add([]byte("GET / HTTP/1.1\r\n"))
+	f.Add(v2Header(0x21, 0x11, 203, 0, 113, 7, 10, 0, 0, 1, 0xC8, 0x22, 0x1F, 0x90))
+	f.Add(v2Header(0x21, 0x21, make([]byte, 36)...))
+	f.Add(v2Header(0x20, 0x00))
+
+	f.Fuzz(func(t *testing.T, data []byte) {
+		h, _, err := read(data)
+		if err != nil || h == nil {
+			return
+		}
+
+		// Whatever was accepted formats to a header that reads back the same
+		again, err := h.Format()
+		if err != nil {
+			t.Fatalf("Format(%+v): %v", h, err)
+		}
+		h2, _, err := read(again)
+		if err != nil || h2 == nil {
+			t.Fatalf("reading back %q: %+v, %v", again, h2, err)
+		}
+		if !sameAddr(h2.Source, h.Source) || !sameAddr(h2.Destination, h.Destination) {
+			t.Fatalf("round trip %v -> %v became %v -> %v", h.Source, h.Destination, h2.Source, h2.Destination)
+		}
+	})
+}
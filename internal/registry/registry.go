@@ -0,0 +1,108 @@
+package registry
+
+import (
+	"context"
+	"errors"
+	"log"
+	"sync"
+	"time"
+)
+
+// Entry is what the server knows about a subdomain beyond its live
+// connections.
+type Entry struct {
+	Subdomain string    `json:"subdomain"`
+	Hostnames []string  `json:"hostnames,omitempty"`
+	Mode      string    `json:"mode,omitempty"`
+	Connected bool      `json:"connected"`
+	LastSeen  time.Time `json:"last_seen"`
+	// Reserved entries are kept after their clients disconnect.
+	Reserved bool              `json:"reserved,omitempty"`
+	Owner    string            `json:"owner,omitempty"`
+	Metadata map[string]string `json:"metadata,omitempty"`
+	// Domains are the custom hostnames verified for the subdomain, which
+	// keep the entry like a reservation does.
+	Domains []string `json:"domains,omitempty"`
+}
+
+// Kept reports whether the entry stays in the registry while no client is
+// connected for it.
+func (e Entry) Kept() bool {
+	return e.Reserved || len(e.Domains) > 0
+}
+
+type EventType int
+
+const (
+	Registered EventType = iota
+	Removed
+)
+
+type Event struct {
+	Type  EventType
+	Entry Entry
+}
+
+// ErrSuspended is returned for changes made while the registry is
+// suspended.
+var ErrSuspended = errors.New("registry: suspended while another process takes over")
+
+// Registry holds tunnel state that outlives a single connection.
+type Registry interface {
+	// Register adds or replaces the entry for entry.Subdomain.
+	Register(entry Entry) error
+	Lookup(subdomain string) (Entry, bool, error)
+	Remove(subdomain string) error
+	// Update changes the entry for subdomain without losing changes made
+	// concurrently, by this process or another. update is given the current
+	// entry, if any, and returns the entry to store, or nil to remove it;
+	// it is called again if the entry changed in the meantime. An error
+	// from update leaves the entry alone and is returned. Update returns
+	// the entry as stored.
+	Update(subdomain string, update func(entry Entry, ok bool) (*Entry, error)) (Entry, error)
+	List() ([]Entry, error)
+	// Watch reports changes made through this registry until ctx is done.
+	Watch(ctx context.Context) <-chan Event
+	// Suspend refuses changes with ErrSuspended until Resume, while another
+	// process takes over the backend. Lookups keep working.
+	Suspend()
+	Resume()
+}
+
+// watchers fans events out to Watch callers. A watcher that falls behind
+// misses events rather than blocking the registry.
+type watchers struct {
+	mu   sync.Mutex
+	subs map[chan Event]struct{}
+}
+
+func (w *watchers) watch(ctx context.Context) <-chan Event {
+	ch := make(chan Event, 256)
+	w.mu.Lock()
+	if w.subs == nil {
+		w.subs = make(map[chan Event]struct{})
+	}
+	w.subs[ch] = struct{}{}
+	w.mu.Unlock()
+
+	go func() {
+		<-ctx.Done()
+		w.mu.Lock()
+		delete(w.subs, ch)
+		w.mu.Unlock()
+		close(ch)
+	}()
+	return ch
+}
+
+func (w *watchers) notify(event Event) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	for ch := range w.subs {
+		select {
+		case ch <- event:
+		default:
+			log.Printf("Registry watcher is falling behind, dropped event for %s", event.Entry.Subdomain)
+		}
+	}
+}
@@ -0,0 +1,184 @@
+package registry
+
+import (
+	"context"
+	"encoding/json"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/ghousemohamed/simple-tunnel/internal/cluster"
+)
+
+const (
+	keyPrefix    = "registry/"
+	storeTimeout = 5 * time.Second
+)
+
+// storeRegistry keeps one JSON entry per subdomain in a cluster store, so
+// the registry lives in memory, in a directory or on a Redis-compatible
+// server shared by several nodes, depending on the store.
+type storeRegistry struct {
+	store cluster.Store
+
+	mu        sync.RWMutex
+	suspended bool
+	watchers
+}
+
+// New returns a registry backed by store. Entries never expire.
+func New(store cluster.Store) Registry {
+	return &storeRegistry{store: store}
+}
+
+func (s *storeRegistry) Register(entry Entry) error {
+	data, err := json.Marshal(entry)
+	if err != nil {
+		return err
+	}
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	if s.suspended {
+		return ErrSuspended
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), storeTimeout)
+	defer cancel()
+	if err := s.store.Set(ctx, keyPrefix+entry.Subdomain, string(data), 0); err != nil {
+		return err
+	}
+	s.notify(Event{Type: Registered, Entry: entry})
+	return nil
+}
+
+func (s *storeRegistry) Lookup(subdomain string) (Entry, bool, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), storeTimeout)
+	defer cancel()
+	entry, _, ok, err := s.get(ctx, subdomain)
+	return entry, ok, err
+}
+
+func (s *storeRegistry) Remove(subdomain string) error {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	if s.suspended {
+		return ErrSuspended
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), storeTimeout)
+	defer cancel()
+	entry, raw, ok, err := s.get(ctx, subdomain)
+	if err != nil || !ok {
+		return err
+	}
+	if err := s.store.Delete(ctx, keyPrefix+subdomain, raw); err != nil {
+		return err
+	}
+	s.notify(Event{Type: Removed, Entry: entry})
+	return nil
+}
+
+func (s *storeRegistry) Update(subdomain string, update func(entry Entry, ok bool) (*Entry, error)) (Entry, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	if s.suspended {
+		return Entry{}, ErrSuspended
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), storeTimeout)
+	defer cancel()
+	for {
+		entry, raw, ok, err := s.get(ctx, subdomain)
+		if err != nil {
+			return Entry{}, err
+		}
+		next, err := update(entry, ok)
+		if err != nil {
+			return entry, err
+		}
+		if next == nil && !ok {
+			return Entry{}, nil
+		}
+
+		var data []byte
+		if next != nil {
+			next.Subdomain = subdomain
+			if data, err = json.Marshal(next); err != nil {
+				return Entry{}, err
+			}
+		}
+		swapped, err := s.store.CompareAndSwap(ctx, keyPrefix+subdomain, raw, string(data))
+		if err != nil {
+			return Entry{}, err
+		}
+		if !swapped {
+			// Changed since it was read, so decide again on the new entry
+			if err := ctx.Err(); err != nil {
+				return Entry{}, err
+			}
+			continue
+		}
+
+		if next == nil {
+			s.notify(Event{Type: Removed, Entry: entry})
+			return Entry{}, nil
+		}
+		s.notify(Event{Type: Registered, Entry: *next})
+		return *next, nil
+	}
+}
+
+func (s *storeRegistry) List() ([]Entry, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), storeTimeout)
+	defer cancel()
+	keys, err := s.store.List(ctx, keyPrefix)
+	if err != nil {
+		return nil, err
+	}
+
+	entries := make([]Entry, 0, len(keys))
+	for _, key := range keys {
+		entry, _, ok, err := s.get(ctx, strings.TrimPrefix(key, keyPrefix))
+		if err != nil {
+			return nil, err
+		}
+		if ok {
+			entries = append(entries, entry)
+		}
+	}
+	sort.Slice(entries, func(i, j int) bool {
+		return entries[i].Subdomain < entries[j].Subdomain
+	})
+	return entries, nil
+}
+
+func (s *storeRegistry) Watch(ctx context.Context) <-chan Event {
+	return s.watch(ctx)
+}
+
+func (s *storeRegistry) Suspend() {
+	s.mu.Lock()
+	s.suspended = true
+	s.mu.Unlock()
+}
+
+func (s *storeRegistry) Resume() {
+	s.mu.Lock()
+	s.suspended = false
+	s.mu.Unlock()
+}
+
+// get returns the entry for subdomain along with its stored form, which
+// Remove and Update need to change it only if nobody changed it since.
+func (s *storeRegistry) get(ctx context.Context, subdomain string) (Entry, string, bool, error) {
+	raw, ok, err := s.store.Get(ctx, keyPrefix+subdomain)
+	if err != nil || !ok {
+		return Entry{}, "", false, err
+	}
+	var entry Entry
+	if err := json.Unmarshal([]byte(raw), &entry); err != nil {
+		return Entry{}, "", false, err
+	}
+	return entry, raw, true, nil
+}
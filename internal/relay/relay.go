@@ -0,0 +1,216 @@
+// Package relay copies the bytes of an upgraded connection between its two
+// ends. For WebSockets it follows the frames passively, so it can tell why
+// a connection ended, enforce a message size limit and stand in for an end
+// that vanished without a closing handshake.
+package relay
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"sync"
+	"time"
+
+	"github.com/ghousemohamed/simple-tunnel/internal/wsframe"
+)
+
+// closeTimeout is how long the other end has to answer a close frame
+// before both connections are torn down.
+const closeTimeout = 5 * time.Second
+
+// Side is one end of a relayed connection.
+type Side struct {
+	// Name identifies the side in the result, e.g. "visitor".
+	Name string
+	Conn net.Conn
+	// Reader reads from Conn, including anything buffered while the
+	// upgrade was negotiated.
+	Reader io.Reader
+	// Mask is whether frames we send to this side must be masked, which is
+	// the case when we stand in for the WebSocket client towards it.
+	Mask bool
+}
+
+// Result tells how a relayed connection ended.
+type Result struct {
+	// ClosedBy names the side that started the closing handshake or went
+	// away.
+	ClosedBy string
+	// Code and Reason come from the first close frame. Code is
+	// CloseAbnormal when a WebSocket ended without one.
+	Code   int
+	Reason string
+	// Err is the error that ended the connection, if any.
+	Err error
+}
+
+func (r Result) String() string {
+	switch {
+	case r.Code == wsframe.CloseAbnormal && r.Err != nil:
+		return fmt.Sprintf("dropped by %s without a close frame: %v", r.ClosedBy, r.Err)
+	case r.Code == wsframe.CloseAbnormal:
+		return fmt.Sprintf("dropped by %s without a close frame", r.ClosedBy)
+	case r.Code != 0:
+		return fmt.Sprintf("closed by %s: %d %q", r.ClosedBy, r.Code, r.Reason)
+	case r.Err != nil:
+		return fmt.Sprintf("ended by %s: %v", r.ClosedBy, r.Err)
+	}
+	return fmt.Sprintf("closed by %s", r.ClosedBy)
+}
+
+// Options configure a relay.
+type Options struct {
+	// WebSocket enables following the frames in both directions.
+	WebSocket bool
+	// Limit is the largest WebSocket message allowed; zero means no limit.
+	Limit int64
+}
+
+// Relay copies bytes between a and b until both directions have ended,
+// passing on half-closes.
+func Relay(a, b Side, opts Options) Result {
+	r := &relay{}
+	aToB := r.direction(a, b, opts)
+	bToA := r.direction(b, a, opts)
+	opposite := map[*direction]*direction{aToB: bToA, bToA: aToB}
+	defer r.stopTimer()
+
+	type ended struct {
+		d   *direction
+		err error
+	}
+	done := make(chan ended, 2)
+	for _, d := range []*direction{aToB, bToA} {
+		go func(d *direction) {
+			_, err := io.Copy(d, d.src.Reader)
+			done <- ended{d: d, err: err}
+		}(d)
+	}
+
+	for i := 0; i < 2; i++ {
+		e := <-done
+		d, back := e.d, opposite[e.d]
+		var violation *wsframe.Error
+		switch {
+		case errors.As(e.err, &violation):
+			// The side broke the protocol or a limit; close both ends
+			// with the code for it
+			r.record(Result{ClosedBy: d.src.Name, Code: violation.Code, Reason: violation.Text})
+			d.writeClose(violation.Code)
+			back.writeClose(violation.Code)
+		case opts.WebSocket && !d.sentClose():
+			// The side went away without a closing handshake, so tell
+			// the other one instead of leaving it with a dead connection
+			r.record(Result{ClosedBy: d.src.Name, Code: wsframe.CloseAbnormal, Err: e.err})
+			d.writeClose(wsframe.CloseGoingAway)
+		default:
+			r.record(Result{ClosedBy: d.src.Name, Err: e.err})
+		}
+
+		if e.err != nil {
+			// Closing both sides ends the other direction too
+			a.Conn.Close()
+			b.Conn.Close()
+		} else if cw, ok := d.dst.Conn.(interface{ CloseWrite() error }); ok {
+			cw.CloseWrite()
+		}
+	}
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return r.result
+}
+
+type relay struct {
+	mu     sync.Mutex
+	result Result
+	set    bool
+	timer  *time.Timer
+}
+
+// record keeps the first reason the connection ended.
+func (r *relay) record(result Result) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if !r.set {
+		r.result, r.set = result, true
+	}
+}
+
+// closeStarted records a close frame and gives the other side closeTimeout
+// to finish the handshake.
+func (r *relay) closeStarted(from Side, payload []byte, a, b net.Conn) {
+	code, reason, _ := wsframe.ParseClose(payload)
+	r.record(Result{ClosedBy: from.Name, Code: code, Reason: reason})
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if r.timer == nil {
+		r.timer = time.AfterFunc(closeTimeout, func() {
+			a.Close()
+			b.Close()
+		})
+	}
+}
+
+func (r *relay) stopTimer() {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if r.timer != nil {
+		r.timer.Stop()
+	}
+}
+
+// direction forwards what src sends to dst.
+type direction struct {
+	src, dst Side
+	mu       sync.Mutex
+	tracker  *wsframe.Tracker
+	closed   bool
+}
+
+func (r *relay) direction(src, dst Side, opts Options) *direction {
+	d := &direction{src: src, dst: dst}
+	if opts.WebSocket {
+		d.tracker = &wsframe.Tracker{Limit: opts.Limit}
+		d.tracker.OnControl = func(op wsframe.Opcode, payload []byte) {
+			if op == wsframe.OpClose && !d.closed {
+				d.closed = true
+				r.closeStarted(src, payload, src.Conn, dst.Conn)
+			}
+		}
+	}
+	return d
+}
+
+func (d *direction) Write(p []byte) (int, error) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	if d.tracker != nil {
+		if n, err := d.tracker.Write(p); err != nil {
+			d.dst.Conn.Write(p[:n])
+			return n, err
+		}
+	}
+	return d.dst.Conn.Write(p)
+}
+
+func (d *direction) sentClose() bool {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	return d.closed
+}
+
+// writeClose sends dst a close frame of our own, unless its side of the
+// handshake already happened or the frame would land in the middle of
+// another one.
+func (d *direction) writeClose(code int) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	if d.tracker == nil || d.closed || !d.tracker.AtBoundary() {
+		return
+	}
+	d.closed = true
+	wsframe.NewWriter(d.dst.Conn, d.dst.Mask).WriteClose(code, "")
+}
@@ -0,0 +1,211 @@
+package server
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"io"
+	"log"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	maxBroadcastBody = 10 << 20
+	maxDeliveries    = 100
+)
+
+// delivery is the outcome of one broadcast request at one subscriber.
+type delivery struct {
+	Time       time.Time `json:"time"`
+	Method     string    `json:"method"`
+	Path       string    `json:"path"`
+	Subscriber string    `json:"subscriber"`
+	Primary    bool      `json:"primary"`
+	Status     int       `json:"status,omitempty"`
+	Error      string    `json:"error,omitempty"`
+	Duration   string    `json:"duration"`
+}
+
+type broadcastResult struct {
+	tunnel *TunnelConnection
+	resp   *http.Response
+	err    error
+}
+
+// broadcastMembers returns the members of a broadcast group, or nil if the
+// subdomain isn't served in broadcast mode.
+func (ts *TunnelServer) broadcastMembers(subdomain string) []*TunnelConnection {
+	ts.tunnelsLock.RLock()
+	defer ts.tunnelsLock.RUnlock()
+
+	group, ok := ts.tunnel[subdomain]
+	if !ok || !group.broadcast {
+		return nil
+	}
+	var members []*TunnelConnection
+	for _, member := range group.members {
+		if !member.isClosed() {
+			members = append(members, member)
+		}
+	}
+	return members
+}
+
+// broadcastRequest delivers r to every subscriber of the tunnel and answers
+// the sender with the primary subscriber's response, or the first successful
+// one when no primary is connected.
+func (ts *TunnelServer) broadcastRequest(w http.ResponseWriter, r *http.Request, subdomain string, members []*TunnelConnection, pathPrefix string) {
+	body, err := io.ReadAll(io.LimitReader(r.Body, maxBroadcastBody+1))
+	var tooLarge *http.MaxBytesError
+	if errors.As(err, &tooLarge) {
+		http.Error(w, "Request body too large", http.StatusRequestEntityTooLarge)
+		return
+	}
+	if err != nil {
+		http.Error(w, "Error reading request body", http.StatusBadRequest)
+		return
+	}
+	if len(body) > maxBroadcastBody {
+		http.Error(w, "Request body too large", http.StatusRequestEntityTooLarge)
+		return
+	}
+
+	var primary *TunnelConnection
+	for _, member := range members {
+		if member.primary {
+			primary = member
+			break
+		}
+	}
+
+	results := make(chan broadcastResult, len(members))
+	var wg sync.WaitGroup
+	for _, member := range members {
+		wg.Add(1)
+		go func(member *TunnelConnection) {
+			defer wg.Done()
+
+			// Deliveries outlive the sender's request, which ends as soon
+			// as one response has been relayed
+			req := r.Clone(context.WithoutCancel(r.Context()))
+			req.Body = io.NopCloser(bytes.NewReader(body))
+			req.ContentLength = int64(len(body))
+			req.TransferEncoding = nil
+
+			start := time.Now()
+			resp, err := member.roundTrip(req, nil)
+			// A slow or timed out delivery doesn't make the subscriber
+			// unreachable
+			if err != nil && member.isClosed() {
+				ts.removeTunnel(subdomain, member)
+			}
+			ts.recordDelivery(subdomain, r, member, resp, err, time.Since(start))
+			results <- broadcastResult{tunnel: member, resp: resp, err: err}
+		}(member)
+	}
+	go func() {
+		wg.Wait()
+		close(results)
+	}()
+
+	respond := func(resp *http.Response) {
+		go drainBroadcastResults(results)
+		defer resp.Body.Close()
+		ts.writeResponse(w, r, resp, subdomain, pathPrefix)
+	}
+
+	// Hold on to the first successful response in case the primary fails
+	var fallback *http.Response
+	primaryFailed := primary == nil
+	for result := range results {
+		if result.err != nil {
+			if result.tunnel == primary {
+				primaryFailed = true
+				if fallback != nil {
+					respond(fallback)
+					return
+				}
+			}
+			continue
+		}
+		if result.tunnel == primary || primaryFailed {
+			if fallback != nil {
+				discardResponse(fallback)
+			}
+			respond(result.resp)
+			return
+		}
+		if fallback == nil {
+			fallback = result.resp
+		} else {
+			discardResponse(result.resp)
+		}
+	}
+	if fallback != nil {
+		respond(fallback)
+		return
+	}
+
+	ts.renderError(w, r, http.StatusBadGateway, errorBadGateway, subdomain)
+}
+
+func drainBroadcastResults(results <-chan broadcastResult) {
+	for result := range results {
+		if result.resp != nil {
+			discardResponse(result.resp)
+		}
+	}
+}
+
+func discardResponse(resp *http.Response) {
+	io.Copy(io.Discard, resp.Body)
+	resp.Body.Close()
+}
+
+func (ts *TunnelServer) recordDelivery(subdomain string, r *http.Request, tunnel *TunnelConnection, resp *http.Response, err error, elapsed time.Duration) {
+	d := delivery{
+		Time:       time.Now(),
+		Method:     r.Method,
+		Path:       r.URL.Path,
+		Subscriber: tunnel.conn.RemoteAddr().String(),
+		Primary:    tunnel.primary,
+		Duration:   elapsed.String(),
+	}
+	if err != nil {
+		d.Error = err.Error()
+		log.Printf("Broadcast %s %s to %s failed: %v", r.Method, r.URL.Path, d.Subscriber, err)
+	} else {
+		d.Status = resp.StatusCode
+		log.Printf("Broadcast %s %s to %s: %d", r.Method, r.URL.Path, d.Subscriber, resp.StatusCode)
+	}
+
+	ts.deliveriesLock.Lock()
+	defer ts.deliveriesLock.Unlock()
+	deliveries := append(ts.deliveries[subdomain], d)
+	if len(deliveries) > maxDeliveries {
+		deliveries = deliveries[len(deliveries)-maxDeliveries:]
+	}
+	ts.deliveries[subdomain] = deliveries
+}
+
+// handleDeliveries lists recent broadcast outcomes for a subdomain to its
+// subscribers.
+func (ts *TunnelServer) handleDeliveries(w http.ResponseWriter, r *http.Request) {
+	subdomain := strings.ToLower(r.URL.Query().Get("subdomain"))
+	if subdomain == "" {
+		http.Error(w, "Subdomain not specified", http.StatusBadRequest)
+		return
+	}
+	if !ts.authorize(w, r, subdomain) {
+		return
+	}
+
+	ts.deliveriesLock.Lock()
+	deliveries := append([]delivery{}, ts.deliveries[subdomain]...)
+	ts.deliveriesLock.Unlock()
+
+	writeJSON(w, deliveries)
+}
@@ -0,0 +1,202 @@
+package server
+
+import (
+	"crypto/tls"
+	"fmt"
+	"log"
+	"net"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+)
+
+// certReloadInterval is how often certificate files are checked for changes.
+const certReloadInterval = 10 * time.Second
+
+// certStore holds the server's certificates and picks one for each TLS
+// handshake. The default certificate comes from --tls-cert/--tls-key, and
+// every <name>.crt/<name>.key pair in the certificate directory is served for
+// the names it covers.
+type certStore struct {
+	certFile string
+	keyFile  string
+	dir      string
+
+	mu       sync.RWMutex
+	fallback *tls.Certificate
+	byName   map[string]*tls.Certificate
+	stamp    string
+}
+
+func newCertStore(certFile, keyFile, dir string) (*certStore, error) {
+	if (certFile == "") != (keyFile == "") {
+		return nil, fmt.Errorf("--tls-cert and --tls-key must be given together")
+	}
+	cs := &certStore{certFile: certFile, keyFile: keyFile, dir: dir}
+	stamp, err := cs.currentStamp()
+	if err != nil {
+		return nil, err
+	}
+	if err := cs.load(stamp); err != nil {
+		return nil, err
+	}
+	return cs, nil
+}
+
+// getCertificate prefers a certificate from the directory matching the
+// requested name exactly, then one whose wildcard covers it, then the default.
+func (cs *certStore) getCertificate(hello *tls.ClientHelloInfo) (*tls.Certificate, error) {
+	cs.mu.RLock()
+	defer cs.mu.RUnlock()
+
+	name := strings.TrimSuffix(strings.ToLower(hello.ServerName), ".")
+	if cert, ok := cs.byName[name]; ok {
+		return cert, nil
+	}
+	if i := strings.IndexByte(name, '.'); i > 0 {
+		if cert, ok := cs.byName["*"+name[i:]]; ok {
+			return cert, nil
+		}
+	}
+	if cs.fallback != nil {
+		return cs.fallback, nil
+	}
+	return nil, fmt.Errorf("no certificate for %q", hello.ServerName)
+}
+
+// watch reloads the certificates whenever one of their files changes. A set
+// of files that fails to load is logged and the previous certificates are
+// kept until the files change again.
+func (cs *certStore) watch() {
+	ticker := time.NewTicker(certReloadInterval)
+	defer ticker.Stop()
+	for range ticker.C {
+		stamp, err := cs.currentStamp()
+		if err != nil {
+			log.Printf("Checking certificates: %v", err)
+			continue
+		}
+		cs.mu.RLock()
+		changed := stamp != cs.stamp
+		cs.mu.RUnlock()
+		if !changed {
+			continue
+		}
+		if err := cs.load(stamp); err != nil {
+			log.Printf("Keeping previous certificates: %v", err)
+			cs.mu.Lock()
+			cs.stamp = stamp
+			cs.mu.Unlock()
+			continue
+		}
+		log.Println("Reloaded TLS certificates")
+	}
+}
+
+func (cs *certStore) load(stamp string) error {
+	var fallback *tls.Certificate
+	if cs.certFile != "" {
+		cert, err := tls.LoadX509KeyPair(cs.certFile, cs.keyFile)
+		if err != nil {
+			return fmt.Errorf("loading %s: %v", cs.certFile, err)
+		}
+		fallback = &cert
+	}
+
+	byName := make(map[string]*tls.Certificate)
+	for _, pair := range cs.dirPairs() {
+		cert, err := tls.LoadX509KeyPair(pair[0], pair[1])
+		if err != nil {
+			return fmt.Errorf("loading %s: %v", pair[0], err)
+		}
+		for _, name := range cert.Leaf.DNSNames {
+			byName[strings.ToLower(name)] = &cert
+		}
+	}
+
+	if fallback == nil && len(byName) == 0 {
+		return fmt.Errorf("no certificates found")
+	}
+
+	cs.mu.Lock()
+	cs.fallback = fallback
+	cs.byName = byName
+	cs.stamp = stamp
+	cs.mu.Unlock()
+	return nil
+}
+
+// dirPairs lists the certificate and key files in the directory.
+func (cs *certStore) dirPairs() [][2]string {
+	if cs.dir == "" {
+		return nil
+	}
+	certs, _ := filepath.Glob(filepath.Join(cs.dir, "*.crt"))
+	var pairs [][2]string
+	for _, certFile := range certs {
+		keyFile := strings.TrimSuffix(certFile, ".crt") + ".key"
+		if _, err := os.Stat(keyFile); err == nil {
+			pairs = append(pairs, [2]string{certFile, keyFile})
+		}
+	}
+	return pairs
+}
+
+// currentStamp summarises the names, sizes and modification times of all
+// certificate files, so any change to them shows up as a different stamp.
+func (cs *certStore) currentStamp() (string, error) {
+	files := []string{}
+	if cs.certFile != "" {
+		files = append(files, cs.certFile, cs.keyFile)
+	}
+	if cs.dir != "" {
+		if _, err := os.Stat(cs.dir); err != nil {
+			return "", err
+		}
+		for _, pair := range cs.dirPairs() {
+			files = append(files, pair[0], pair[1])
+		}
+	}
+
+	var b strings.Builder
+	for _, file := range files {
+		info, err := os.Stat(file)
+		if err != nil {
+			return "", err
+		}
+		fmt.Fprintf(&b, "%s:%d:%d\n", file, info.Size(), info.ModTime().UnixNano())
+	}
+	return b.String(), nil
+}
+
+// redirectHandler sends everyone on plain HTTP to the same URL over HTTPS.
+// That includes clients: tokens and tunneled traffic must not travel in the
+// clear, so tunnels and the API are only served over TLS.
+func redirectHandler(httpsPort string) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		host := r.Host
+		if h, _, err := net.SplitHostPort(host); err == nil {
+			host = h
+		} else {
+			host = strings.TrimSuffix(strings.TrimPrefix(host, "["), "]")
+		}
+		if host == "" {
+			http.Error(w, "Host header required", http.StatusBadRequest)
+			return
+		}
+		if httpsPort != "443" {
+			host = net.JoinHostPort(host, httpsPort)
+		} else if strings.Contains(host, ":") {
+			host = "[" + host + "]"
+		}
+
+		status := http.StatusPermanentRedirect
+		if r.Method == http.MethodGet || r.Method == http.MethodHead {
+			status = http.StatusMovedPermanently
+		}
+		http.Redirect(w, r, "https://"+host+r.URL.RequestURI(), status)
+	})
+}
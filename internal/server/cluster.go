@@ -0,0 +1,216 @@
+package server
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/subtle"
+	"encoding/hex"
+	"fmt"
+	"log"
+	mrand "math/rand"
+	"net/http"
+	"net/http/httputil"
+	"net/url"
+	"strings"
+	"time"
+
+	"github.com/ghousemohamed/simple-tunnel/internal/cluster"
+)
+
+const (
+	// clusterTokenHeader proves a request was forwarded by another node of
+	// the cluster. Such requests are served locally and never forwarded again.
+	clusterTokenHeader = "X-Simple-Tunnel-Cluster-Token"
+	// clusterRouteHeader carries the subdomain and path prefix the
+	// forwarding node resolved, as "<subdomain> <prefix>".
+	clusterRouteHeader = "X-Simple-Tunnel-Cluster-Route"
+
+	// clusterTTL is how long a registration outlives its node. Nodes refresh
+	// theirs every clusterTTL/3.
+	clusterTTL = 30 * time.Second
+)
+
+// clusterNode records which node each subdomain is connected to in a store
+// shared by every node, and forwards visitors to the node holding the tunnel.
+type clusterNode struct {
+	store     cluster.Store
+	advertise *url.URL
+	secret    string
+	// instance tells this process apart from its successor after a
+	// handoff, which advertises the same address.
+	instance string
+	// registration is what this process stores for its subdomains: the
+	// advertised address plus the instance id.
+	registration string
+}
+
+func newClusterNode(config Config) (*clusterNode, error) {
+	if config.ClusterAdvertise == "" {
+		return nil, fmt.Errorf("an advertise address is required")
+	}
+	if config.ClusterSecret == "" {
+		return nil, fmt.Errorf("a cluster secret is required")
+	}
+	advertise, err := url.Parse(config.ClusterAdvertise)
+	if err != nil || advertise.Host == "" || (advertise.Scheme != "http" && advertise.Scheme != "https") {
+		return nil, fmt.Errorf("invalid advertise address %q", config.ClusterAdvertise)
+	}
+
+	store, err := cluster.Open(config.ClusterStore)
+	if err != nil {
+		return nil, err
+	}
+
+	instance := make([]byte, 8)
+	if _, err := rand.Read(instance); err != nil {
+		return nil, err
+	}
+
+	return &clusterNode{
+		store:        store,
+		advertise:    advertise,
+		secret:       config.ClusterSecret,
+		instance:     hex.EncodeToString(instance),
+		registration: advertise.String() + " " + hex.EncodeToString(instance),
+	}, nil
+}
+
+// clusterPrefix is where the registrations of every node holding
+// subdomain are kept. Each node has its own key under it, so group clients
+// connected to different nodes don't overwrite each other.
+func clusterPrefix(subdomain string) string {
+	return "tunnel/" + subdomain + "/"
+}
+
+func (n *clusterNode) key(subdomain string) string {
+	return clusterPrefix(subdomain) + n.instance
+}
+
+// announce registers subdomain as connected to this node.
+func (ts *TunnelServer) announce(subdomain string) {
+	if ts.cluster == nil {
+		return
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	if err := ts.cluster.store.Set(ctx, ts.cluster.key(subdomain), ts.cluster.registration, clusterTTL); err != nil {
+		log.Printf("Error registering subdomain %s with the cluster: %v", subdomain, err)
+	}
+}
+
+// withdraw removes this node's registration for subdomain unless a client
+// has connected again in the meantime.
+func (ts *TunnelServer) withdraw(subdomain string) {
+	if ts.cluster == nil {
+		return
+	}
+	ts.tunnelsLock.RLock()
+	_, connected := ts.tunnel[subdomain]
+	ts.tunnelsLock.RUnlock()
+	if connected {
+		return
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	if err := ts.cluster.store.Delete(ctx, ts.cluster.key(subdomain), ts.cluster.registration); err != nil {
+		log.Printf("Error removing subdomain %s from the cluster: %v", subdomain, err)
+	}
+}
+
+// heartbeat keeps this node's registrations from expiring, and disconnects
+// clients of subdomains another node has since reserved to someone else.
+func (ts *TunnelServer) heartbeat() {
+	ticker := time.NewTicker(clusterTTL / 3)
+	defer ticker.Stop()
+	for range ticker.C {
+		for _, subdomain := range ts.connectedSubdomains() {
+			ts.announce(subdomain)
+			ts.enforceReservation(subdomain)
+		}
+	}
+}
+
+// clusterOwners returns the other nodes subdomain is connected to.
+func (ts *TunnelServer) clusterOwners(subdomain string) ([]*url.URL, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	keys, err := ts.cluster.store.List(ctx, clusterPrefix(subdomain))
+	if err != nil {
+		return nil, err
+	}
+
+	var owners []*url.URL
+	for _, key := range keys {
+		value, ok, err := ts.cluster.store.Get(ctx, key)
+		if err != nil {
+			return nil, err
+		}
+		if !ok || value == ts.cluster.registration {
+			continue
+		}
+		address, _, _ := strings.Cut(value, " ")
+		owner, err := url.Parse(address)
+		if err != nil || *owner == *ts.cluster.advertise {
+			continue
+		}
+		owners = append(owners, owner)
+	}
+	return owners, nil
+}
+
+// clusterOwner returns a node another process registered subdomain on, or
+// nil if it isn't connected anywhere else. Group clients may be spread over
+// several nodes, in which case requests are spread over them too.
+func (ts *TunnelServer) clusterOwner(subdomain string) *url.URL {
+	owners, err := ts.clusterOwners(subdomain)
+	if err != nil {
+		log.Printf("Error looking up subdomain %s in the cluster: %v", subdomain, err)
+		return nil
+	}
+	if len(owners) == 0 {
+		return nil
+	}
+	return owners[mrand.Intn(len(owners))]
+}
+
+// peerRoute reports whether r was forwarded by another node and, if so, the
+// route it resolved. The cluster headers are removed from r either way.
+func (ts *TunnelServer) peerRoute(r *http.Request) (subdomain, pathPrefix string, ok bool) {
+	token := r.Header.Get(clusterTokenHeader)
+	route := r.Header.Get(clusterRouteHeader)
+	r.Header.Del(clusterTokenHeader)
+	r.Header.Del(clusterRouteHeader)
+
+	if ts.cluster == nil || token == "" || subtle.ConstantTimeCompare([]byte(token), []byte(ts.cluster.secret)) != 1 {
+		return "", "", false
+	}
+	subdomain, pathPrefix, _ = strings.Cut(route, " ")
+	if !validSubdomain(subdomain) {
+		return "", "", false
+	}
+	return subdomain, pathPrefix, true
+}
+
+// forwardToNode proxies r to the node holding the subdomain's tunnel. The
+// forwarding headers were already set on r and are passed on unchanged.
+func (ts *TunnelServer) forwardToNode(w http.ResponseWriter, r *http.Request, owner *url.URL, subdomain, pathPrefix string) {
+	log.Printf("Forwarding request for subdomain %s to %s", subdomain, owner.Host)
+
+	proxy := &httputil.ReverseProxy{
+		Rewrite: func(pr *httputil.ProxyRequest) {
+			pr.SetURL(owner)
+			pr.Out.Host = pr.In.Host
+			for _, h := range forwardedHeaders {
+				pr.Out.Header[h] = pr.In.Header[h]
+			}
+			pr.Out.Header.Set(clusterTokenHeader, ts.cluster.secret)
+			pr.Out.Header.Set(clusterRouteHeader, subdomain+" "+pathPrefix)
+		},
+		ErrorHandler: func(w http.ResponseWriter, r *http.Request, err error) {
+			log.Printf("Error forwarding request to %s: %v", owner.Host, err)
+			ts.renderError(w, r, http.StatusBadGateway, errorBadGateway, subdomain)
+		},
+	}
+	proxy.ServeHTTP(w, r)
+}
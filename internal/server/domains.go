@@ -0,0 +1,255 @@
+package server
+
+import (
+	"context"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"log"
+	"net"
+	"slices"
+	"strings"
+	"time"
+
+	"github.com/ghousemohamed/simple-tunnel/internal/cluster"
+	"github.com/ghousemohamed/simple-tunnel/internal/registry"
+)
+
+const (
+	domainChallengeRecord = "_simple-tunnel"
+	domainStatusHeader    = "X-Simple-Tunnel-Domain"
+
+	domainVerifyInterval = 30 * time.Second
+	domainVerifyTimeout  = 10 * time.Second
+	domainVerifyDeadline = time.Hour
+
+	// domainSecretKey holds the generated secret next to the registry, so
+	// tokens stay valid across restarts and are the same on every node
+	domainSecretKey = "domain-secret"
+)
+
+type customDomain struct {
+	hostname  string
+	subdomain string
+	token     string
+}
+
+// loadDomainSecret returns --domain-secret or, without it, the secret kept in
+// the registry's store, generating it the first time.
+func loadDomainSecret(config Config, store cluster.Store) ([]byte, error) {
+	if config.DomainSecret != "" {
+		return []byte(config.DomainSecret), nil
+	}
+
+	secret := make([]byte, 32)
+	if _, err := rand.Read(secret); err != nil {
+		return nil, err
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	// Another node may store its secret first, in which case that one is used
+	if _, err := store.CompareAndSwap(ctx, domainSecretKey, "", hex.EncodeToString(secret)); err != nil {
+		return nil, err
+	}
+	stored, ok, err := store.Get(ctx, domainSecretKey)
+	if err != nil {
+		return nil, err
+	}
+	if !ok {
+		return nil, fmt.Errorf("%s disappeared from the store", domainSecretKey)
+	}
+	return hex.DecodeString(stored)
+}
+
+// loadDomains routes the custom domains verified before this process
+// started.
+func (ts *TunnelServer) loadDomains() error {
+	entries, err := ts.registry.List()
+	if err != nil {
+		return err
+	}
+	ts.domainsLock.Lock()
+	defer ts.domainsLock.Unlock()
+	for _, entry := range entries {
+		for _, hostname := range entry.Domains {
+			ts.domains[hostname] = &customDomain{
+				hostname:  hostname,
+				subdomain: entry.Subdomain,
+				token:     ts.challengeToken(hostname, entry.Subdomain),
+			}
+		}
+	}
+	return nil
+}
+
+// challengeToken binds a hostname to the tunnel claiming it, so a record
+// published for one tunnel cannot be reused to claim the hostname for another.
+func (ts *TunnelServer) challengeToken(hostname, subdomain string) string {
+	mac := hmac.New(sha256.New, ts.domainSecret)
+	mac.Write([]byte(hostname + "\x00" + subdomain))
+	return hex.EncodeToString(mac.Sum(nil))[:32]
+}
+
+// registerDomains checks the custom hostnames a tunnel asked for and returns
+// their status for the client. Hostnames that are not yet mapped to this
+// tunnel are verified in the background and only routed once verified.
+func (ts *TunnelServer) registerDomains(subdomain string, hostnames []string, tunnelConn *TunnelConnection) []string {
+	var statuses []string
+	for _, hostname := range hostnames {
+		hostname = normalizeHost(hostname)
+		if !validHostname(hostname) {
+			statuses = append(statuses, fmt.Sprintf("%s; status=invalid", hostname))
+			continue
+		}
+
+		ts.domainsLock.RLock()
+		existing, ok := ts.domains[hostname]
+		ts.domainsLock.RUnlock()
+
+		if ok && existing.subdomain == subdomain {
+			statuses = append(statuses, fmt.Sprintf("%s; status=verified", hostname))
+			continue
+		}
+
+		domain := &customDomain{
+			hostname:  hostname,
+			subdomain: subdomain,
+			token:     ts.challengeToken(hostname, subdomain),
+		}
+		statuses = append(statuses, fmt.Sprintf("%s; status=pending; token=%s", hostname, domain.token))
+		go ts.verifyDomain(domain, tunnelConn)
+	}
+	return statuses
+}
+
+func (ts *TunnelServer) verifyDomain(domain *customDomain, tunnelConn *TunnelConnection) {
+	ticker := time.NewTicker(domainVerifyInterval)
+	defer ticker.Stop()
+	deadline := time.After(domainVerifyDeadline)
+
+	for {
+		err := checkDomainOwnership(domain.hostname, domain.token)
+		if err == nil {
+			ts.domainsLock.Lock()
+			previous := ts.domains[domain.hostname]
+			ts.domains[domain.hostname] = domain
+			ts.domainsLock.Unlock()
+			log.Printf("Custom domain %s verified for subdomain: %s", domain.hostname, domain.subdomain)
+			ts.recordDomain(domain, previous)
+			return
+		}
+		log.Printf("Custom domain %s not verified yet: %v", domain.hostname, err)
+
+		select {
+		case <-ticker.C:
+		case <-deadline:
+			log.Printf("Gave up verifying custom domain %s", domain.hostname)
+			return
+		case <-tunnelConn.closed:
+			return
+		}
+	}
+}
+
+// recordDomain stores a verified custom domain in the registry, taking it
+// from the subdomain it was verified for before, if any.
+func (ts *TunnelServer) recordDomain(domain, previous *customDomain) {
+	_, err := ts.registry.Update(domain.subdomain, func(entry registry.Entry, _ bool) (*registry.Entry, error) {
+		if !slices.Contains(entry.Domains, domain.hostname) {
+			entry.Domains = append(entry.Domains, domain.hostname)
+		}
+		return &entry, nil
+	})
+	if err != nil {
+		log.Printf("Error recording custom domain %s in the registry: %v", domain.hostname, err)
+	}
+
+	if previous == nil || previous.subdomain == domain.subdomain {
+		return
+	}
+	_, err = ts.registry.Update(previous.subdomain, func(entry registry.Entry, ok bool) (*registry.Entry, error) {
+		if !ok {
+			return nil, nil
+		}
+		entry.Domains = slices.DeleteFunc(entry.Domains, func(hostname string) bool { return hostname == domain.hostname })
+		if !entry.Connected && !entry.Kept() {
+			return nil, nil
+		}
+		return &entry, nil
+	})
+	if err != nil {
+		log.Printf("Error removing custom domain %s from subdomain %s in the registry: %v", domain.hostname, previous.subdomain, err)
+	}
+}
+
+// checkDomainOwnership looks for the token in a DNS TXT record at
+// _simple-tunnel.<hostname>. There is deliberately no HTTP challenge: once
+// the hostname points at this server, a challenge request would be routed
+// to whichever tunnel matches its first label, and that tunnel's owner could
+// answer it.
+func checkDomainOwnership(hostname, token string) error {
+	ctx, cancel := context.WithTimeout(context.Background(), domainVerifyTimeout)
+	defer cancel()
+
+	records, err := net.DefaultResolver.LookupTXT(ctx, domainChallengeRecord+"."+hostname)
+	if err != nil {
+		return fmt.Errorf("dns: %v", err)
+	}
+	for _, record := range records {
+		if strings.TrimSpace(record) == token {
+			return nil
+		}
+	}
+	return fmt.Errorf("dns: no TXT record at %s.%s matches the token", domainChallengeRecord, hostname)
+}
+
+// lookupCustomDomain returns the subdomain a verified custom hostname maps to.
+func (ts *TunnelServer) lookupCustomDomain(host string) (string, bool) {
+	ts.domainsLock.RLock()
+	defer ts.domainsLock.RUnlock()
+
+	domain, ok := ts.domains[normalizeHost(host)]
+	if !ok {
+		return "", false
+	}
+	return domain.subdomain, true
+}
+
+// normalizeHost lowercases a Host header value and strips any port and
+// trailing dot.
+func normalizeHost(host string) string {
+	if h, _, err := net.SplitHostPort(host); err == nil {
+		host = h
+	}
+	return strings.TrimSuffix(strings.ToLower(host), ".")
+}
+
+func validHostname(hostname string) bool {
+	if len(hostname) == 0 || len(hostname) > 253 || net.ParseIP(hostname) != nil {
+		return false
+	}
+	labels := strings.Split(hostname, ".")
+	if len(labels) < 2 {
+		return false
+	}
+	for _, label := range labels {
+		if !validLabel(label) {
+			return false
+		}
+	}
+	return true
+}
+
+func validLabel(label string) bool {
+	if len(label) == 0 || len(label) > 63 || label[0] == '-' || label[len(label)-1] == '-' {
+		return false
+	}
+	for _, c := range label {
+		if !(c >= 'a' && c <= 'z' || c >= '0' && c <= '9' || c == '-') {
+			return false
+		}
+	}
+	return true
+}
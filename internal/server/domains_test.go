@@ -0,0 +1,69 @@
+package server
+
+import (
+	"bytes"
+	"slices"
+	"testing"
+
+	"github.com/ghousemohamed/simple-tunnel/internal/cluster"
+)
+
+func TestDomainSecret(t *testing.T) {
+	store, err := cluster.NewFileStore(t.TempDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+	first, err := loadDomainSecret(Config{}, store)
+	if err != nil {
+		t.Fatal(err)
+	}
+	second, err := loadDomainSecret(Config{}, store)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(first) != 32 || !bytes.Equal(first, second) {
+		t.Fatalf("generated secret changed from %x to %x", first, second)
+	}
+
+	configured, err := loadDomainSecret(Config{DomainSecret: "s3"}, store)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(configured) != "s3" {
+		t.Fatalf("--domain-secret gave secret %q", configured)
+	}
+}
+
+// TestDomainsAcrossRestarts checks that verified custom domains and their
+// tokens survive a restart with the same --registry-dir.
+func TestDomainsAcrossRestarts(t *testing.T) {
+	config := Config{BaseDomains: []string{"example.test"}, RegistryDir: t.TempDir()}
+	ts, err := NewTunnelServer(config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	token := ts.challengeToken("www.example.com", "app")
+	ts.recordDomain(&customDomain{hostname: "www.example.com", subdomain: "app", token: token}, nil)
+	ts.unregister("app")
+
+	// The hostname moves to another subdomain
+	moved := &customDomain{hostname: "docs.example.com", subdomain: "docs", token: ts.challengeToken("docs.example.com", "docs")}
+	ts.recordDomain(&customDomain{hostname: "docs.example.com", subdomain: "app"}, nil)
+	ts.recordDomain(moved, &customDomain{hostname: "docs.example.com", subdomain: "app"})
+
+	restarted, err := NewTunnelServer(config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := restarted.challengeToken("www.example.com", "app"); got != token {
+		t.Fatalf("token changed across restarts: %s, was %s", got, token)
+	}
+	for hostname, want := range map[string]string{"www.example.com": "app", "docs.example.com": "docs"} {
+		if subdomain, ok := restarted.lookupCustomDomain(hostname); !ok || subdomain != want {
+			t.Fatalf("%s routes to %q, %v after a restart; want %s", hostname, subdomain, ok, want)
+		}
+	}
+	if entry, _, _ := restarted.registry.Lookup("app"); !slices.Equal(entry.Domains, []string{"www.example.com"}) {
+		t.Fatalf("app keeps domains %v, want only www.example.com", entry.Domains)
+	}
+}
@@ -0,0 +1,88 @@
+package server
+
+import (
+	"context"
+	"log"
+	"time"
+
+	"github.com/ghousemohamed/simple-tunnel/internal/mux"
+)
+
+// goAway tells the client to reconnect elsewhere. Streams in flight carry
+// on until the connection is closed.
+func (tc *TunnelConnection) goAway() error {
+	select {
+	case <-tc.ready:
+	case <-tc.closed:
+		return mux.ErrSessionClosed
+	}
+	return tc.session.GoAway()
+}
+
+func (ts *TunnelServer) allTunnels() map[*TunnelConnection]string {
+	ts.tunnelsLock.RLock()
+	defer ts.tunnelsLock.RUnlock()
+
+	tunnels := make(map[*TunnelConnection]string)
+	for subdomain, group := range ts.tunnel {
+		for _, member := range group.members {
+			tunnels[member] = subdomain
+		}
+	}
+	return tunnels
+}
+
+// drain stops accepting new tunnels, tells every connected client to
+// reconnect elsewhere and waits for the exchanges in flight to finish.
+// Clients keep serving on the old connection until closeTunnels.
+func (ts *TunnelServer) drain(ctx context.Context) {
+	ts.draining.Store(true)
+
+	tunnels := ts.allTunnels()
+	log.Printf("Draining %d tunnel(s)", len(tunnels))
+
+	for tunnel, subdomain := range tunnels {
+		if err := tunnel.goAway(); err != nil {
+			log.Printf("Error sending go away to subdomain %s: %v", subdomain, err)
+		}
+	}
+
+	ticker := time.NewTicker(100 * time.Millisecond)
+	defer ticker.Stop()
+	for {
+		busy := 0
+		for tunnel := range tunnels {
+			if !tunnel.isClosed() && tunnel.inflight.Load() > 0 {
+				busy++
+			}
+		}
+		if busy == 0 {
+			return
+		}
+		select {
+		case <-ticker.C:
+		case <-ctx.Done():
+			log.Printf("Drain deadline reached with %d tunnel(s) still busy", busy)
+			return
+		}
+	}
+}
+
+// closeTunnels closes every tunnel connection, ending anything still in
+// flight.
+func (ts *TunnelServer) closeTunnels() {
+	for tunnel, subdomain := range ts.allTunnels() {
+		ts.removeTunnel(subdomain, tunnel)
+	}
+}
+
+func (ts *TunnelServer) connectedSubdomains() []string {
+	ts.tunnelsLock.RLock()
+	defer ts.tunnelsLock.RUnlock()
+
+	var subdomains []string
+	for subdomain := range ts.tunnel {
+		subdomains = append(subdomains, subdomain)
+	}
+	return subdomains
+}
@@ -0,0 +1,166 @@
+package server
+
+import (
+	"bytes"
+	"encoding/json"
+	"html/template"
+	"log"
+	"mime"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+)
+
+// errorHeader is set by the client on responses it generated itself because
+// the local origin failed. The server replaces them with an error page.
+const errorHeader = "X-Simple-Tunnel-Error"
+
+// Kinds of error page. Operators override them with <kind>.html, or
+// error.html for all kinds, in the error pages directory, and per tunnel in
+// a subdirectory named after the subdomain.
+const (
+	errorOffline       = "offline"
+	errorOriginRefused = "origin-refused"
+	errorOriginTimeout = "origin-timeout"
+	errorBadGateway    = "bad-gateway"
+)
+
+type errorPage struct {
+	Status    int    `json:"status"`
+	Kind      string `json:"error"`
+	Title     string `json:"title"`
+	Message   string `json:"message"`
+	Subdomain string `json:"subdomain,omitempty"`
+	Host      string `json:"-"`
+}
+
+func newErrorPage(status int, kind, subdomain, host string) errorPage {
+	page := errorPage{Status: status, Kind: kind, Subdomain: subdomain, Host: host}
+	switch {
+	case kind == errorOffline && status == http.StatusServiceUnavailable:
+		page.Title = "Tunnel unavailable"
+		page.Message = "The tunnel for this address is reconnecting. Try again shortly."
+	case kind == errorOffline:
+		page.Title = "Tunnel not found"
+		page.Message = "No tunnel is connected for this address."
+	case kind == errorOriginRefused:
+		page.Title = "Local server unavailable"
+		page.Message = "The tunnel is connected, but the application behind it refused the connection."
+	case kind == errorOriginTimeout:
+		page.Title = "Local server timed out"
+		page.Message = "The application behind the tunnel took too long to respond."
+	default:
+		page.Kind = errorBadGateway
+		page.Title = "Error forwarding request"
+		page.Message = "The request could not be delivered through the tunnel."
+	}
+	return page
+}
+
+var defaultErrorTemplate = template.Must(template.New("error").Parse(`<!DOCTYPE html>
+<html>
+<head><title>{{.Status}} {{.Title}}</title></head>
+<body>
+<h1>{{.Title}}</h1>
+<p>{{.Message}}</p>
+<hr>
+<p>Simple Tunnel</p>
+</body>
+</html>
+`))
+
+// renderError answers the visitor with an error page, as JSON when the
+// visitor prefers it over HTML.
+func (ts *TunnelServer) renderError(w http.ResponseWriter, r *http.Request, status int, kind, subdomain string) {
+	page := newErrorPage(status, kind, subdomain, r.Host)
+
+	w.Header().Set("Cache-Control", "no-store")
+	w.Header().Set("X-Content-Type-Options", "nosniff")
+	if isGRPC(r) {
+		writeGRPCError(w, page)
+		return
+	}
+	if prefersJSON(r.Header.Get("Accept")) {
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(status)
+		json.NewEncoder(w).Encode(page)
+		return
+	}
+
+	var body bytes.Buffer
+	if err := ts.errorTemplate(page.Kind, subdomain).Execute(&body, page); err != nil {
+		log.Printf("Error rendering %s error page: %v", page.Kind, err)
+		body.Reset()
+		defaultErrorTemplate.Execute(&body, page)
+	}
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	w.WriteHeader(status)
+	w.Write(body.Bytes())
+}
+
+// errorTemplate finds the most specific template for kind, falling back to
+// the built-in page.
+func (ts *TunnelServer) errorTemplate(kind, subdomain string) *template.Template {
+	if ts.errorPagesDir == "" {
+		return defaultErrorTemplate
+	}
+
+	var candidates []string
+	if subdomain != "" {
+		dir := filepath.Join(ts.errorPagesDir, subdomain)
+		candidates = append(candidates, filepath.Join(dir, kind+".html"), filepath.Join(dir, "error.html"))
+	}
+	candidates = append(candidates, filepath.Join(ts.errorPagesDir, kind+".html"), filepath.Join(ts.errorPagesDir, "error.html"))
+
+	for _, path := range candidates {
+		if _, err := os.Stat(path); err != nil {
+			continue
+		}
+		tmpl, err := template.ParseFiles(path)
+		if err != nil {
+			log.Printf("Error parsing error page %s: %v", path, err)
+			continue
+		}
+		return tmpl
+	}
+	return defaultErrorTemplate
+}
+
+// prefersJSON reports whether an Accept header ranks application/json
+// above text/html.
+func prefersJSON(accept string) bool {
+	var jsonQ, htmlQ float64
+	for _, part := range strings.Split(accept, ",") {
+		mediaType, params, err := mime.ParseMediaType(strings.TrimSpace(part))
+		if err != nil {
+			continue
+		}
+		q := 1.0
+		if v, ok := params["q"]; ok {
+			if q, err = strconv.ParseFloat(v, 64); err != nil {
+				continue
+			}
+		}
+		switch {
+		case mediaType == "application/json" || strings.HasSuffix(mediaType, "+json"):
+			jsonQ = max(jsonQ, q)
+		case mediaType == "text/html":
+			htmlQ = max(htmlQ, q)
+		}
+	}
+	return jsonQ > htmlQ
+}
+
+// originError renders the error page for a response the client generated
+// because the local origin failed. It reports false for ordinary responses.
+func (ts *TunnelServer) originError(w http.ResponseWriter, r *http.Request, resp *http.Response, subdomain string) bool {
+	kind := resp.Header.Get(errorHeader)
+	if kind == "" {
+		return false
+	}
+	ts.renderError(w, r, resp.StatusCode, kind, subdomain)
+	log.Printf("Origin error for subdomain %s: %s", subdomain, kind)
+	return true
+}
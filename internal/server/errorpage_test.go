@@ -0,0 +1,46 @@
+package server
+
+import (
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/ghousemohamed/simple-tunnel/internal/client"
+)
+
+// TestOriginErrorHeader checks that an origin setting the header the client
+// marks its own error responses with still has its response passed on.
+func TestOriginErrorHeader(t *testing.T) {
+	origin := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set(errorHeader, "origin-refused")
+		w.WriteHeader(http.StatusServiceUnavailable)
+		io.WriteString(w, "from the origin")
+	}))
+	defer origin.Close()
+
+	ts, serverAddr := startTunnelServer(t, Config{BaseDomains: []string{"example.test"}})
+	connectClient(t, ts, client.Config{
+		HTTPPort:   port(t, origin.Listener.Addr()),
+		ServerAddr: serverAddr,
+		Subdomain:  "app",
+	})
+
+	req, err := http.NewRequest(http.MethodGet, "http://"+serverAddr+"/", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	req.Host = "app.example.test"
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	body, _ := io.ReadAll(resp.Body)
+	if resp.StatusCode != http.StatusServiceUnavailable || string(body) != "from the origin" {
+		t.Fatalf("got %d %q, want the origin's 503", resp.StatusCode, body)
+	}
+	if got := resp.Header.Get(errorHeader); got != "" {
+		t.Fatalf("%s = %q reached the visitor", errorHeader, got)
+	}
+}
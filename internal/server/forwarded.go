@@ -0,0 +1,128 @@
+package server
+
+import (
+	"fmt"
+	"net"
+	"net/http"
+	"strings"
+)
+
+// remoteAddrHeader carries the visitor's address down the tunnel so the
+// client can announce it to the local origin. It never reaches the origin.
+const remoteAddrHeader = "X-Simple-Tunnel-Remote-Addr"
+
+var forwardedHeaders = []string{
+	"X-Forwarded-For",
+	"X-Forwarded-Proto",
+	"X-Forwarded-Host",
+	"X-Real-IP",
+	"Forwarded",
+}
+
+// setForwardedHeaders records the visitor's address, scheme and host on r
+// before it is sent down the tunnel. Values set by the peer are only kept and
+// extended when the peer is a trusted proxy; otherwise they are replaced.
+func (ts *TunnelServer) setForwardedHeaders(r *http.Request) {
+	peerIP := remoteIP(r.RemoteAddr)
+	trusted := ts.isTrustedProxy(peerIP)
+
+	if !trusted {
+		for _, h := range forwardedHeaders {
+			r.Header.Del(h)
+		}
+	}
+
+	proto := r.Header.Get("X-Forwarded-Proto")
+	if proto == "" {
+		proto = "http"
+		if r.TLS != nil {
+			proto = "https"
+		}
+	}
+	host := r.Header.Get("X-Forwarded-Host")
+	if host == "" {
+		host = r.Host
+	}
+
+	var chain []string
+	for _, v := range r.Header.Values("X-Forwarded-For") {
+		for _, ip := range strings.Split(v, ",") {
+			if ip = strings.TrimSpace(ip); ip != "" {
+				chain = append(chain, ip)
+			}
+		}
+	}
+
+	forwarded := r.Header.Values("Forwarded")
+	if len(forwarded) == 0 {
+		for _, ip := range chain {
+			forwarded = append(forwarded, "for="+forwardedNode(ip))
+		}
+	}
+	forwarded = append(forwarded, fmt.Sprintf("for=%s;host=%s;proto=%s", forwardedNode(peerIP), quoteForwarded(host), proto))
+
+	chain = append(chain, peerIP)
+
+	r.Header.Set("X-Forwarded-For", strings.Join(chain, ", "))
+	r.Header.Set("X-Forwarded-Proto", proto)
+	r.Header.Set("X-Forwarded-Host", host)
+	r.Header.Set("X-Real-IP", ts.clientIP(chain))
+	r.Header.Set("Forwarded", strings.Join(forwarded, ", "))
+}
+
+// visitorAddr returns the visitor's ip:port. When the request came through a
+// trusted proxy only the IP is known and the port is reported as 0.
+func visitorAddr(r *http.Request) string {
+	realIP := r.Header.Get("X-Real-IP")
+	if realIP == "" || realIP == remoteIP(r.RemoteAddr) {
+		return r.RemoteAddr
+	}
+	return net.JoinHostPort(realIP, "0")
+}
+
+// clientIP walks the forwarding chain from the nearest hop outwards and
+// returns the first address that is not a trusted proxy.
+func (ts *TunnelServer) clientIP(chain []string) string {
+	for i := len(chain) - 1; i > 0; i-- {
+		if !ts.isTrustedProxy(chain[i]) {
+			return chain[i]
+		}
+	}
+	return chain[0]
+}
+
+func (ts *TunnelServer) isTrustedProxy(ip string) bool {
+	parsed := net.ParseIP(ip)
+	if parsed == nil {
+		return false
+	}
+	for _, n := range ts.trustedProxies {
+		if n.Contains(parsed) {
+			return true
+		}
+	}
+	return false
+}
+
+func remoteIP(remoteAddr string) string {
+	host, _, err := net.SplitHostPort(remoteAddr)
+	if err != nil {
+		return remoteAddr
+	}
+	return host
+}
+
+// forwardedNode formats an address as an RFC 7239 node, quoting IPv6.
+func forwardedNode(ip string) string {
+	if strings.Contains(ip, ":") {
+		return fmt.Sprintf("\"[%s]\"", ip)
+	}
+	return ip
+}
+
+func quoteForwarded(v string) string {
+	if strings.ContainsAny(v, ":[]\" ") {
+		return fmt.Sprintf("%q", v)
+	}
+	return v
+}
@@ -0,0 +1,231 @@
+package server
+
+import (
+	"bufio"
+	"context"
+	"errors"
+	"io"
+	"net/http"
+	"os"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/ghousemohamed/simple-tunnel/internal/mux"
+)
+
+const (
+	RoundRobin       = "round-robin"
+	LeastOutstanding = "least-outstanding"
+)
+
+// tunnelGroup is every client serving a subdomain. A client that did not ask
+// to share the subdomain is the only member of its group. Broadcast groups
+// deliver every request to all members instead of picking one.
+type tunnelGroup struct {
+	members   []*TunnelConnection
+	shared    bool
+	broadcast bool
+	next      atomic.Uint32
+}
+
+// pick chooses a healthy member that hasn't been tried yet for this request.
+// Callers hold tunnelsLock.
+func (g *tunnelGroup) pick(strategy string, tried map[*TunnelConnection]bool) *TunnelConnection {
+	var candidates []*TunnelConnection
+	for _, member := range g.members {
+		if !tried[member] && !member.isClosed() {
+			candidates = append(candidates, member)
+		}
+	}
+	if len(candidates) == 0 {
+		return nil
+	}
+
+	if strategy == LeastOutstanding {
+		best := candidates[0]
+		for _, member := range candidates[1:] {
+			if member.inflight.Load() < best.inflight.Load() {
+				best = member
+			}
+		}
+		return best
+	}
+	return candidates[int(g.next.Add(1)-1)%len(candidates)]
+}
+
+func (g *tunnelGroup) remove(tunnelConn *TunnelConnection) {
+	for i, member := range g.members {
+		if member == tunnelConn {
+			g.members = append(g.members[:i], g.members[i+1:]...)
+			return
+		}
+	}
+}
+
+// pickTunnel returns the member of subdomain's group that should serve the
+// next request, skipping members that already failed it.
+func (ts *TunnelServer) pickTunnel(subdomain string, tried map[*TunnelConnection]bool) *TunnelConnection {
+	ts.tunnelsLock.RLock()
+	defer ts.tunnelsLock.RUnlock()
+
+	group, ok := ts.tunnel[subdomain]
+	if !ok {
+		return nil
+	}
+	return group.pick(ts.loadBalancing, tried)
+}
+
+// open starts a stream for one exchange once the tunnel handshake is done.
+// Exchanges run concurrently, each on its own stream.
+func (tc *TunnelConnection) open() (*mux.Stream, error) {
+	select {
+	case <-tc.ready:
+	case <-tc.closed:
+		return nil, mux.ErrSessionClosed
+	}
+	return tc.session.Open()
+}
+
+func (tc *TunnelConnection) isClosed() bool {
+	select {
+	case <-tc.closed:
+		return true
+	case <-tc.ready:
+		select {
+		case <-tc.session.Closed():
+			return true
+		default:
+			return false
+		}
+	default:
+		return false
+	}
+}
+
+// errTimeout is returned by roundTrip when the client took longer than the
+// tunnel's timeouts allow.
+var errTimeout = errors.New("timed out waiting for the client")
+
+// roundTrip sends r down the tunnel and reads the client's response. The
+// stream is aborted, which cancels the request at the client, when the
+// visitor goes away or a timeout expires before the response body is closed.
+// If the exchange ends before r was sent in full, abort, if given, is called
+// to unblock a read of r.Body that may be waiting on a slow sender.
+func (tc *TunnelConnection) roundTrip(r *http.Request, abort func()) (*http.Response, error) {
+	stream, err := tc.open()
+	if err != nil {
+		return nil, err
+	}
+	tc.inflight.Add(1)
+
+	ctx, cancel := r.Context(), context.CancelFunc(func() {})
+	if tc.timeouts.total > 0 {
+		ctx, cancel = context.WithTimeout(ctx, tc.timeouts.total)
+	}
+	stop := context.AfterFunc(ctx, func() { stream.Reset() })
+
+	// The request is written while the response is read, as the client may
+	// answer before it has read the whole body. The body is only read until
+	// the exchange ends, as its owner may close it as soon as roundTrip or
+	// the response body returns.
+	req := r.WithContext(r.Context())
+	body := &outgoingBody{ReadCloser: r.Body}
+	if r.Body != nil && r.Body != http.NoBody {
+		req.Body = body
+	}
+	written := make(chan struct{})
+	go func() {
+		defer close(written)
+		if err := req.Write(stream); err != nil {
+			stream.Reset()
+			return
+		}
+		stream.CloseWrite()
+	}()
+
+	var once sync.Once
+	done := func() {
+		once.Do(func() {
+			stop()
+			cancel()
+			select {
+			case <-written:
+				stream.Close()
+			default:
+				// The request is still being sent, so abort it and let a
+				// read of the body in progress return
+				body.ended.Store(true)
+				stream.Reset()
+				if abort != nil {
+					abort()
+				}
+			}
+			<-written
+			tc.inflight.Add(-1)
+		})
+	}
+
+	if tc.timeouts.header > 0 {
+		stream.SetReadDeadline(time.Now().Add(tc.timeouts.header))
+	}
+	header := newHeaderLimiter(stream, tc.limits.header)
+	resp, err := http.ReadResponse(bufio.NewReader(header), r)
+	if err != nil {
+		done()
+		if errors.Is(err, os.ErrDeadlineExceeded) || ctx.Err() == context.DeadlineExceeded {
+			return nil, errTimeout
+		}
+		return nil, err
+	}
+	stream.SetReadDeadline(time.Time{})
+	header.disarmed = true
+
+	if tc.limits.responseBody > 0 {
+		resp.Body = &limitedReader{ReadCloser: resp.Body, remaining: tc.limits.responseBody, err: errResponseTooLarge}
+	}
+	resp.Body = &exchangeBody{ReadCloser: resp.Body, stream: stream, idle: tc.timeouts.idle, done: done}
+	return resp, nil
+}
+
+// exchangeBody ends the exchange when the response body is closed and keeps
+// the idle timeout between reads.
+// outgoingBody is a request body as the write of one exchange reads it.
+type outgoingBody struct {
+	io.ReadCloser
+	ended atomic.Bool
+}
+
+var errExchangeEnded = errors.New("exchange ended before the request was sent")
+
+func (b *outgoingBody) Read(p []byte) (int, error) {
+	if b.ended.Load() {
+		return 0, errExchangeEnded
+	}
+	return b.ReadCloser.Read(p)
+}
+
+// Close leaves the body to its owner.
+func (b *outgoingBody) Close() error {
+	return nil
+}
+
+type exchangeBody struct {
+	io.ReadCloser
+	stream *mux.Stream
+	idle   time.Duration
+	done   func()
+}
+
+func (b *exchangeBody) Read(p []byte) (int, error) {
+	if b.idle > 0 {
+		b.stream.SetReadDeadline(time.Now().Add(b.idle))
+	}
+	return b.ReadCloser.Read(p)
+}
+
+func (b *exchangeBody) Close() error {
+	err := b.ReadCloser.Close()
+	b.done()
+	return err
+}
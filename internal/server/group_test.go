@@ -0,0 +1,87 @@
+package server
+
+import (
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/ghousemohamed/simple-tunnel/internal/client"
+)
+
+// trickleBody sends a byte at a time until it is aborted, and fails the test
+// if it is read once its owner is done with it.
+type trickleBody struct {
+	t       *testing.T
+	aborted chan struct{}
+	owned   atomic.Bool
+}
+
+func (b *trickleBody) Read(p []byte) (int, error) {
+	if b.owned.Load() {
+		b.t.Error("request body read after the exchange ended")
+	}
+	select {
+	case <-b.aborted:
+		return 0, io.ErrUnexpectedEOF
+	case <-time.After(10 * time.Millisecond):
+		p[0] = 'x'
+		return 1, nil
+	}
+}
+
+func (b *trickleBody) Close() error { return nil }
+
+// TestRoundTripRequestBody checks that a request body still being sent is
+// no longer read once roundTrip or the response body has returned.
+func TestRoundTripRequestBody(t *testing.T) {
+	origin := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/slow" {
+			time.Sleep(time.Second)
+		}
+		// Answer without waiting for the body
+		http.NewResponseController(w).EnableFullDuplex()
+		w.WriteHeader(http.StatusRequestEntityTooLarge)
+	}))
+	defer origin.Close()
+
+	ts, serverAddr := startTunnelServer(t, Config{BaseDomains: []string{"example.test"}, HeaderTimeout: 200 * time.Millisecond})
+	connectClient(t, ts, client.Config{
+		HTTPPort:   port(t, origin.Listener.Addr()),
+		ServerAddr: serverAddr,
+		Subdomain:  "app",
+	})
+	tunnel := ts.pickTunnel("app", nil)
+
+	for _, path := range []string{"/early", "/slow"} {
+		t.Run(path, func(t *testing.T) {
+			body := &trickleBody{t: t, aborted: make(chan struct{})}
+			req := httptest.NewRequest(http.MethodPost, path, body)
+			req.ContentLength = -1
+			abort := func() { close(body.aborted) }
+
+			resp, err := tunnel.roundTrip(req, abort)
+			if err == nil {
+				io.Copy(io.Discard, resp.Body)
+				resp.Body.Close()
+			}
+			body.owned.Store(true)
+
+			switch {
+			case path == "/early" && (err != nil || resp.StatusCode != http.StatusRequestEntityTooLarge):
+				t.Fatalf("early answer: %v", err)
+			case path == "/slow" && err != errTimeout:
+				t.Fatalf("slow answer: %v, want a timeout", err)
+			}
+			select {
+			case <-body.aborted:
+			default:
+				t.Fatal("exchange ended without aborting the body")
+			}
+			// Give a stray write time to show up
+			time.Sleep(50 * time.Millisecond)
+		})
+	}
+}
@@ -0,0 +1,36 @@
+package server
+
+import (
+	"net/http"
+	"strconv"
+	"strings"
+)
+
+// gRPC status codes used for tunnel errors.
+const (
+	grpcDeadlineExceeded = 4
+	grpcUnimplemented    = 12
+	grpcUnavailable      = 14
+)
+
+// isGRPC reports whether r is a gRPC call, which expects errors as a
+// grpc-status rather than an HTTP status.
+func isGRPC(r *http.Request) bool {
+	return strings.HasPrefix(r.Header.Get("Content-Type"), "application/grpc")
+}
+
+// writeGRPCError answers a gRPC call with a response that carries only the
+// status, as gRPC servers do for calls that fail before any message.
+func writeGRPCError(w http.ResponseWriter, page errorPage) {
+	code := grpcUnavailable
+	switch {
+	case page.Status == http.StatusNotFound:
+		code = grpcUnimplemented
+	case page.Kind == errorOriginTimeout:
+		code = grpcDeadlineExceeded
+	}
+	w.Header().Set("Content-Type", "application/grpc")
+	w.Header().Set("Grpc-Status", strconv.Itoa(code))
+	w.Header().Set("Grpc-Message", page.Message)
+	w.WriteHeader(http.StatusOK)
+}
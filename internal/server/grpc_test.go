@@ -0,0 +1,308 @@
+package server
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/ghousemohamed/simple-tunnel/internal/client"
+)
+
+// grpcMessage frames payload as a single uncompressed gRPC message.
+func grpcMessage(payload []byte) []byte {
+	msg := make([]byte, 5, 5+len(payload))
+	binary.BigEndian.PutUint32(msg[1:], uint32(len(payload)))
+	return append(msg, payload...)
+}
+
+// grpcOrigin is a local gRPC server speaking h2c. /Echo answers with the
+// request message, /Chat echoes each message of a stream as it arrives,
+// /Fail answers with a NOT_FOUND status in the trailers after a message, and
+// /Slow sleeps before answering.
+func grpcOrigin(t *testing.T) string {
+	t.Helper()
+	mux := http.NewServeMux()
+	mux.HandleFunc("/test.Echo/Echo", func(w http.ResponseWriter, r *http.Request) {
+		body, _ := io.ReadAll(r.Body)
+		w.Header().Set("Content-Type", "application/grpc")
+		w.Header().Set("Trailer", "Grpc-Status, Grpc-Message, X-Echo-Trailer")
+		w.Write(body)
+		w.Header().Set("Grpc-Status", "0")
+		w.Header().Set("Grpc-Message", "")
+		w.Header().Set("X-Echo-Trailer", "done")
+	})
+	mux.HandleFunc("/test.Echo/Chat", func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/grpc")
+		w.Header().Set("Trailer", "Grpc-Status")
+		rc := http.NewResponseController(w)
+		rc.EnableFullDuplex()
+		w.WriteHeader(http.StatusOK)
+		rc.Flush()
+		for {
+			var prefix [5]byte
+			if _, err := io.ReadFull(r.Body, prefix[:]); err != nil {
+				break
+			}
+			payload := make([]byte, binary.BigEndian.Uint32(prefix[1:]))
+			if _, err := io.ReadFull(r.Body, payload); err != nil {
+				break
+			}
+			w.Write(grpcMessage(append([]byte("re: "), payload...)))
+			rc.Flush()
+		}
+		w.Header().Set("Grpc-Status", "0")
+	})
+	mux.HandleFunc("/test.Echo/Fail", func(w http.ResponseWriter, r *http.Request) {
+		io.Copy(io.Discard, r.Body)
+		w.Header().Set("Content-Type", "application/grpc")
+		w.Write(grpcMessage([]byte("partial")))
+		w.Header().Set(http.TrailerPrefix+"Grpc-Status", "5")
+		w.Header().Set(http.TrailerPrefix+"Grpc-Message", "no such thing")
+	})
+	mux.HandleFunc("/test.Echo/Slow", func(w http.ResponseWriter, r *http.Request) {
+		select {
+		case <-time.After(5 * time.Second):
+		case <-r.Context().Done():
+		}
+	})
+
+	srv := httptest.NewUnstartedServer(mux)
+	srv.Config.Protocols = new(http.Protocols)
+	srv.Config.Protocols.SetUnencryptedHTTP2(true)
+	srv.Start()
+	t.Cleanup(srv.Close)
+	return port(t, srv.Listener.Addr())
+}
+
+func port(t *testing.T, addr net.Addr) string {
+	t.Helper()
+	_, p, err := net.SplitHostPort(addr.String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	return p
+}
+
+// closedPort returns a local port nothing listens on.
+func closedPort(t *testing.T) string {
+	t.Helper()
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+	return port(t, ln.Addr())
+}
+
+// startTunnelServer serves the tunnel endpoints over h2c the way
+// StartServer does, without the process handling around it.
+func startTunnelServer(t *testing.T, config Config) (*TunnelServer, string) {
+	t.Helper()
+	ts, err := NewTunnelServer(config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	mux := http.NewServeMux()
+	mux.HandleFunc("/", ts.handleTunnelRequest)
+	mux.HandleFunc("/_tunnel", ts.handleTunnelOpen)
+
+	srv := httptest.NewUnstartedServer(mux)
+	srv.Config.Protocols = new(http.Protocols)
+	srv.Config.Protocols.SetHTTP1(true)
+	srv.Config.Protocols.SetUnencryptedHTTP2(true)
+	srv.Start()
+	t.Cleanup(srv.Close)
+	return ts, srv.Listener.Addr().String()
+}
+
+// startTunnel connects a gRPC client for subdomain to the local port and
+// waits until the server routes to it.
+func startTunnel(t *testing.T, ts *TunnelServer, serverAddr, subdomain, localPort string) {
+	t.Helper()
+	connectClient(t, ts, client.Config{
+		HTTPPort:   localPort,
+		ServerAddr: serverAddr,
+		Subdomain:  subdomain,
+		Proto:      "grpc",
+	})
+}
+
+// connectClient starts a client and waits until the server routes to it.
+func connectClient(t *testing.T, ts *TunnelServer, config client.Config) {
+	t.Helper()
+	c, err := client.NewClient(config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	go c.StartClient()
+
+	deadline := time.Now().Add(5 * time.Second)
+	for ts.pickTunnel(config.Subdomain, nil) == nil {
+		if time.Now().After(deadline) {
+			t.Fatalf("tunnel %s did not connect", config.Subdomain)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+// grpcCall makes a unary call over h2c as a gRPC client would and returns
+// the response body and its grpc-status, which comes in the trailers or, for
+// a trailers-only response, in the headers.
+func grpcCall(t *testing.T, serverAddr, host, method string, payload []byte) (*http.Response, []byte, int) {
+	t.Helper()
+	transport := &http.Transport{Protocols: new(http.Protocols)}
+	transport.Protocols.SetUnencryptedHTTP2(true)
+	httpClient := &http.Client{Transport: transport}
+	defer transport.CloseIdleConnections()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, "http://"+serverAddr+method, bytes.NewReader(grpcMessage(payload)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	req.Host = host
+	req.Header.Set("Content-Type", "application/grpc")
+	req.Header.Set("TE", "trailers")
+
+	resp, err := httpClient.Do(req)
+	if err != nil {
+		t.Fatalf("%s: %v", method, err)
+	}
+	defer resp.Body.Close()
+	body, err := io.ReadAll(resp.Body)
+	if err != nil {
+		t.Fatalf("%s: reading body: %v", method, err)
+	}
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf("%s: HTTP status %d; gRPC answers 200", method, resp.StatusCode)
+	}
+
+	status := resp.Trailer.Get("Grpc-Status")
+	if status == "" {
+		status = resp.Header.Get("Grpc-Status")
+	}
+	code, err := strconv.Atoi(status)
+	if err != nil {
+		t.Fatalf("%s: grpc-status %q", method, status)
+	}
+	return resp, body, code
+}
+
+func TestGRPCThroughTunnel(t *testing.T) {
+	ts, serverAddr := startTunnelServer(t, Config{
+		BaseDomains:   []string{"example.test"},
+		HeaderTimeout: time.Second,
+	})
+	startTunnel(t, ts, serverAddr, "rpc", grpcOrigin(t))
+	startTunnel(t, ts, serverAddr, "down", closedPort(t))
+
+	t.Run("trailers", func(t *testing.T) {
+		resp, body, code := grpcCall(t, serverAddr, "rpc.example.test", "/test.Echo/Echo", []byte("hello"))
+		if code != 0 {
+			t.Errorf("grpc-status = %d; want 0", code)
+		}
+		if !bytes.Equal(body, grpcMessage([]byte("hello"))) {
+			t.Errorf("body = %q; want the echoed message", body)
+		}
+		if got := resp.Trailer.Get("X-Echo-Trailer"); got != "done" {
+			t.Errorf("X-Echo-Trailer trailer = %q; want done", got)
+		}
+	})
+
+	// Each message is only sent once the reply to the previous one arrived,
+	// so this hangs unless both directions are relayed as they go
+	t.Run("bidi streaming", func(t *testing.T) {
+		transport := &http.Transport{Protocols: new(http.Protocols)}
+		transport.Protocols.SetUnencryptedHTTP2(true)
+		defer transport.CloseIdleConnections()
+
+		ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+		defer cancel()
+		body, send := io.Pipe()
+		req, err := http.NewRequestWithContext(ctx, http.MethodPost, "http://"+serverAddr+"/test.Echo/Chat", body)
+		if err != nil {
+			t.Fatal(err)
+		}
+		req.Host = "rpc.example.test"
+		req.Header.Set("Content-Type", "application/grpc")
+		req.Header.Set("TE", "trailers")
+
+		messages := []string{"one", "two", "three"}
+		go send.Write(grpcMessage([]byte(messages[0])))
+		resp, err := transport.RoundTrip(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer resp.Body.Close()
+
+		for i, msg := range messages {
+			want := grpcMessage([]byte("re: " + msg))
+			got := make([]byte, len(want))
+			if _, err := io.ReadFull(resp.Body, got); err != nil {
+				t.Fatalf("reply to %s: %v", msg, err)
+			}
+			if !bytes.Equal(got, want) {
+				t.Fatalf("reply to %s = %q; want %q", msg, got, want)
+			}
+			if i+1 == len(messages) {
+				send.Close()
+			} else if _, err := send.Write(grpcMessage([]byte(messages[i+1]))); err != nil {
+				t.Fatalf("sending %s: %v", messages[i+1], err)
+			}
+		}
+
+		if rest, err := io.ReadAll(resp.Body); err != nil || len(rest) != 0 {
+			t.Fatalf("after the last reply: %q, %v", rest, err)
+		}
+		if status := resp.Trailer.Get("Grpc-Status"); status != "0" {
+			t.Errorf("grpc-status = %q; want 0", status)
+		}
+	})
+
+	t.Run("status from origin", func(t *testing.T) {
+		resp, body, code := grpcCall(t, serverAddr, "rpc.example.test", "/test.Echo/Fail", nil)
+		if code != 5 {
+			t.Errorf("grpc-status = %d; want 5", code)
+		}
+		if got := resp.Trailer.Get("Grpc-Message"); got != "no such thing" {
+			t.Errorf("grpc-message = %q; want %q", got, "no such thing")
+		}
+		if !bytes.Equal(body, grpcMessage([]byte("partial"))) {
+			t.Errorf("body = %q; want the message sent before the status", body)
+		}
+	})
+
+	// Calls the tunnel can't complete get a status the gRPC client
+	// understands instead of an HTTP error page
+	for _, tt := range []struct {
+		name   string
+		host   string
+		method string
+		want   int
+	}{
+		{"offline", "nope.example.test", "/test.Echo/Echo", grpcUnimplemented},
+		{"origin refused", "down.example.test", "/test.Echo/Echo", grpcUnavailable},
+		{"origin timeout", "rpc.example.test", "/test.Echo/Slow", grpcDeadlineExceeded},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			resp, body, code := grpcCall(t, serverAddr, tt.host, tt.method, []byte("hello"))
+			if code != tt.want {
+				t.Errorf("grpc-status = %d (%s); want %d", code, resp.Header.Get("Grpc-Message"), tt.want)
+			}
+			if ct := resp.Header.Get("Content-Type"); ct != "application/grpc" {
+				t.Errorf("Content-Type = %q; want application/grpc", ct)
+			}
+			if len(body) != 0 {
+				t.Errorf("body = %q; want none", body)
+			}
+		})
+	}
+}
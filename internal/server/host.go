@@ -0,0 +1,99 @@
+package server
+
+import (
+	"fmt"
+	"net"
+	"net/http"
+	"sort"
+	"strings"
+)
+
+// resolveHost maps a Host header to the tunnel it addresses. apex is set
+// when the host is one of the server's own base domains (or a bare IP).
+func (ts *TunnelServer) resolveHost(host string) (subdomain string, apex bool, ok bool) {
+	if subdomain, ok := ts.lookupCustomDomain(host); ok {
+		return subdomain, false, true
+	}
+
+	host = normalizeHost(host)
+	if host == "" || net.ParseIP(host) != nil {
+		return "", true, false
+	}
+
+	if len(ts.baseDomains) == 0 {
+		label, _, found := strings.Cut(host, ".")
+		if !found {
+			return "", true, false
+		}
+		return label, false, true
+	}
+
+	for _, base := range ts.baseDomains {
+		if host == base {
+			return "", true, false
+		}
+		if strings.HasSuffix(host, "."+base) {
+			subdomain = strings.TrimSuffix(host, "."+base)
+			return subdomain, false, validSubdomain(subdomain)
+		}
+	}
+	return "", false, false
+}
+
+// validSubdomain accepts one or more DNS labels, so tunnels can be nested
+// like feature.app.<base domain>.
+func validSubdomain(subdomain string) bool {
+	if len(subdomain) == 0 || len(subdomain) > 253 {
+		return false
+	}
+	for _, label := range strings.Split(subdomain, ".") {
+		if !validLabel(label) {
+			return false
+		}
+	}
+	return true
+}
+
+// publicURL is the address visitors use to reach a tunnel, or "" when the
+// server has no base domain configured.
+func (ts *TunnelServer) publicURL(subdomain string) string {
+	if len(ts.baseDomains) == 0 {
+		return ""
+	}
+	return fmt.Sprintf("https://%s.%s", subdomain, ts.baseDomains[0])
+}
+
+func (ts *TunnelServer) handleRoot(w http.ResponseWriter, r *http.Request) {
+	if r.URL.Path != "/" {
+		http.NotFound(w, r)
+		return
+	}
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	fmt.Fprint(w, rootPage)
+}
+
+// normalizeBaseDomains lowercases the configured base domains and orders
+// them longest first so the most specific suffix wins.
+func normalizeBaseDomains(domains []string) []string {
+	var normalized []string
+	for _, d := range domains {
+		if d = normalizeHost(strings.TrimPrefix(strings.TrimSpace(d), ".")); d != "" {
+			normalized = append(normalized, d)
+		}
+	}
+	sort.SliceStable(normalized, func(i, j int) bool {
+		return len(normalized[i]) > len(normalized[j])
+	})
+	return normalized
+}
+
+const rootPage = `<!DOCTYPE html>
+<html>
+<head><title>Simple Tunnel</title></head>
+<body>
+<h1>Simple Tunnel</h1>
+<p>This server exposes local web servers to the internet.</p>
+<p>Run <code>simple-tunnel --port 3000 --subdomain yoursubdomain</code> to open a tunnel.</p>
+</body>
+</html>
+`
@@ -0,0 +1,487 @@
+package server
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"log"
+	"net/http"
+	"net/http/httputil"
+	"os"
+	"path/filepath"
+	"runtime"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	maxInboxBody    = 10 << 20
+	inboxMarker     = ".inbox"
+	inboxRequestExt = ".http"
+	inboxTempExt    = ".tmp"
+)
+
+// inbox persists requests for offline tunnels that opted in with --inbox,
+// one file per request, and redelivers them in order when the client is back.
+type inbox struct {
+	dir         string
+	status      int
+	maxRequests int
+	maxBytes    int64
+
+	mu         sync.Mutex
+	delivering map[string]bool
+}
+
+type inboxEntry struct {
+	ID       string    `json:"id"`
+	Method   string    `json:"method"`
+	Path     string    `json:"path"`
+	Size     int64     `json:"size"`
+	Received time.Time `json:"received"`
+}
+
+func newInbox(dir string, status, maxRequests int, maxBytes int64) (*inbox, error) {
+	if err := os.MkdirAll(dir, 0o700); err != nil {
+		return nil, err
+	}
+	if status == 0 {
+		status = http.StatusAccepted
+	}
+
+	// Requests a previous process was still writing when it died are gone
+	// for good; their senders never got an answer
+	partial, err := filepath.Glob(filepath.Join(dir, "*", "*"+inboxTempExt))
+	if err != nil {
+		return nil, err
+	}
+	for _, path := range partial {
+		os.Remove(path)
+	}
+
+	return &inbox{
+		dir:         dir,
+		status:      status,
+		maxRequests: maxRequests,
+		maxBytes:    maxBytes,
+		delivering:  make(map[string]bool),
+	}, nil
+}
+
+// setEnabled records whether subdomain wants requests stored while offline,
+// along with the account of the client that asked for it. It is kept on disk
+// so it survives server restarts.
+func (ib *inbox) setEnabled(subdomain string, enabled bool, owner string) error {
+	marker := filepath.Join(ib.dir, subdomain, inboxMarker)
+	if !enabled {
+		if err := os.Remove(marker); err != nil && !os.IsNotExist(err) {
+			return err
+		}
+		return nil
+	}
+	if err := os.MkdirAll(filepath.Dir(marker), 0o700); err != nil {
+		return err
+	}
+	return os.WriteFile(marker, []byte(owner), 0o600)
+}
+
+func (ib *inbox) enabled(subdomain string) bool {
+	_, err := os.Stat(filepath.Join(ib.dir, subdomain, inboxMarker))
+	return err == nil
+}
+
+// owner is the account of the client that enabled the inbox, or "" if it
+// connected without a token.
+func (ib *inbox) owner(subdomain string) string {
+	owner, _ := os.ReadFile(filepath.Join(ib.dir, subdomain, inboxMarker))
+	return string(owner)
+}
+
+// store writes r to disk and answers the sender with the canned status.
+func (ib *inbox) store(w http.ResponseWriter, r *http.Request, subdomain string) {
+	if r.ContentLength > maxInboxBody {
+		http.Error(w, "Request body too large", http.StatusRequestEntityTooLarge)
+		return
+	}
+	body, err := io.ReadAll(http.MaxBytesReader(w, r.Body, maxInboxBody))
+	if err != nil {
+		log.Printf("Error reading request for inbox: %v", err)
+		http.Error(w, "Error storing request", http.StatusRequestEntityTooLarge)
+		return
+	}
+
+	// Store the request as the origin should see it: without any path
+	// routing prefix, and as HTTP/1.1 with an explicit length so bodies of
+	// HTTP/2 and chunked requests are read back in full
+	req := r.Clone(r.Context())
+	req.RequestURI = ""
+	req.Proto, req.ProtoMajor, req.ProtoMinor = "HTTP/1.1", 1, 1
+	req.TransferEncoding = nil
+	req.ContentLength = int64(len(body))
+	req.Header.Set("Content-Length", strconv.Itoa(len(body)))
+	req.Body = io.NopCloser(bytes.NewReader(body))
+
+	dump, err := httputil.DumpRequest(req, true)
+	if err != nil {
+		log.Printf("Error storing request in inbox: %v", err)
+		http.Error(w, "Error storing request", http.StatusInternalServerError)
+		return
+	}
+
+	id, err := ib.write(subdomain, dump)
+	if errors.Is(err, errInboxFull) {
+		log.Printf("Inbox for subdomain %s is full, turning away %s %s", subdomain, r.Method, r.URL.Path)
+		http.Error(w, "Inbox is full", http.StatusInsufficientStorage)
+		return
+	}
+	if err != nil {
+		log.Printf("Error writing request to inbox: %v", err)
+		http.Error(w, "Error storing request", http.StatusInternalServerError)
+		return
+	}
+
+	log.Printf("Stored %s %s in inbox for subdomain %s as %s", r.Method, r.URL.Path, subdomain, id)
+	w.WriteHeader(ib.status)
+}
+
+var errInboxFull = errors.New("inbox is full")
+
+// write stores a request durably and returns its id. The request is synced
+// to a temporary file first and only then linked under its id, so a crash
+// never leaves a partial entry and two requests never share an id.
+func (ib *inbox) write(subdomain string, dump []byte) (string, error) {
+	dir := filepath.Join(ib.dir, subdomain)
+	f, err := os.CreateTemp(dir, "*"+inboxTempExt)
+	if err != nil {
+		return "", err
+	}
+	defer os.Remove(f.Name())
+	if _, err := f.Write(dump); err != nil {
+		f.Close()
+		return "", err
+	}
+	if err := f.Sync(); err != nil {
+		f.Close()
+		return "", err
+	}
+	if err := f.Close(); err != nil {
+		return "", err
+	}
+
+	// Checking the limits and adding the entry happen together, so
+	// concurrent requests can't go over them between them
+	ib.mu.Lock()
+	defer ib.mu.Unlock()
+	requests, size, err := ib.usage(subdomain)
+	if err != nil {
+		return "", err
+	}
+	if ib.maxRequests > 0 && requests >= ib.maxRequests || ib.maxBytes > 0 && size+int64(len(dump)) > ib.maxBytes {
+		return "", errInboxFull
+	}
+
+	for nanos := time.Now().UnixNano(); ; nanos++ {
+		id := fmt.Sprintf("%020d", nanos)
+		err := os.Link(f.Name(), filepath.Join(dir, id+inboxRequestExt))
+		if errors.Is(err, fs.ErrExist) {
+			continue
+		}
+		if err != nil {
+			return "", err
+		}
+		return id, syncDir(dir)
+	}
+}
+
+// usage returns how many requests are stored for subdomain and their size on
+// disk.
+func (ib *inbox) usage(subdomain string) (int, int64, error) {
+	files, err := os.ReadDir(filepath.Join(ib.dir, subdomain))
+	if err != nil {
+		return 0, 0, err
+	}
+	var (
+		requests int
+		size     int64
+	)
+	for _, file := range files {
+		if !strings.HasSuffix(file.Name(), inboxRequestExt) {
+			continue
+		}
+		info, err := file.Info()
+		if err != nil {
+			continue
+		}
+		requests++
+		size += info.Size()
+	}
+	return requests, size, nil
+}
+
+// syncDir makes a new directory entry durable. Windows can't sync
+// directories and doesn't need to.
+func syncDir(dir string) error {
+	if runtime.GOOS == "windows" {
+		return nil
+	}
+	d, err := os.Open(dir)
+	if err != nil {
+		return err
+	}
+	defer d.Close()
+	return d.Sync()
+}
+
+func (ib *inbox) list(subdomain string) ([]inboxEntry, error) {
+	files, err := os.ReadDir(filepath.Join(ib.dir, subdomain))
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	var entries []inboxEntry
+	for _, file := range files {
+		id, ok := strings.CutSuffix(file.Name(), inboxRequestExt)
+		if !ok {
+			continue
+		}
+		req, size, err := ib.load(subdomain, id)
+		if err != nil {
+			log.Printf("Skipping unreadable inbox entry %s: %v", id, err)
+			continue
+		}
+		req.Body.Close()
+
+		nanos, _ := strconv.ParseInt(id, 10, 64)
+		entries = append(entries, inboxEntry{
+			ID:       id,
+			Method:   req.Method,
+			Path:     req.URL.RequestURI(),
+			Size:     size,
+			Received: time.Unix(0, nanos).UTC(),
+		})
+	}
+	sort.Slice(entries, func(i, j int) bool { return entries[i].ID < entries[j].ID })
+	return entries, nil
+}
+
+func (ib *inbox) load(subdomain, id string) (*http.Request, int64, error) {
+	if !validInboxID(id) {
+		return nil, 0, fmt.Errorf("invalid inbox id %q", id)
+	}
+	f, err := os.Open(filepath.Join(ib.dir, subdomain, id+inboxRequestExt))
+	if err != nil {
+		return nil, 0, err
+	}
+	req, err := http.ReadRequest(bufio.NewReader(f))
+	if err != nil {
+		f.Close()
+		return nil, 0, err
+	}
+	req.Body = struct {
+		io.Reader
+		io.Closer
+	}{req.Body, f}
+	return req, req.ContentLength, nil
+}
+
+func (ib *inbox) discard(subdomain, id string) error {
+	if !validInboxID(id) {
+		return fmt.Errorf("invalid inbox id %q", id)
+	}
+	return os.Remove(filepath.Join(ib.dir, subdomain, id+inboxRequestExt))
+}
+
+// deliverInboxEntry sends a stored request down the tunnel and removes it once the
+// origin has answered it without a server error.
+func (ts *TunnelServer) deliverInboxEntry(subdomain, id string) (int, error) {
+	tunnel := ts.pickTunnel(subdomain, nil)
+	if tunnel == nil {
+		return 0, fmt.Errorf("tunnel %s is not connected", subdomain)
+	}
+
+	req, _, err := ts.inbox.load(subdomain, id)
+	if err != nil {
+		return 0, err
+	}
+	defer req.Body.Close()
+
+	resp, err := tunnel.roundTrip(req, nil)
+	if err != nil {
+		if tunnel.isClosed() {
+			ts.removeTunnel(subdomain, tunnel)
+		}
+		return 0, err
+	}
+	discardResponse(resp)
+
+	// The request didn't get through to a working origin, so keep it for
+	// another try
+	if reason := resp.Header.Get(errorHeader); reason != "" {
+		return resp.StatusCode, fmt.Errorf("client couldn't deliver inbox entry %s: %s", id, reason)
+	}
+	if resp.StatusCode >= 500 {
+		return resp.StatusCode, fmt.Errorf("origin answered inbox entry %s with %d", id, resp.StatusCode)
+	}
+
+	log.Printf("Delivered inbox entry %s to subdomain %s: %d", id, subdomain, resp.StatusCode)
+	return resp.StatusCode, ts.inbox.discard(subdomain, id)
+}
+
+// deliverInbox drains a subdomain's stored requests in the order they
+// arrived. Only one delivery runs per subdomain at a time.
+func (ts *TunnelServer) deliverInbox(subdomain string) {
+	ib := ts.inbox
+	if !ib.startDelivery(subdomain) {
+		return
+	}
+	defer ib.endDelivery(subdomain)
+
+	entries, err := ib.list(subdomain)
+	if err != nil {
+		log.Printf("Error listing inbox for subdomain %s: %v", subdomain, err)
+		return
+	}
+	for _, entry := range entries {
+		if _, err := ts.deliverInboxEntry(subdomain, entry.ID); err != nil {
+			log.Printf("Stopped inbox delivery for subdomain %s: %v", subdomain, err)
+			return
+		}
+	}
+}
+
+// startDelivery reports whether the caller may deliver subdomain's stored
+// requests, which it must then end with endDelivery.
+func (ib *inbox) startDelivery(subdomain string) bool {
+	ib.mu.Lock()
+	defer ib.mu.Unlock()
+	if ib.delivering[subdomain] {
+		return false
+	}
+	ib.delivering[subdomain] = true
+	return true
+}
+
+func (ib *inbox) endDelivery(subdomain string) {
+	ib.mu.Lock()
+	delete(ib.delivering, subdomain)
+	ib.mu.Unlock()
+}
+
+// handleInbox serves the inbox API used by `simple-tunnel inbox`:
+//
+//	GET  /_tunnel/inbox?subdomain=x                 list stored requests
+//	POST /_tunnel/inbox/replay?subdomain=x[&id=y]   deliver now
+//	POST /_tunnel/inbox/discard?subdomain=x[&id=y]  delete
+func (ts *TunnelServer) handleInbox(w http.ResponseWriter, r *http.Request) {
+	if ts.inbox == nil {
+		http.Error(w, "Inbox is not enabled on this server", http.StatusNotFound)
+		return
+	}
+
+	subdomain := strings.ToLower(r.URL.Query().Get("subdomain"))
+	if !validSubdomain(subdomain) {
+		http.Error(w, "Invalid subdomain", http.StatusBadRequest)
+		return
+	}
+	if !ts.authorize(w, r, subdomain, ts.inbox.owner(subdomain)) {
+		return
+	}
+
+	action := strings.TrimPrefix(r.URL.Path, "/_tunnel/inbox")
+	if action == "" || action == "/" {
+		if r.Method != http.MethodGet {
+			http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+		entries, err := ts.inbox.list(subdomain)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		writeJSON(w, entries)
+		return
+	}
+
+	if r.Method != http.MethodPost {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	if action != "/replay" && action != "/discard" {
+		http.NotFound(w, r)
+		return
+	}
+	// Replays would otherwise race the delivery that runs when the client
+	// connects, sending requests twice or out of order
+	if action == "/replay" {
+		if !ts.inbox.startDelivery(subdomain) {
+			http.Error(w, "Stored requests are being delivered already", http.StatusConflict)
+			return
+		}
+		defer ts.inbox.endDelivery(subdomain)
+	}
+
+	ids := r.URL.Query()["id"]
+	if len(ids) == 0 {
+		entries, err := ts.inbox.list(subdomain)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		for _, entry := range entries {
+			ids = append(ids, entry.ID)
+		}
+	}
+
+	type result struct {
+		ID     string `json:"id"`
+		Status int    `json:"status,omitempty"`
+		Error  string `json:"error,omitempty"`
+	}
+	var results []result
+	for _, id := range ids {
+		res := result{ID: id}
+		var err error
+		if action == "/replay" {
+			res.Status, err = ts.deliverInboxEntry(subdomain, id)
+		} else {
+			err = ts.inbox.discard(subdomain, id)
+		}
+		if err != nil {
+			res.Error = err.Error()
+		}
+		results = append(results, res)
+		// Later requests wait for the one that failed, as they do on
+		// reconnect
+		if err != nil && action == "/replay" {
+			break
+		}
+	}
+	writeJSON(w, results)
+}
+
+func validInboxID(id string) bool {
+	if id == "" {
+		return false
+	}
+	for _, c := range id {
+		if c < '0' || c > '9' {
+			return false
+		}
+	}
+	return true
+}
+
+func writeJSON(w http.ResponseWriter, v any) {
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(v)
+}
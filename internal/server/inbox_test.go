@@ -0,0 +1,162 @@
+package server
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/ghousemohamed/simple-tunnel/internal/client"
+)
+
+func storeRequest(ib *inbox, subdomain, path string) int {
+	w := httptest.NewRecorder()
+	ib.store(w, httptest.NewRequest(http.MethodPost, path, strings.NewReader("payload")), subdomain)
+	return w.Code
+}
+
+func newTestInbox(t *testing.T, maxRequests int, maxBytes int64) *inbox {
+	t.Helper()
+	ib, err := newInbox(t.TempDir(), 0, maxRequests, maxBytes)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := ib.setEnabled("hook", true, ""); err != nil {
+		t.Fatal(err)
+	}
+	return ib
+}
+
+func TestInboxLimits(t *testing.T) {
+	ib := newTestInbox(t, 2, 0)
+	for i, want := range []int{http.StatusAccepted, http.StatusAccepted, http.StatusInsufficientStorage} {
+		if code := storeRequest(ib, "hook", "/"); code != want {
+			t.Fatalf("request %d answered %d, want %d", i, code, want)
+		}
+	}
+
+	ib = newTestInbox(t, 0, 300)
+	first := storeRequest(ib, "hook", "/")
+	_, size, err := ib.usage("hook")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if first != http.StatusAccepted || size == 0 || size > 300 {
+		t.Fatalf("first request answered %d and took %d bytes", first, size)
+	}
+	for storeRequest(ib, "hook", "/") == http.StatusAccepted {
+	}
+	if _, size, _ := ib.usage("hook"); size > 300 {
+		t.Fatalf("inbox holds %d bytes, limit is 300", size)
+	}
+}
+
+// TestInboxConcurrentStores checks that requests stored at the same time all
+// get their own entry and leave no temporary files behind.
+func TestInboxConcurrentStores(t *testing.T) {
+	ib := newTestInbox(t, 0, 0)
+	var wg sync.WaitGroup
+	for i := 0; i < 50; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			storeRequest(ib, "hook", "/")
+		}()
+	}
+	wg.Wait()
+
+	entries, err := ib.list("hook")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(entries) != 50 {
+		t.Fatalf("inbox holds %d entries, want 50", len(entries))
+	}
+	if partial, _ := filepath.Glob(filepath.Join(ib.dir, "hook", "*"+inboxTempExt)); len(partial) > 0 {
+		t.Fatalf("temporary files left behind: %v", partial)
+	}
+}
+
+func TestInboxRemovesPartialFiles(t *testing.T) {
+	ib := newTestInbox(t, 0, 0)
+	partial := filepath.Join(ib.dir, "hook", "123"+inboxTempExt)
+	if err := os.WriteFile(partial, []byte("POST / HT"), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := newInbox(ib.dir, 0, 0, 0); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := os.Stat(partial); !os.IsNotExist(err) {
+		t.Fatalf("partial file kept: %v", err)
+	}
+}
+
+// TestInboxDelivery checks that requests the origin fails stay in the inbox
+// and stop the delivery, and that replays wait for a running delivery.
+func TestInboxDelivery(t *testing.T) {
+	origin := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/fail" {
+			w.WriteHeader(http.StatusInternalServerError)
+		}
+	}))
+	defer origin.Close()
+
+	ts, serverAddr := startTunnelServer(t, Config{BaseDomains: []string{"example.test"}, InboxDir: t.TempDir()})
+	ts.inbox.setEnabled("hook", true, "")
+	for _, path := range []string{"/first", "/fail", "/last"} {
+		if code := storeRequest(ts.inbox, "hook", path); code != http.StatusAccepted {
+			t.Fatalf("storing %s answered %d", path, code)
+		}
+	}
+
+	connectClient(t, ts, client.Config{
+		HTTPPort:   port(t, origin.Listener.Addr()),
+		ServerAddr: serverAddr,
+		Subdomain:  "hook",
+		Inbox:      true,
+		Token:      "token",
+	})
+
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		entries, err := ts.inbox.list("hook")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(entries) == 2 {
+			if entries[0].Path != "/fail" || entries[1].Path != "/last" {
+				t.Fatalf("inbox keeps %s and %s, want /fail and /last", entries[0].Path, entries[1].Path)
+			}
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("inbox holds %d entries, want 2", len(entries))
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	// The delivery that ran on connect is still going, as far as the
+	// inbox knows
+	ts.inbox.startDelivery("hook")
+	r := httptest.NewRequest(http.MethodPost, "/_tunnel/inbox/replay?subdomain=hook", nil)
+	r.Header.Set("Authorization", "Bearer token")
+	w := httptest.NewRecorder()
+	ts.handleInbox(w, r)
+	if w.Code != http.StatusConflict {
+		t.Fatalf("replay during a delivery answered %d, want 409", w.Code)
+	}
+	ts.inbox.endDelivery("hook")
+
+	w = httptest.NewRecorder()
+	ts.handleInbox(w, r)
+	if w.Code != http.StatusOK || !strings.Contains(w.Body.String(), `"status":500`) {
+		t.Fatalf("replay answered %d: %s", w.Code, w.Body)
+	}
+	if entries, _ := ts.inbox.list("hook"); len(entries) != 2 {
+		t.Fatalf("replay left %d entries, want the 2 the origin failed or never got", len(entries))
+	}
+}
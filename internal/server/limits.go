@@ -0,0 +1,98 @@
+package server
+
+import (
+	"errors"
+	"io"
+	"net/http"
+	"sync/atomic"
+)
+
+// limits bound what a visitor or a client can make the server hold or
+// relay. Zero means no limit.
+type limits struct {
+	header       int   // bytes of response headers read from a client
+	requestBody  int64 // bytes of a visitor's request body
+	responseBody int64 // bytes of a response body relayed to a visitor
+	message      int64 // bytes of a single WebSocket message
+}
+
+var (
+	errHeaderTooLarge   = errors.New("response headers exceed the size limit")
+	errResponseTooLarge = errors.New("response body exceeds the size limit")
+)
+
+// requestBody limits a visitor's request body and remembers whether the
+// visitor tried to send more, however deep in the relay the error surfaced.
+type requestBody struct {
+	io.ReadCloser
+	exceeded atomic.Bool
+}
+
+func (ts *TunnelServer) limitRequestBody(w http.ResponseWriter, r *http.Request) *requestBody {
+	body := &requestBody{ReadCloser: http.MaxBytesReader(w, r.Body, ts.limits.requestBody)}
+	r.Body = body
+	return body
+}
+
+func (b *requestBody) Read(p []byte) (int, error) {
+	n, err := b.ReadCloser.Read(p)
+	var tooLarge *http.MaxBytesError
+	if errors.As(err, &tooLarge) {
+		b.exceeded.Store(true)
+	}
+	return n, err
+}
+
+func (b *requestBody) tooLarge() bool {
+	return b != nil && b.exceeded.Load()
+}
+
+// headerLimiter fails reads past n bytes until it is disarmed once the
+// headers have been parsed.
+type headerLimiter struct {
+	r        io.Reader
+	n        int64
+	disarmed bool
+}
+
+func newHeaderLimiter(r io.Reader, limit int) *headerLimiter {
+	if limit <= 0 {
+		return &headerLimiter{r: r, disarmed: true}
+	}
+	// Reading headers buffers a little of the body too
+	return &headerLimiter{r: r, n: int64(limit) + 4096}
+}
+
+func (l *headerLimiter) Read(p []byte) (int, error) {
+	if l.disarmed {
+		return l.r.Read(p)
+	}
+	if l.n <= 0 {
+		return 0, errHeaderTooLarge
+	}
+	if int64(len(p)) > l.n {
+		p = p[:l.n]
+	}
+	n, err := l.r.Read(p)
+	l.n -= int64(n)
+	return n, err
+}
+
+// limitedReader fails with err once more than remaining bytes are read.
+type limitedReader struct {
+	io.ReadCloser
+	remaining int64
+	err       error
+}
+
+func (l *limitedReader) Read(p []byte) (int, error) {
+	if int64(len(p)) > l.remaining+1 {
+		p = p[:l.remaining+1]
+	}
+	n, err := l.ReadCloser.Read(p)
+	l.remaining -= int64(n)
+	if l.remaining < 0 {
+		return n + int(l.remaining), l.err
+	}
+	return n, err
+}
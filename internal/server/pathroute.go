@@ -0,0 +1,78 @@
+package server
+
+import (
+	"net/http"
+	"net/url"
+	"strings"
+)
+
+const tunnelPathPrefix = "/t/"
+
+// routeByPath handles https://server/t/<name>/... for networks without
+// wildcard DNS. It strips the prefix from r and returns the tunnel name and
+// the prefix that was removed.
+func routeByPath(r *http.Request) (subdomain string, prefix string, ok bool) {
+	rest, found := strings.CutPrefix(r.URL.Path, tunnelPathPrefix)
+	if !found {
+		return "", "", false
+	}
+	name, path, _ := strings.Cut(rest, "/")
+	name = strings.ToLower(name)
+	if !validSubdomain(name) {
+		return "", "", false
+	}
+
+	prefix = tunnelPathPrefix + name
+	r.URL.Path = "/" + path
+	if r.URL.RawPath != "" {
+		r.URL.RawPath = strings.TrimPrefix(r.URL.RawPath, prefix)
+	}
+	r.Header.Set("X-Forwarded-Prefix", prefix)
+	return name, prefix, true
+}
+
+// rewritePathResponse maps redirects and cookie paths set by the origin
+// back under the tunnel's path prefix.
+func rewritePathResponse(header http.Header, prefix string, host string) {
+	if location := header.Get("Location"); location != "" {
+		header.Set("Location", prefixLocation(location, prefix, host))
+	}
+
+	cookies := header.Values("Set-Cookie")
+	if len(cookies) == 0 {
+		return
+	}
+	header.Del("Set-Cookie")
+	for _, cookie := range cookies {
+		header.Add("Set-Cookie", prefixCookiePath(cookie, prefix))
+	}
+}
+
+func prefixLocation(location, prefix, host string) string {
+	u, err := url.Parse(location)
+	if err != nil {
+		return location
+	}
+	if u.Host != "" && !strings.EqualFold(u.Host, host) {
+		return location
+	}
+	if u.Host == "" && !strings.HasPrefix(u.Path, "/") {
+		return location
+	}
+	u.Path = prefix + u.Path
+	if u.RawPath != "" {
+		u.RawPath = prefix + u.RawPath
+	}
+	return u.String()
+}
+
+func prefixCookiePath(cookie, prefix string) string {
+	attrs := strings.Split(cookie, ";")
+	for i, attr := range attrs {
+		name, value, found := strings.Cut(strings.TrimSpace(attr), "=")
+		if found && strings.EqualFold(name, "path") && strings.HasPrefix(value, "/") {
+			attrs[i] = " Path=" + prefix + value
+		}
+	}
+	return strings.Join(attrs, ";")
+}
@@ -0,0 +1,121 @@
+package server
+
+import (
+	"bytes"
+	"io"
+	"log"
+	"net/http"
+	"time"
+)
+
+// reconnectQueue holds requests for a subdomain whose client dropped
+// recently, until the client comes back or the grace period runs out.
+type reconnectQueue struct {
+	ready    chan struct{}
+	requests int
+	bytes    int64
+}
+
+// markDisconnected remembers when a subdomain lost its last client. Callers
+// hold tunnelsLock.
+func (ts *TunnelServer) markDisconnected(subdomain string) {
+	if ts.reconnectGrace > 0 {
+		ts.lastSeen[subdomain] = time.Now()
+	}
+}
+
+// markConnected releases any requests queued for subdomain. Callers hold
+// tunnelsLock.
+func (ts *TunnelServer) markConnected(subdomain string) {
+	delete(ts.lastSeen, subdomain)
+	if queue, ok := ts.queues[subdomain]; ok {
+		close(queue.ready)
+		delete(ts.queues, subdomain)
+	}
+}
+
+// waitForTunnel holds r while the subdomain's client reconnects. It returns
+// the status to answer with if no tunnel came back.
+func (ts *TunnelServer) waitForTunnel(r *http.Request, subdomain string) (*TunnelConnection, int) {
+	ts.tunnelsLock.Lock()
+	lastSeen, ok := ts.lastSeen[subdomain]
+	deadline := lastSeen.Add(ts.reconnectGrace)
+	if !ok || time.Now().After(deadline) {
+		delete(ts.lastSeen, subdomain)
+		delete(ts.queues, subdomain)
+		ts.tunnelsLock.Unlock()
+		return nil, http.StatusNotFound
+	}
+
+	queue, ok := ts.queues[subdomain]
+	if !ok {
+		queue = &reconnectQueue{ready: make(chan struct{})}
+		ts.queues[subdomain] = queue
+	}
+	if queue.requests >= ts.queueMaxRequests {
+		ts.tunnelsLock.Unlock()
+		return nil, http.StatusServiceUnavailable
+	}
+	queue.requests++
+	ts.tunnelsLock.Unlock()
+
+	var size int64
+	defer func() {
+		ts.tunnelsLock.Lock()
+		queue.requests--
+		queue.bytes -= size
+		// The last request out of an expired queue removes it
+		if queue.requests == 0 && ts.queues[subdomain] == queue && time.Now().After(deadline) {
+			delete(ts.queues, subdomain)
+		}
+		ts.tunnelsLock.Unlock()
+	}()
+
+	// Buffer the body so the visitor's upload doesn't stall while we wait.
+	// Each chunk is charged to the queue as it arrives, so concurrent
+	// requests can't hold more than queueMaxBytes between them.
+	if r.Body != nil && r.Body != http.NoBody {
+		var body bytes.Buffer
+		chunk := make([]byte, 32<<10)
+		for {
+			n, err := r.Body.Read(chunk)
+			if n > 0 {
+				ts.tunnelsLock.Lock()
+				fits := queue.bytes+int64(n) <= ts.queueMaxBytes
+				if fits {
+					queue.bytes += int64(n)
+					size += int64(n)
+				}
+				ts.tunnelsLock.Unlock()
+				body.Write(chunk[:n])
+				if !fits {
+					// Leave the body intact for whoever handles the request next
+					r.Body = io.NopCloser(io.MultiReader(&body, r.Body))
+					return nil, http.StatusServiceUnavailable
+				}
+			}
+			if err == io.EOF {
+				break
+			}
+			if err != nil {
+				return nil, http.StatusServiceUnavailable
+			}
+		}
+		r.Body = io.NopCloser(&body)
+	}
+
+	log.Printf("Holding %s %s until subdomain %s reconnects", r.Method, r.URL.Path, subdomain)
+
+	timer := time.NewTimer(time.Until(deadline))
+	defer timer.Stop()
+
+	select {
+	case <-queue.ready:
+		if tunnel := ts.pickTunnel(subdomain, nil); tunnel != nil {
+			return tunnel, 0
+		}
+	case <-timer.C:
+	case <-r.Context().Done():
+	}
+	return nil, http.StatusServiceUnavailable
+}
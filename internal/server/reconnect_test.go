@@ -0,0 +1,68 @@
+package server
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// slowBody hands out a few bytes per read, so concurrent requests buffer
+// their bodies at the same time.
+type slowBody struct {
+	*strings.Reader
+}
+
+func (b slowBody) Read(p []byte) (int, error) {
+	time.Sleep(time.Millisecond)
+	return b.Reader.Read(p[:min(len(p), 10)])
+}
+
+func (b slowBody) Close() error { return nil }
+
+// TestReconnectQueueBytes checks that requests held together never buffer
+// more than queueMaxBytes, and that the queue goes away with the grace
+// period.
+func TestReconnectQueueBytes(t *testing.T) {
+	ts, err := NewTunnelServer(Config{
+		BaseDomains:      []string{"example.test"},
+		ReconnectGrace:   300 * time.Millisecond,
+		QueueMaxRequests: 20,
+		QueueMaxBytes:    100,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	ts.tunnelsLock.Lock()
+	ts.markDisconnected("app")
+	ts.tunnelsLock.Unlock()
+
+	var wg sync.WaitGroup
+	for i := 0; i < 10; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			r := httptest.NewRequest(http.MethodPost, "/", nil)
+			r.Body = slowBody{strings.NewReader(strings.Repeat("x", 40))}
+			ts.waitForTunnel(r, "app")
+		}()
+	}
+
+	time.Sleep(150 * time.Millisecond)
+	ts.tunnelsLock.Lock()
+	held := ts.queues["app"].bytes
+	ts.tunnelsLock.Unlock()
+	if held > 100 {
+		t.Fatalf("queue holds %d bytes, limit is 100", held)
+	}
+
+	wg.Wait()
+	ts.tunnelsLock.Lock()
+	_, ok := ts.queues["app"]
+	ts.tunnelsLock.Unlock()
+	if ok {
+		t.Fatal("queue kept after the grace period")
+	}
+}
@@ -0,0 +1,120 @@
+package server
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"strings"
+	"time"
+
+	"github.com/ghousemohamed/simple-tunnel/internal/cluster"
+	"github.com/ghousemohamed/simple-tunnel/internal/registry"
+)
+
+// registryStore opens the store the registry is kept in: the cluster store
+// when there is one, so every node sees the same reservations, and otherwise
+// memory or --registry-dir.
+func registryStore(config Config, node *clusterNode) (cluster.Store, error) {
+	if node != nil {
+		if config.RegistryDir != "" {
+			return nil, fmt.Errorf("--registry-dir can't be used with --cluster-store, which holds the registry")
+		}
+		return node.store, nil
+	}
+	if config.RegistryDir == "" {
+		return cluster.NewMemoryStore(), nil
+	}
+	return cluster.NewFileStore(config.RegistryDir)
+}
+
+// newRegistry opens the registry in store. A registry this process doesn't
+// share has nothing connected to it yet, so entries are marked disconnected;
+// other nodes' clients are still connected, so shared entries are left as
+// they are.
+func newRegistry(store cluster.Store, shared bool) (registry.Registry, error) {
+	reg := registry.New(store)
+	if shared {
+		return reg, nil
+	}
+
+	entries, err := reg.List()
+	if err != nil {
+		return nil, err
+	}
+	for _, entry := range entries {
+		if !entry.Connected {
+			continue
+		}
+		_, err = reg.Update(entry.Subdomain, func(entry registry.Entry, ok bool) (*registry.Entry, error) {
+			if !ok || !entry.Kept() {
+				return nil, nil
+			}
+			entry.Connected = false
+			return &entry, nil
+		})
+		if err != nil {
+			return nil, err
+		}
+	}
+	return reg, nil
+}
+
+// persistentRegistry reports whether the registry config asks for is kept
+// across restarts.
+func persistentRegistry(config Config) bool {
+	if config.ClusterStore != "" {
+		return !strings.HasPrefix(config.ClusterStore, "memory:")
+	}
+	return config.RegistryDir != ""
+}
+
+// register records that a client connected for subdomain, keeping what the
+// registry already knows about it.
+func (ts *TunnelServer) register(subdomain string, hostnames []string, mode string) {
+	_, err := ts.registry.Update(subdomain, func(entry registry.Entry, _ bool) (*registry.Entry, error) {
+		entry.Hostnames = hostnames
+		entry.Mode = mode
+		entry.Connected = true
+		entry.LastSeen = time.Now()
+		return &entry, nil
+	})
+	if err != nil && !errors.Is(err, registry.ErrSuspended) {
+		log.Printf("Error registering subdomain %s: %v", subdomain, err)
+	}
+	ts.announce(subdomain)
+}
+
+// unregister records that the last client for subdomain went away. Reserved
+// entries and those with verified custom domains stay in the registry, and in a cluster the entry is left alone
+// while another node still serves subdomain.
+func (ts *TunnelServer) unregister(subdomain string) {
+	ts.tunnelsLock.RLock()
+	_, connected := ts.tunnel[subdomain]
+	ts.tunnelsLock.RUnlock()
+	if connected {
+		return
+	}
+	ts.withdraw(subdomain)
+	if ts.cluster != nil {
+		owners, err := ts.clusterOwners(subdomain)
+		if err != nil {
+			log.Printf("Error looking up subdomain %s in the cluster: %v", subdomain, err)
+			return
+		}
+		if len(owners) > 0 {
+			return
+		}
+	}
+
+	_, err := ts.registry.Update(subdomain, func(entry registry.Entry, ok bool) (*registry.Entry, error) {
+		if !ok || !entry.Kept() {
+			return nil, nil
+		}
+		entry.Connected = false
+		entry.LastSeen = time.Now()
+		return &entry, nil
+	})
+	if err != nil && !errors.Is(err, registry.ErrSuspended) {
+		log.Printf("Error unregistering subdomain %s: %v", subdomain, err)
+	}
+}
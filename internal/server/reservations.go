@@ -0,0 +1,278 @@
+package server
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"slices"
+	"strings"
+	"time"
+
+	"github.com/ghousemohamed/simple-tunnel/internal/registry"
+)
+
+type reservation struct {
+	Subdomain string    `json:"subdomain"`
+	Connected bool      `json:"connected"`
+	LastSeen  time.Time `json:"last_seen"`
+}
+
+// account identifies the caller by a hash of the bearer token it sent, so
+// tokens themselves are never stored. It is empty for anonymous callers.
+func account(r *http.Request) string {
+	token, ok := strings.CutPrefix(r.Header.Get("Authorization"), "Bearer ")
+	if !ok || token == "" {
+		return ""
+	}
+	sum := sha256.Sum256([]byte(token))
+	return hex.EncodeToString(sum[:])
+}
+
+// allowed reports whether the caller may use subdomain: it isn't reserved,
+// or it is reserved to the caller's account.
+func (ts *TunnelServer) allowed(subdomain string, r *http.Request) bool {
+	entry, ok, err := ts.registry.Lookup(subdomain)
+	if err != nil {
+		log.Printf("Error looking up subdomain %s in the registry: %v", subdomain, err)
+		return false
+	}
+	return !ok || !entry.Reserved || entry.Owner == account(r)
+}
+
+// authorize checks that the caller may look into subdomain through the API
+// and answers the request if not. Callers need the token of the account the
+// subdomain is reserved to or, for names that aren't reserved, the token of
+// a client serving it or of one listed in known.
+func (ts *TunnelServer) authorize(w http.ResponseWriter, r *http.Request, subdomain string, known ...string) bool {
+	caller := account(r)
+	if caller == "" {
+		http.Error(w, "A token is required", http.StatusUnauthorized)
+		return false
+	}
+	entry, ok, err := ts.registry.Lookup(subdomain)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return false
+	}
+	if ok && entry.Reserved {
+		if entry.Owner != caller {
+			http.Error(w, "Subdomain is reserved by another account", http.StatusForbidden)
+			return false
+		}
+		return true
+	}
+	if slices.Contains(known, caller) || ts.servedBy(subdomain, caller) {
+		return true
+	}
+	http.Error(w, "Token doesn't match the tunnel's", http.StatusForbidden)
+	return false
+}
+
+// servedBy reports whether a client with caller's account is connected for
+// subdomain.
+func (ts *TunnelServer) servedBy(subdomain, caller string) bool {
+	ts.tunnelsLock.RLock()
+	defer ts.tunnelsLock.RUnlock()
+	group, ok := ts.tunnel[subdomain]
+	if !ok {
+		return false
+	}
+	for _, member := range group.members {
+		if member.account == caller && !member.isClosed() {
+			return true
+		}
+	}
+	return false
+}
+
+func (ts *TunnelServer) handleReservations(w http.ResponseWriter, r *http.Request) {
+	owner := account(r)
+	if owner == "" {
+		http.Error(w, "A token is required", http.StatusUnauthorized)
+		return
+	}
+
+	subdomain := strings.ToLower(strings.TrimPrefix(strings.TrimPrefix(r.URL.Path, "/_tunnel/reservations"), "/"))
+	if subdomain == "" {
+		if r.Method != http.MethodGet {
+			http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+		entries, err := ts.registry.List()
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		reservations := []reservation{}
+		for _, entry := range entries {
+			if entry.Reserved && entry.Owner == owner {
+				reservations = append(reservations, reservation{entry.Subdomain, entry.Connected, entry.LastSeen})
+			}
+		}
+		writeJSON(w, reservations)
+		return
+	}
+
+	if !validSubdomain(subdomain) {
+		http.Error(w, "Invalid subdomain", http.StatusBadRequest)
+		return
+	}
+
+	var (
+		entry registry.Entry
+		err   error
+	)
+	switch r.Method {
+	case http.MethodPost:
+		if !ts.reservable {
+			http.Error(w, "This server keeps its registry in memory, where reservations would be lost on restart; it needs --registry-dir or --cluster-store to take them", http.StatusNotImplemented)
+			return
+		}
+		if ts.maxReservations > 0 {
+			if err := ts.checkReservationLimit(owner, subdomain); err != nil {
+				reservationError(w, err)
+				return
+			}
+		}
+		reserved := false
+		entry, err = ts.registry.Update(subdomain, func(entry registry.Entry, _ bool) (*registry.Entry, error) {
+			if entry.Reserved && entry.Owner != owner {
+				return nil, errReservedElsewhere
+			}
+			reserved = !entry.Reserved
+			entry.Reserved = true
+			entry.Owner = owner
+			return &entry, nil
+		})
+		if err == nil && reserved && ts.maxReservations > 0 {
+			// Another request may have reserved a subdomain for the same
+			// account since the count above, so count again now that this
+			// one is stored and give it back if that went over the limit
+			if err = ts.checkReservationLimit(owner, subdomain); err != nil {
+				ts.release(subdomain, owner)
+			}
+		}
+		if err == nil {
+			ts.enforceReservation(subdomain)
+		}
+	case http.MethodDelete:
+		var released registry.Entry
+		_, err = ts.registry.Update(subdomain, func(entry registry.Entry, ok bool) (*registry.Entry, error) {
+			released = entry
+			return releasedEntry(entry, ok, owner)
+		})
+		entry = released
+	default:
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	if err != nil {
+		reservationError(w, err)
+		return
+	}
+	writeJSON(w, reservation{subdomain, entry.Connected, entry.LastSeen})
+}
+
+var (
+	errReservedElsewhere = errors.New("Subdomain is reserved by another account")
+	errNotReserved       = errors.New("Subdomain is not reserved")
+)
+
+// reservationError answers a reservation request that failed with err.
+func reservationError(w http.ResponseWriter, err error) {
+	var limit reservationLimitError
+	switch {
+	case errors.Is(err, errReservedElsewhere):
+		http.Error(w, err.Error(), http.StatusConflict)
+	case errors.Is(err, errNotReserved):
+		http.Error(w, err.Error(), http.StatusNotFound)
+	case errors.As(err, &limit):
+		http.Error(w, err.Error(), http.StatusForbidden)
+	case errors.Is(err, registry.ErrSuspended):
+		http.Error(w, "The server is restarting, try again shortly", http.StatusServiceUnavailable)
+	default:
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+	}
+}
+
+// releasedEntry returns what is left of entry once owner gives up its
+// reservation: the entry without the reservation if it is still connected or
+// otherwise kept, and nothing otherwise.
+func releasedEntry(entry registry.Entry, ok bool, owner string) (*registry.Entry, error) {
+	if !ok || !entry.Reserved {
+		return nil, errNotReserved
+	}
+	if entry.Owner != owner {
+		return nil, errReservedElsewhere
+	}
+	entry.Reserved = false
+	entry.Owner = ""
+	if !entry.Connected && !entry.Kept() {
+		return nil, nil
+	}
+	return &entry, nil
+}
+
+// release gives back owner's reservation of subdomain.
+func (ts *TunnelServer) release(subdomain, owner string) {
+	_, err := ts.registry.Update(subdomain, func(entry registry.Entry, ok bool) (*registry.Entry, error) {
+		return releasedEntry(entry, ok, owner)
+	})
+	if err != nil {
+		log.Printf("Error releasing reservation of subdomain %s: %v", subdomain, err)
+	}
+}
+
+type reservationLimitError int
+
+func (e reservationLimitError) Error() string {
+	return fmt.Sprintf("This account already holds the maximum of %d reservations", int(e))
+}
+
+// checkReservationLimit fails if owner already holds the maximum number of
+// reservations, not counting subdomain.
+func (ts *TunnelServer) checkReservationLimit(owner, subdomain string) error {
+	entries, err := ts.registry.List()
+	if err != nil {
+		return err
+	}
+	held := 0
+	for _, entry := range entries {
+		if entry.Reserved && entry.Owner == owner && entry.Subdomain != subdomain {
+			held++
+		}
+	}
+	if held >= ts.maxReservations {
+		return reservationLimitError(ts.maxReservations)
+	}
+	return nil
+}
+
+// enforceReservation disconnects this node's clients of subdomain that
+// don't belong to the account it is reserved to. They are turned away when
+// they try to reconnect.
+func (ts *TunnelServer) enforceReservation(subdomain string) {
+	entry, ok, err := ts.registry.Lookup(subdomain)
+	if err != nil || !ok || !entry.Reserved {
+		return
+	}
+
+	var evicted []*TunnelConnection
+	ts.tunnelsLock.RLock()
+	if group, ok := ts.tunnel[subdomain]; ok {
+		for _, member := range group.members {
+			if member.account != entry.Owner {
+				evicted = append(evicted, member)
+			}
+		}
+	}
+	ts.tunnelsLock.RUnlock()
+
+	for _, member := range evicted {
+		log.Printf("Disconnecting client of subdomain %s, which is now reserved by another account", subdomain)
+		ts.removeTunnel(subdomain, member)
+	}
+}
@@ -0,0 +1,117 @@
+package server
+
+import (
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+)
+
+func reserve(ts *TunnelServer, method, subdomain, token string) int {
+	r := httptest.NewRequest(method, "/_tunnel/reservations/"+subdomain, nil)
+	r.Header.Set("Authorization", "Bearer "+token)
+	w := httptest.NewRecorder()
+	ts.handleReservations(w, r)
+	return w.Code
+}
+
+// TestReservationLimit checks that concurrent reservations never take an
+// account over --max-reservations.
+func TestReservationLimit(t *testing.T) {
+	ts, err := NewTunnelServer(Config{BaseDomains: []string{"example.test"}, RegistryDir: t.TempDir(), MaxReservations: 2})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var wg sync.WaitGroup
+	for i := 0; i < 10; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			reserve(ts, http.MethodPost, fmt.Sprintf("app%d", i), "token")
+		}()
+	}
+	wg.Wait()
+
+	entries, err := ts.registry.List()
+	if err != nil {
+		t.Fatal(err)
+	}
+	held := 0
+	for _, entry := range entries {
+		if entry.Reserved {
+			held++
+		}
+	}
+	if held > 2 {
+		t.Fatalf("account holds %d reservations, want at most 2", held)
+	}
+}
+
+func TestReservationConflict(t *testing.T) {
+	ts, err := NewTunnelServer(Config{BaseDomains: []string{"example.test"}, RegistryDir: t.TempDir()})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var wg sync.WaitGroup
+	codes := make([]int, 10)
+	for i := range codes {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			codes[i] = reserve(ts, http.MethodPost, "app", fmt.Sprintf("token%d", i))
+		}()
+	}
+	wg.Wait()
+
+	won := 0
+	for _, code := range codes {
+		switch code {
+		case http.StatusOK:
+			won++
+		case http.StatusConflict:
+		default:
+			t.Fatalf("reservation answered %d", code)
+		}
+	}
+	if won != 1 {
+		t.Fatalf("%d accounts reserved the same subdomain, want 1", won)
+	}
+	if code := reserve(ts, http.MethodDelete, "app", "other"); code != http.StatusConflict {
+		t.Fatalf("release by another account answered %d", code)
+	}
+}
+
+func TestReservationSuspended(t *testing.T) {
+	ts, err := NewTunnelServer(Config{BaseDomains: []string{"example.test"}, RegistryDir: t.TempDir()})
+	if err != nil {
+		t.Fatal(err)
+	}
+	ts.registry.Suspend()
+	if code := reserve(ts, http.MethodPost, "app", "token"); code != http.StatusServiceUnavailable {
+		t.Fatalf("reservation while suspended answered %d, want 503", code)
+	}
+	ts.registry.Resume()
+	if code := reserve(ts, http.MethodPost, "app", "token"); code != http.StatusOK {
+		t.Fatalf("reservation after resuming answered %d", code)
+	}
+}
+
+// TestReservationNeedsRegistry checks that a server whose registry is lost on
+// restart doesn't take reservations it can't keep.
+func TestReservationNeedsRegistry(t *testing.T) {
+	for _, config := range []Config{
+		{BaseDomains: []string{"example.test"}},
+		{BaseDomains: []string{"example.test"}, ClusterStore: "memory://", ClusterAdvertise: "http://127.0.0.1:1", ClusterSecret: "secret"},
+	} {
+		ts, err := NewTunnelServer(config)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if code := reserve(ts, http.MethodPost, "app", "token"); code != http.StatusNotImplemented {
+			t.Fatalf("reservation with cluster store %q answered %d, want 501", config.ClusterStore, code)
+		}
+	}
+}
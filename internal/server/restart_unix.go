@@ -0,0 +1,153 @@
+//go:build !windows
+
+package server
+
+import (
+	"fmt"
+	"log"
+	"net"
+	"os"
+	"os/exec"
+	"os/signal"
+	"strings"
+	"syscall"
+	"time"
+)
+
+// A restarted server finds its inherited listeners and readiness pipe at
+// these descriptors.
+const (
+	listenFDEnv          = "SIMPLE_TUNNEL_LISTEN_FD"
+	readyFDEnv           = "SIMPLE_TUNNEL_READY_FD"
+	redirectFDEnv        = "SIMPLE_TUNNEL_REDIRECT_FD"
+	handoffSubdomainsEnv = "SIMPLE_TUNNEL_HANDOFF_SUBDOMAINS"
+
+	inheritedListenerFD = 3
+	inheritedReadyFD    = 4
+	inheritedRedirectFD = 5
+
+	handoffReadyTimeout = 30 * time.Second
+)
+
+// listen reuses the socket handed over by a previous server process, if
+// any, so no connection is refused during a restart.
+func listen(addr string) (net.Listener, error) {
+	return inheritOrListen(addr, listenFDEnv, inheritedListenerFD)
+}
+
+// listenRedirect does the same for the HTTP redirect listener.
+func listenRedirect(addr string) (net.Listener, error) {
+	return inheritOrListen(addr, redirectFDEnv, inheritedRedirectFD)
+}
+
+func inheritOrListen(addr, env string, fd uintptr) (net.Listener, error) {
+	if os.Getenv(env) == "" {
+		return net.Listen("tcp", addr)
+	}
+	f := os.NewFile(fd, "listener")
+	defer f.Close()
+	ln, err := net.FileListener(f)
+	if err != nil {
+		return nil, fmt.Errorf("inherited listener: %v", err)
+	}
+	log.Println("Serving on listener inherited from previous process")
+	return ln, nil
+}
+
+// notifyReady tells the previous process it can start draining.
+func notifyReady() {
+	if os.Getenv(readyFDEnv) == "" {
+		return
+	}
+	f := os.NewFile(inheritedReadyFD, "ready")
+	f.Write([]byte{1})
+	f.Close()
+}
+
+// handoffSubdomains lists the subdomains that were connected to the
+// previous process, so their requests are held while the clients move over.
+func handoffSubdomains() []string {
+	if v := os.Getenv(handoffSubdomainsEnv); v != "" {
+		return strings.Split(v, ",")
+	}
+	return nil
+}
+
+func notifyRestart(c chan<- os.Signal) {
+	signal.Notify(c, syscall.SIGUSR2)
+}
+
+// handoff starts a new copy of the running binary on the same listening
+// sockets and waits until it is serving. redirectLn is nil when the server
+// doesn't redirect plain HTTP.
+func handoff(ln, redirectLn net.Listener, subdomains []string) error {
+	listenerFile, err := socketFile(ln)
+	if err != nil {
+		return err
+	}
+	defer listenerFile.Close()
+
+	readyR, readyW, err := os.Pipe()
+	if err != nil {
+		return err
+	}
+	defer readyR.Close()
+
+	executable, err := os.Executable()
+	if err != nil {
+		return err
+	}
+
+	cmd := exec.Command(executable, os.Args[1:]...)
+	cmd.Stdout = os.Stdout
+	cmd.Stderr = os.Stderr
+	cmd.ExtraFiles = []*os.File{listenerFile, readyW}
+	cmd.Env = append(os.Environ(),
+		fmt.Sprintf("%s=%d", listenFDEnv, inheritedListenerFD),
+		fmt.Sprintf("%s=%d", readyFDEnv, inheritedReadyFD),
+		fmt.Sprintf("%s=%s", handoffSubdomainsEnv, strings.Join(subdomains, ",")),
+	)
+	if redirectLn != nil {
+		redirectFile, err := socketFile(redirectLn)
+		if err != nil {
+			readyW.Close()
+			return err
+		}
+		defer redirectFile.Close()
+		cmd.ExtraFiles = append(cmd.ExtraFiles, redirectFile)
+		cmd.Env = append(cmd.Env, fmt.Sprintf("%s=%d", redirectFDEnv, inheritedRedirectFD))
+	}
+	if err := cmd.Start(); err != nil {
+		readyW.Close()
+		return err
+	}
+	readyW.Close()
+	go cmd.Wait()
+
+	ready := make(chan error, 1)
+	go func() {
+		b := make([]byte, 1)
+		_, err := readyR.Read(b)
+		ready <- err
+	}()
+
+	select {
+	case err := <-ready:
+		if err != nil {
+			return fmt.Errorf("new process exited before it was ready: %v", err)
+		}
+		log.Printf("New server process %d is ready", cmd.Process.Pid)
+		return nil
+	case <-time.After(handoffReadyTimeout):
+		cmd.Process.Kill()
+		return fmt.Errorf("new server process was not ready within %s", handoffReadyTimeout)
+	}
+}
+
+func socketFile(ln net.Listener) (*os.File, error) {
+	filer, ok := ln.(interface{ File() (*os.File, error) })
+	if !ok {
+		return nil, fmt.Errorf("listener %T cannot be handed over", ln)
+	}
+	return filer.File()
+}
@@ -0,0 +1,29 @@
+//go:build windows
+
+package server
+
+import (
+	"fmt"
+	"net"
+	"os"
+)
+
+func listen(addr string) (net.Listener, error) {
+	return net.Listen("tcp", addr)
+}
+
+func listenRedirect(addr string) (net.Listener, error) {
+	return net.Listen("tcp", addr)
+}
+
+func notifyReady() {}
+
+func handoffSubdomains() []string {
+	return nil
+}
+
+func notifyRestart(c chan<- os.Signal) {}
+
+func handoff(ln, redirectLn net.Listener, subdomains []string) error {
+	return fmt.Errorf("restarts with listener handoff are not supported on windows")
+}
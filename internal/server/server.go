@@ -1,53 +1,208 @@
 package server
 
 import (
+	"crypto/tls"
 	"fmt"
 	"log"
+	"net"
 	"net/http"
 	"context"
 	"os"
 	"os/signal"
 	"syscall"
 	"time"
+
+	"github.com/ghousemohamed/simple-tunnel/internal/proxyproto"
 )
 
+type Config struct {
+	HTTPPort          string
+	TrustedProxies    []string
+	ProxyProtocolFrom []string
+	DomainSecret      string
+	BaseDomains       []string
+	PathRouting       bool
+	LoadBalancing     string
+	ReconnectGrace    time.Duration
+	QueueMaxRequests  int
+	QueueMaxBytes     int64
+	InboxDir          string
+	InboxStatus       int
+	InboxMaxRequests  int
+	InboxMaxBytes     int64
+	DrainTimeout      time.Duration
+	ClusterStore      string
+	ClusterAdvertise  string
+	ClusterSecret     string
+	RegistryDir       string
+	MaxReservations   int
+	ErrorPagesDir     string
+	HeaderTimeout     time.Duration
+	IdleTimeout       time.Duration
+	RequestTimeout    time.Duration
+	MaxHeaderBytes    int
+	MaxRequestBody    int64
+	MaxResponseBody   int64
+	MaxMessageSize    int64
+	H2C               bool
+	TLSCert           string
+	TLSKey            string
+	TLSCertDir        string
+	HTTPRedirectPort  string
+}
+
 type Server struct {
-	httpPort string
+	config Config
 }
 
-func NewServer(httpPort string) *Server {
+func NewServer(config Config) *Server {
 	return &Server{
-		httpPort: httpPort,
+		config: config,
 	}
 }
 
 func (s *Server) StartServer() error {
-	ts := NewTunnelServer()
+	ts, err := NewTunnelServer(s.config)
+	if err != nil {
+		return err
+	}
 	// Routes
 	http.HandleFunc("/", ts.handleTunnelRequest)
 	http.HandleFunc("/_tunnel", ts.handleTunnelOpen)
+	http.HandleFunc("/_tunnel/deliveries", ts.handleDeliveries)
+	http.HandleFunc("/_tunnel/inbox", ts.handleInbox)
+	http.HandleFunc("/_tunnel/inbox/", ts.handleInbox)
+	http.HandleFunc("/_tunnel/reservations", ts.handleReservations)
+	http.HandleFunc("/_tunnel/reservations/", ts.handleReservations)
 
 	srv := &http.Server{
-		Addr:    fmt.Sprintf(":%s", s.httpPort),
-		Handler: nil,
+		Addr:           fmt.Sprintf(":%s", s.config.HTTPPort),
+		Handler:        nil,
+		MaxHeaderBytes: s.config.MaxHeaderBytes,
+		Protocols:      new(http.Protocols),
+	}
+	// HTTP/2 is negotiated through TLS, or spoken in the clear by visitors
+	// that know the server supports it
+	srv.Protocols.SetHTTP1(true)
+	srv.Protocols.SetHTTP2(true)
+	srv.Protocols.SetUnencryptedHTTP2(s.config.H2C)
+
+	var certs *certStore
+	if s.config.TLSCert != "" || s.config.TLSKey != "" || s.config.TLSCertDir != "" {
+		certs, err = newCertStore(s.config.TLSCert, s.config.TLSKey, s.config.TLSCertDir)
+		if err != nil {
+			return fmt.Errorf("tls: %v", err)
+		}
+		srv.TLSConfig = &tls.Config{
+			GetCertificate: certs.getCertificate,
+			MinVersion:     tls.VersionTLS12,
+		}
+		go certs.watch()
+	} else if s.config.HTTPRedirectPort != "" {
+		return fmt.Errorf("--http-redirect-port needs --tls-cert or --tls-cert-dir")
+	}
+
+	proxyProtocolFrom, err := parseCIDRs(s.config.ProxyProtocolFrom)
+	if err != nil {
+		return fmt.Errorf("proxy protocol sources: %v", err)
+	}
+	acceptProxyProtocol := func(ln net.Listener) net.Listener {
+		if len(proxyProtocolFrom) == 0 {
+			return ln
+		}
+		return &proxyproto.Listener{
+			Listener:      ln,
+			Allowed:       proxyProtocolFrom,
+			HeaderTimeout: 10 * time.Second,
+		}
+	}
+
+	rawListener, err := listen(srv.Addr)
+	if err != nil {
+		return err
+	}
+	ln := acceptProxyProtocol(rawListener)
+
+	// Plain HTTP on the redirect port only sends everyone to HTTPS
+	var redirectSrv *http.Server
+	var rawRedirectListener net.Listener
+	if s.config.HTTPRedirectPort != "" {
+		redirectSrv = &http.Server{
+			Addr:           fmt.Sprintf(":%s", s.config.HTTPRedirectPort),
+			Handler:        redirectHandler(s.config.HTTPPort),
+			MaxHeaderBytes: s.config.MaxHeaderBytes,
+		}
+		rawRedirectListener, err = listenRedirect(redirectSrv.Addr)
+		if err != nil {
+			return err
+		}
+		go func() {
+			if err := redirectSrv.Serve(acceptProxyProtocol(rawRedirectListener)); err != nil && err != http.ErrServerClosed {
+				log.Fatalf("listen: %s\n", err)
+			}
+		}()
 	}
 
 	go func() {
-		if err := srv.ListenAndServe(); err != nil && err != http.ErrServerClosed {
+		var err error
+		if certs != nil {
+			// Certificates come from srv.TLSConfig, which also gets
+			// HTTP/2 added to its ALPN protocols
+			err = srv.ServeTLS(ln, "", "")
+		} else {
+			err = srv.Serve(ln)
+		}
+		if err != nil && err != http.ErrServerClosed {
 			log.Fatalf("listen: %s\n", err)
 		}
 	}()
 
+	notifyReady()
+
 	quit := make(chan os.Signal, 1)
 	signal.Notify(quit, syscall.SIGINT, syscall.SIGTERM)
-	<-quit
+	restart := make(chan os.Signal, 1)
+	notifyRestart(restart)
+
+wait:
+	for {
+		select {
+		case <-quit:
+			break wait
+		case <-restart:
+			log.Println("Restarting server...")
+			// The new process owns the registry from the moment it starts,
+			// so nothing this one does while draining may overwrite it
+			ts.registry.Suspend()
+			if err := handoff(rawListener, rawRedirectListener, ts.connectedSubdomains()); err != nil {
+				log.Printf("Restart failed, continuing to serve: %v", err)
+				ts.registry.Resume()
+				continue
+			}
+			break wait
+		}
+	}
 	log.Println("Shutting down server...")
 
-	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+	ctx, cancel := context.WithTimeout(context.Background(), s.config.DrainTimeout)
 	defer cancel()
-	if err := srv.Shutdown(ctx); err != nil {
-		log.Fatal("Server forced to shutdown:", err)
+
+	// Stop accepting straight away so reconnecting clients land on the
+	// next process. Hijacked tunnel connections aren't tracked by srv, so
+	// clients are told to move and only cut off once in-flight requests
+	// are done
+	shutdown := make(chan error, 1)
+	go func() {
+		if redirectSrv != nil {
+			go redirectSrv.Shutdown(ctx)
+		}
+		shutdown <- srv.Shutdown(ctx)
+	}()
+	ts.drain(ctx)
+	if err := <-shutdown; err != nil {
+		log.Println("Server forced to shutdown:", err)
 	}
+	ts.closeTunnels()
 
 	log.Println("Server exiting")
 	return nil
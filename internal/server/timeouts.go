@@ -0,0 +1,40 @@
+package server
+
+import (
+	"net/url"
+	"time"
+)
+
+const (
+	// protocolVersion is the tunnel protocol clients must speak, sent as the
+	// v parameter of the handshake.
+	protocolVersion = "2"
+
+	keepAliveInterval = 30 * time.Second
+	keepAliveTimeout  = 10 * time.Second
+)
+
+// timeouts bound one exchange over a tunnel. Zero means no limit.
+type timeouts struct {
+	header time.Duration // until the response headers arrive
+	idle   time.Duration // between reads of the response body
+	total  time.Duration // for the whole exchange
+}
+
+// tunnelTimeouts applies the timeouts a client asked for in its handshake.
+// Clients can shorten the server's timeouts but not extend them.
+func (ts *TunnelServer) tunnelTimeouts(query url.Values) timeouts {
+	return timeouts{
+		header: shorterTimeout(ts.timeouts.header, query.Get("header_timeout")),
+		idle:   shorterTimeout(ts.timeouts.idle, query.Get("idle_timeout")),
+		total:  shorterTimeout(ts.timeouts.total, query.Get("timeout")),
+	}
+}
+
+func shorterTimeout(limit time.Duration, requested string) time.Duration {
+	d, err := time.ParseDuration(requested)
+	if err != nil || d <= 0 || (limit > 0 && d > limit) {
+		return limit
+	}
+	return d
+}
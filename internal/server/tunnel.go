@@ -1,8 +1,8 @@
 package server
 
 import (
-	"bufio"
-	"encoding/binary"
+	"context"
+	"errors"
 	"fmt"
 	"io"
 	"log"
@@ -10,104 +10,385 @@ import (
 	"net/http"
 	"strings"
 	"sync"
+	"sync/atomic"
 	"time"
-	"github.com/gorilla/websocket"
+	"github.com/ghousemohamed/simple-tunnel/internal/mux"
+	"github.com/ghousemohamed/simple-tunnel/internal/registry"
 )
 
 type TunnelConnection struct {
 	conn   net.Conn
-	reader *bufio.Reader
-	writer *bufio.Writer
+	// session is set once the handshake response has been written, which
+	// ready announces
+	session *mux.Session
+	ready   chan struct{}
+	closed chan struct{}
+	closeOnce sync.Once
+	inflight atomic.Int32
+	primary  bool
+	timeouts timeouts
+	limits   limits
+	// account is the hashed token the client connected with
+	account  string
 }
 
 type TunnelServer struct {
-	tunnel     map[string]*TunnelConnection
+	tunnel     map[string]*tunnelGroup
 	tunnelsLock sync.RWMutex
+	loadBalancing string
+	trustedProxies []*net.IPNet
+	baseDomains []string
+	pathRouting bool
+	domains     map[string]*customDomain
+	domainsLock sync.RWMutex
+	domainSecret []byte
+	deliveries     map[string][]delivery
+	deliveriesLock sync.Mutex
+	reconnectGrace   time.Duration
+	queueMaxRequests int
+	queueMaxBytes    int64
+	lastSeen         map[string]time.Time
+	queues           map[string]*reconnectQueue
+	inbox            *inbox
+	draining         atomic.Bool
+	cluster          *clusterNode
+	registry         registry.Registry
+	maxReservations  int
+	reservable       bool
+	errorPagesDir    string
+	timeouts         timeouts
+	limits           limits
 }
 
-var upgrader = websocket.Upgrader{
-	CheckOrigin: func(r *http.Request) bool {
-		return true // Allow all origins for this example
-	},
-}
+// publicURLHeader tells the client where visitors can reach its tunnel.
+const publicURLHeader = "X-Simple-Tunnel-URL"
 
-const (
-	WebSocketContinuationFrame = 0
-	WebSocketTextFrame         = 1
-	WebSocketBinaryFrame       = 2
-	WebSocketCloseFrame        = 8
-	WebSocketPingFrame         = 9
-	WebSocketPongFrame         = 10
-)
+func NewTunnelServer(config Config) (*TunnelServer, error) {
+	switch config.LoadBalancing {
+	case "":
+		config.LoadBalancing = RoundRobin
+	case RoundRobin, LeastOutstanding:
+	default:
+		return nil, fmt.Errorf("unknown load balancing strategy %q", config.LoadBalancing)
+	}
+
+	trustedProxies, err := parseCIDRs(config.TrustedProxies)
+	if err != nil {
+		return nil, fmt.Errorf("trusted proxies: %v", err)
+	}
+
+	var tunnelInbox *inbox
+	if config.InboxDir != "" {
+		tunnelInbox, err = newInbox(config.InboxDir, config.InboxStatus, config.InboxMaxRequests, config.InboxMaxBytes)
+		if err != nil {
+			return nil, fmt.Errorf("inbox: %v", err)
+		}
+	}
+
+	var node *clusterNode
+	if config.ClusterStore != "" {
+		node, err = newClusterNode(config)
+		if err != nil {
+			return nil, fmt.Errorf("cluster: %v", err)
+		}
+	}
+
+	store, err := registryStore(config, node)
+	if err != nil {
+		return nil, fmt.Errorf("registry: %v", err)
+	}
+	reg, err := newRegistry(store, node != nil)
+	if err != nil {
+		return nil, fmt.Errorf("registry: %v", err)
+	}
+	domainSecret, err := loadDomainSecret(config, store)
+	if err != nil {
+		return nil, fmt.Errorf("domain secret: %v", err)
+	}
+
+	ts := &TunnelServer{
+		tunnel: make(map[string]*tunnelGroup),
+		loadBalancing: config.LoadBalancing,
+		trustedProxies: trustedProxies,
+		baseDomains: normalizeBaseDomains(config.BaseDomains),
+		pathRouting: config.PathRouting,
+		domains: make(map[string]*customDomain),
+		domainSecret: domainSecret,
+		deliveries: make(map[string][]delivery),
+		reconnectGrace: config.ReconnectGrace,
+		queueMaxRequests: config.QueueMaxRequests,
+		queueMaxBytes: config.QueueMaxBytes,
+		lastSeen: make(map[string]time.Time),
+		queues: make(map[string]*reconnectQueue),
+		inbox: tunnelInbox,
+		cluster: node,
+		registry: reg,
+		maxReservations: config.MaxReservations,
+		reservable: persistentRegistry(config),
+		errorPagesDir: config.ErrorPagesDir,
+		timeouts: timeouts{
+			header: config.HeaderTimeout,
+			idle:   config.IdleTimeout,
+			total:  config.RequestTimeout,
+		},
+		limits: limits{
+			header:       config.MaxHeaderBytes,
+			requestBody:  config.MaxRequestBody,
+			responseBody: config.MaxResponseBody,
+			message:      config.MaxMessageSize,
+		},
+	}
+
+	if err := ts.loadDomains(); err != nil {
+		return nil, fmt.Errorf("registry: %v", err)
+	}
+
+	// Clients of the process we took over from are on their way here
+	for _, subdomain := range handoffSubdomains() {
+		ts.markDisconnected(subdomain)
+	}
 
-func NewTunnelServer() *TunnelServer {
-	return &TunnelServer{
-		tunnel: make(map[string]*TunnelConnection),
+	if ts.cluster != nil {
+		go ts.heartbeat()
 	}
+
+	return ts, nil
 }
 
 func (ts *TunnelServer) handleTunnelRequest(w http.ResponseWriter, r *http.Request) {
-	subdomain := strings.Split(r.Host, ".")[0]
+	// Requests forwarded by another node were routed and annotated there
+	subdomain, pathPrefix, fromPeer := ts.peerRoute(r)
+	if !fromPeer {
+		var ok bool
+		subdomain, pathPrefix, ok = ts.route(w, r)
+		if !ok {
+			return
+		}
+		ts.setForwardedHeaders(r)
+		r.Header.Set(remoteAddrHeader, visitorAddr(r))
+	}
 
-	ts.tunnelsLock.Lock()
-	tunnel, ok := ts.tunnel[subdomain]
-	ts.tunnelsLock.Unlock()
+	var body *requestBody
+	if ts.limits.requestBody > 0 {
+		if r.ContentLength > ts.limits.requestBody {
+			http.Error(w, "Request body too large", http.StatusRequestEntityTooLarge)
+			return
+		}
+		body = ts.limitRequestBody(w, r)
+	}
 
-	if !ok {
-		http.Error(w, "Tunnel not found", http.StatusNotFound)
-		return
+	tunnel := ts.pickTunnel(subdomain, nil)
+	if tunnel == nil && !fromPeer && ts.cluster != nil {
+		if owner := ts.clusterOwner(subdomain); owner != nil {
+			ts.forwardToNode(w, r, owner, subdomain, pathPrefix)
+			return
+		}
+	}
+	if tunnel == nil {
+		var status int
+		tunnel, status = ts.waitForTunnel(r, subdomain)
+		if body.tooLarge() {
+			http.Error(w, "Request body too large", http.StatusRequestEntityTooLarge)
+			return
+		}
+		if tunnel == nil && ts.inbox != nil && ts.inbox.enabled(subdomain) {
+			ts.inbox.store(w, r, subdomain)
+			return
+		}
+		if tunnel == nil {
+			if status == http.StatusServiceUnavailable {
+				w.Header().Set("Retry-After", "5")
+			}
+			ts.renderError(w, r, status, errorOffline, subdomain)
+			return
+		}
 	}
 
-	if websocket.IsWebSocketUpgrade(r) {
-		ts.handleWebSocketUpgrade(w, r, tunnel)
+	if isUpgrade(r) {
+		ts.handleUpgrade(w, r, tunnel, subdomain, pathPrefix)
 		return
 	}
 
 	// Handle regular HTTP request
 	log.Printf("Handling HTTP request: %s %s", r.Method, r.URL.Path)
 
-	// Forward the request to the tunnel
-	if err := r.Write(tunnel.writer); err != nil {
-		log.Printf("Error writing request to tunnel: %v", err)
-		http.Error(w, "Error forwarding request", http.StatusInternalServerError)
-		return
-	}
-	if err := tunnel.writer.Flush(); err != nil {
-		log.Printf("Error flushing request to tunnel: %v", err)
-		http.Error(w, "Error forwarding request", http.StatusInternalServerError)
+	if members := ts.broadcastMembers(subdomain); len(members) > 0 {
+		ts.broadcastRequest(w, r, subdomain, members, pathPrefix)
 		return
 	}
 
-	// Read the response from the tunnel
-	resp, err := http.ReadResponse(tunnel.reader, r)
+	// Forward the request to the tunnel, failing over to other members of
+	// the group while the request can still be replayed
+	tried := make(map[*TunnelConnection]bool)
+	var resp *http.Response
+	var err error
+	unblock := func() { http.NewResponseController(w).SetReadDeadline(time.Now()) }
+	for tunnel != nil {
+		tried[tunnel] = true
+		resp, err = tunnel.roundTrip(r, unblock)
+		if err == nil {
+			break
+		}
+		if body.tooLarge() {
+			http.Error(w, "Request body too large", http.StatusRequestEntityTooLarge)
+			return
+		}
+		if errors.Is(err, errTimeout) {
+			log.Printf("Timed out waiting for subdomain %s: %s %s", subdomain, r.Method, r.URL.Path)
+			ts.renderError(w, r, http.StatusGatewayTimeout, errorOriginTimeout, subdomain)
+			return
+		}
+		if r.Context().Err() != nil {
+			log.Printf("Visitor went away: %s %s", r.Method, r.URL.Path)
+			return
+		}
+		log.Printf("Error forwarding request to tunnel: %v", err)
+		// Only a broken connection is worth failing over from
+		if !tunnel.isClosed() {
+			break
+		}
+		ts.removeTunnel(subdomain, tunnel)
+		if !replayable(r) {
+			break
+		}
+		tunnel = ts.pickTunnel(subdomain, tried)
+		if tunnel == nil {
+			tunnel, _ = ts.waitForTunnel(r, subdomain)
+		}
+	}
 	if err != nil {
-		log.Printf("Error reading response from tunnel: %v", err)
-		http.Error(w, "Error reading response from client", http.StatusInternalServerError)
+		if tunnel == nil && replayable(r) && ts.inbox != nil && ts.inbox.enabled(subdomain) {
+			ts.inbox.store(w, r, subdomain)
+			return
+		}
+		ts.renderError(w, r, http.StatusBadGateway, errorBadGateway, subdomain)
 		return
 	}
 	defer resp.Body.Close()
 
+	ts.writeResponse(w, r, resp, subdomain, pathPrefix)
+}
+
+// route resolves the subdomain r is for. It answers requests that aren't for
+// a tunnel itself and reports false for them.
+func (ts *TunnelServer) route(w http.ResponseWriter, r *http.Request) (subdomain, pathPrefix string, ok bool) {
+	subdomain, apex, ok := ts.resolveHost(r.Host)
+
+	// Path based routing only applies to hosts that aren't a tunnel already
+	if ts.pathRouting && (apex || !ok) {
+		originalPath := r.URL.Path
+		if name, prefix, found := routeByPath(r); found {
+			if originalPath == prefix {
+				target := prefix + "/"
+				if r.URL.RawQuery != "" {
+					target += "?" + r.URL.RawQuery
+				}
+				http.Redirect(w, r, target, http.StatusMovedPermanently)
+				return "", "", false
+			}
+			subdomain, pathPrefix, apex, ok = name, prefix, false, true
+		}
+	}
+
+	if apex {
+		ts.handleRoot(w, r)
+		return "", "", false
+	}
+	if !ok {
+		ts.renderError(w, r, http.StatusNotFound, errorOffline, "")
+		return "", "", false
+	}
+
+	return subdomain, pathPrefix, true
+}
+
+// writeResponse copies a response read from the tunnel back to the visitor.
+func (ts *TunnelServer) writeResponse(w http.ResponseWriter, r *http.Request, resp *http.Response, subdomain, pathPrefix string) {
+	if ts.originError(w, r, resp, subdomain) {
+		return
+	}
+	if ts.limits.responseBody > 0 && resp.ContentLength > ts.limits.responseBody {
+		log.Printf("Response for subdomain %s is too large: %d bytes", subdomain, resp.ContentLength)
+		ts.renderError(w, r, http.StatusBadGateway, errorBadGateway, subdomain)
+		return
+	}
+	if pathPrefix != "" {
+		rewritePathResponse(resp.Header, pathPrefix, r.Host)
+	}
+
 	// Copy headers
 	for k, v := range resp.Header {
 		w.Header()[k] = v
 	}
 	w.WriteHeader(resp.StatusCode)
 
-	// Copy body
-	_, err = io.Copy(w, resp.Body)
+	// Copy body. Streamed responses such as event streams and gRPC calls
+	// are passed on as they arrive
+	var err error
+	if resp.ContentLength < 0 {
+		err = copyFlushing(w, resp.Body)
+	} else {
+		_, err = io.Copy(w, resp.Body)
+	}
 	if err != nil {
 		log.Printf("Error copying response body: %v", err)
+		// Don't let the visitor mistake a cut-off body for the whole one
+		panic(http.ErrAbortHandler)
+	}
+	for k, v := range resp.Trailer {
+		w.Header()[http.TrailerPrefix+k] = v
 	}
 
 	log.Printf("HTTP request handled: %s %s", r.Method, r.URL.Path)
 }
 
+// copyFlushing copies body to w, flushing after every read.
+func copyFlushing(w http.ResponseWriter, body io.Reader) error {
+	rc := http.NewResponseController(w)
+	rc.Flush()
+	buf := make([]byte, 32<<10)
+	for {
+		n, err := body.Read(buf)
+		if n > 0 {
+			if _, err := w.Write(buf[:n]); err != nil {
+				return err
+			}
+			rc.Flush()
+		}
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+	}
+}
+
 func (ts *TunnelServer) handleTunnelOpen(w http.ResponseWriter, r *http.Request) {
-	subdomain := r.URL.Query().Get("subdomain")
+	subdomain := strings.ToLower(r.URL.Query().Get("subdomain"))
 	if subdomain == "" {
 		http.Error(w, "Subdomain not specified", http.StatusBadRequest)
 		return
 	}
+	if !validSubdomain(subdomain) {
+		http.Error(w, "Invalid subdomain", http.StatusBadRequest)
+		return
+	}
+
+	if ts.draining.Load() {
+		http.Error(w, "Server is shutting down", http.StatusServiceUnavailable)
+		return
+	}
+
+	if r.URL.Query().Get("v") != protocolVersion {
+		http.Error(w, "This server needs a newer simple-tunnel client", http.StatusUpgradeRequired)
+		return
+	}
+
+	if !ts.allowed(subdomain, r) {
+		http.Error(w, "Subdomain is reserved by another account", http.StatusForbidden)
+		return
+	}
 
 	conn, bufrw, err := w.(http.Hijacker).Hijack()
 	if err != nil {
@@ -117,269 +398,142 @@ func (ts *TunnelServer) handleTunnelOpen(w http.ResponseWriter, r *http.Request)
 	}
 
 	tunnelConn := &TunnelConnection{
-		conn:   conn,
-		reader: bufrw.Reader,
-		writer: bufrw.Writer,
+		conn:    conn,
+		ready:   make(chan struct{}),
+		closed:  make(chan struct{}),
+		account: account(r),
+	}
+
+	query := r.URL.Query()
+	tunnelConn.timeouts = ts.tunnelTimeouts(query)
+	tunnelConn.limits = ts.limits
+	broadcast := query.Get("mode") == "broadcast"
+	shared := query.Get("group") != "" || broadcast
+	tunnelConn.primary = query.Get("primary") != ""
+	if ts.inbox != nil {
+		if err := ts.inbox.setEnabled(subdomain, query.Get("inbox") != "", tunnelConn.account); err != nil {
+			log.Printf("Error updating inbox for subdomain %s: %v", subdomain, err)
+		}
 	}
 
 	ts.tunnelsLock.Lock()
-	ts.tunnel[subdomain] = tunnelConn
+	group, ok := ts.tunnel[subdomain]
+	if ok && shared && group.shared && group.broadcast != broadcast {
+		ts.tunnelsLock.Unlock()
+		log.Printf("Rejected tunnel for subdomain %s: group mode mismatch", subdomain)
+		conn.Write([]byte("HTTP/1.1 409 Conflict\r\nContent-Length: 0\r\nConnection: close\r\n\r\n"))
+		conn.Close()
+		return
+	}
+	if ok && shared && group.shared {
+		group.members = append(group.members, tunnelConn)
+	} else {
+		if ok {
+			for _, previous := range group.members {
+				previous.close()
+			}
+		}
+		ts.tunnel[subdomain] = &tunnelGroup{
+			members:   []*TunnelConnection{tunnelConn},
+			shared:    shared,
+			broadcast: broadcast,
+		}
+	}
+	members := len(ts.tunnel[subdomain].members)
+	ts.markConnected(subdomain)
 	ts.tunnelsLock.Unlock()
 
-	log.Printf("Tunnel opened for subdomain: %s", subdomain)
+	log.Printf("Tunnel opened for subdomain: %s (%d connected)", subdomain, members)
 	response := "HTTP/1.1 101 Switching Protocols\r\n" +
 		"Upgrade: websocket\r\n" +
-		"Connection: Upgrade\r\n" +
-		"\r\n"
+		"Connection: Upgrade\r\n"
+	if publicURL := ts.publicURL(subdomain); publicURL != "" {
+		response += publicURLHeader + ": " + publicURL + "\r\n"
+	}
+	for _, status := range ts.registerDomains(subdomain, r.URL.Query()["hostname"], tunnelConn) {
+		response += domainStatusHeader + ": " + status + "\r\n"
+	}
+	response += "\r\n"
 
 	_, err = conn.Write([]byte(response))
 	if err != nil {
 		log.Printf("Error writing response: %v", err)
-		ts.removeTunnel(subdomain, conn)
+		ts.removeTunnel(subdomain, tunnelConn)
 		return
 	}
+	// Requests routed to the new connection were waiting for this
+	tunnelConn.session = mux.Server(conn, bufrw.Reader)
+	close(tunnelConn.ready)
+
+	mode := ""
+	if broadcast {
+		mode = "broadcast"
+	} else if shared {
+		mode = "group"
+	}
+	ts.register(subdomain, r.URL.Query()["hostname"], mode)
+
+	if ts.inbox != nil {
+		go ts.deliverInbox(subdomain)
+	}
 
 	// Start a goroutine to keep the connection alive and monitor for closure
 	go ts.monitorConnection(subdomain, tunnelConn)
 }
 
 func (ts *TunnelServer) monitorConnection(subdomain string, tunnelConn *TunnelConnection) {
-	defer ts.removeTunnel(subdomain, tunnelConn.conn)
+	defer ts.removeTunnel(subdomain, tunnelConn)
 
 	// Keep-alive loop
-	ticker := time.NewTicker(30 * time.Second)
+	ticker := time.NewTicker(keepAliveInterval)
 	defer ticker.Stop()
 
 	for {
 		select {
 		case <-ticker.C:
-			// For now let's not do anything here
-		default:
-			// Check if the connection is closed
-			one := []byte{}
-			tunnelConn.conn.SetReadDeadline(time.Now().Add(1 * time.Second))
-			_, err := tunnelConn.conn.Read(one)
-			tunnelConn.conn.SetReadDeadline(time.Time{}) // Reset the read deadline
-			if err == io.EOF {
-				log.Printf("Client closed the connection for subdomain: %s", subdomain)
-				return
-			} else if err != nil && !err.(net.Error).Timeout() {
-				log.Printf("Error reading from connection: %v", err)
+			ctx, cancel := context.WithTimeout(context.Background(), keepAliveTimeout)
+			_, err := tunnelConn.session.Ping(ctx)
+			cancel()
+			if err != nil {
+				log.Printf("Client for subdomain %s stopped responding: %v", subdomain, err)
 				return
 			}
+		case <-tunnelConn.session.Closed():
+			log.Printf("Client closed the connection for subdomain: %s", subdomain)
+			return
+		case <-tunnelConn.closed:
+			return
 		}
-		time.Sleep(1 * time.Second) // Small delay to prevent tight loop
 	}
 }
 
-func (ts *TunnelServer) removeTunnel(subdomain string, conn net.Conn) {
+func (ts *TunnelServer) removeTunnel(subdomain string, tunnelConn *TunnelConnection) {
 	ts.tunnelsLock.Lock()
-	defer ts.tunnelsLock.Unlock()
-	delete(ts.tunnel, subdomain)
-
-	conn.Close()
-}
-
-func (ts *TunnelServer) handleWebSocketUpgrade(w http.ResponseWriter, r *http.Request, tunnel *TunnelConnection) {
-	serverConn, err := upgrader.Upgrade(w, r, nil)
-	if err != nil {
-		log.Printf("Failed to upgrade server connection: %v", err)
-		return
-	}
-	defer serverConn.Close()
-
-	upgradeReq := &http.Request{
-		Method: http.MethodGet,
-		URL:    r.URL,
-		Header: make(http.Header),
-	}
-	for k, v := range r.Header {
-		upgradeReq.Header[k] = v
-	}
-	upgradeReq.Header.Set("Connection", "Upgrade")
-	upgradeReq.Header.Set("Upgrade", "websocket")
-
-	if err := upgradeReq.Write(tunnel.writer); err != nil {
-		log.Printf("Failed to send upgrade request to client: %v", err)
-		return
-	}
-	if err := tunnel.writer.Flush(); err != nil {
-		log.Printf("Failed to flush upgrade request to client: %v", err)
-		return
-	}
-
-	upgradeResp, err := http.ReadResponse(tunnel.reader, upgradeReq)
-	if err != nil {
-		log.Printf("Failed to read upgrade response from client: %v", err)
-		return
-	}
-	if upgradeResp.StatusCode != http.StatusSwitchingProtocols {
-		log.Printf("Client failed to upgrade connection: %v", upgradeResp.Status)
-		return
-	}
-
-	var wg sync.WaitGroup
-	wg.Add(2)
-
-	go func() {
-		defer wg.Done()
-		for {
-			messageType, p, err := serverConn.ReadMessage()
-			if err != nil {
-				log.Printf("Error reading from server WebSocket: %v", err)
-				return
-			}
-			log.Printf("Server received message: %s", string(p))
-			var wsMessageType int
-			switch messageType {
-			case websocket.TextMessage:
-				wsMessageType = WebSocketTextFrame
-			case websocket.BinaryMessage:
-				wsMessageType = WebSocketBinaryFrame
-			case websocket.CloseMessage:
-				wsMessageType = WebSocketCloseFrame
-			case websocket.PingMessage:
-				wsMessageType = WebSocketPingFrame
-			case websocket.PongMessage:
-				wsMessageType = WebSocketPongFrame
-			default:
-				log.Printf("Unknown message type: %d", messageType)
-				continue
-			}
-			if err := writeWebSocketMessage(tunnel.conn, wsMessageType, p); err != nil {
-				log.Printf("Error writing to tunnel: %v", err)
-				return
-			}
-		}
-	}()
-
-	go func() {
-		defer wg.Done()
-		for {
-			messageType, p, err := readWebSocketMessage(tunnel.conn)
-			if err != nil {
-				log.Printf("Error reading from tunnel: %v", err)
-				return
-			}
-			if messageType == 0 && p == nil {
-				continue
-			}
-			log.Printf("Server received message from tunnel: %s", string(p))
-			var wsMessageType int
-			switch messageType {
-			case WebSocketTextFrame:
-				wsMessageType = websocket.TextMessage
-			case WebSocketBinaryFrame:
-				wsMessageType = websocket.BinaryMessage
-			case WebSocketCloseFrame:
-				wsMessageType = websocket.CloseMessage
-			case WebSocketPingFrame:
-				wsMessageType = websocket.PingMessage
-			case WebSocketPongFrame:
-				wsMessageType = websocket.PongMessage
-			default:
-				log.Printf("Unknown message type: %d", messageType)
-				continue
-			}
-			if err := serverConn.WriteMessage(wsMessageType, p); err != nil {
-				log.Printf("Error writing to server WebSocket: %v", err)
-				return
-			}
+	var gone bool
+	if group, ok := ts.tunnel[subdomain]; ok {
+		group.remove(tunnelConn)
+		if len(group.members) == 0 {
+			delete(ts.tunnel, subdomain)
+			ts.markDisconnected(subdomain)
+			gone = true
 		}
-	}()
-
-	wg.Wait()
-}
-
-func writeWebSocketMessage(conn net.Conn, messageType int, payload []byte) error {
-	// https://tools.ietf.org/html/rfc6455#section-5.2
-	var header []byte
-	if len(payload) < 126 {
-		header = make([]byte, 2)
-		header[1] = byte(len(payload))
-	} else if len(payload) < 65536 {
-		header = make([]byte, 4)
-		header[1] = 126
-		binary.BigEndian.PutUint16(header[2:], uint16(len(payload)))
-	} else {
-		header = make([]byte, 10)
-		header[1] = 127
-		binary.BigEndian.PutUint64(header[2:], uint64(len(payload)))
 	}
+	ts.tunnelsLock.Unlock()
 
-	header[0] = byte(messageType) | 0x80
-
-	if _, err := conn.Write(header); err != nil {
-		return err
+	tunnelConn.close()
+	if gone {
+		ts.unregister(subdomain)
 	}
-	if _, err := conn.Write(payload); err != nil {
-		return err
-	}
-	return nil
 }
 
-func readWebSocketMessage(conn net.Conn) (int, []byte, error) {
-	if err := conn.SetReadDeadline(time.Now().Add(30 * time.Second)); err != nil {
-		log.Printf("Error setting read deadline: %v", err)
-		return 0, nil, err
-	}
-	defer conn.SetReadDeadline(time.Time{})
-
-	header := make([]byte, 2)
-	_, err := io.ReadFull(conn, header)
-	if err != nil {
-		if netErr, ok := err.(net.Error); ok && netErr.Timeout() {
-			return 0, nil, nil
-		}
-		log.Printf("Error reading WebSocket header from tunnel: %v", err)
-		return 0, nil, err
-	}
-
-	fin := header[0]&0x80 != 0
-	opcode := int(header[0] & 0x0F)
-
-	payloadLen := int(header[1] & 0x7F)
-	if payloadLen == 126 {
-		extendedLen := make([]byte, 2)
-		if _, err := io.ReadFull(conn, extendedLen); err != nil {
-			log.Printf("Error reading extended payload length (16-bit): %v", err)
-			return 0, nil, err
-		}
-		payloadLen = int(binary.BigEndian.Uint16(extendedLen))
-	} else if payloadLen == 127 {
-		extendedLen := make([]byte, 8)
-		if _, err := io.ReadFull(conn, extendedLen); err != nil {
-			log.Printf("Error reading extended payload length (64-bit): %v", err)
-			return 0, nil, err
-		}
-		payloadLen = int(binary.BigEndian.Uint64(extendedLen))
-	}
-
-	log.Printf("Reading WebSocket message. Opcode: %d, Payload length: %d", opcode, payloadLen)
-
-	payload := make([]byte, payloadLen)
-	if _, err := io.ReadFull(conn, payload); err != nil {
-		log.Printf("Error reading WebSocket payload from tunnel: %v", err)
-		return 0, nil, err
-	}
-
-	log.Printf("Successfully read WebSocket message from tunnel. Opcode: %d, Payload: %s", opcode, string(payload))
-
-	if !fin {
-		for {
-			nextOpcode, nextPayload, err := readWebSocketMessage(conn)
-			if err != nil {
-				return 0, nil, err
-			}
-			if nextOpcode != WebSocketContinuationFrame {
-				return 0, nil, fmt.Errorf("expected continuation frame")
-			}
-			payload = append(payload, nextPayload...)
-			if nextOpcode&0x80 != 0 {
-				break
-			}
+func (tc *TunnelConnection) close() {
+	tc.closeOnce.Do(func() {
+		close(tc.closed)
+		tc.conn.Close()
+		select {
+		case <-tc.ready:
+			tc.session.Close()
+		default:
 		}
-	}
-
-	return opcode, payload, nil
+	})
 }
@@ -0,0 +1,104 @@
+package server
+
+import (
+	"bufio"
+	"bytes"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/ghousemohamed/simple-tunnel/internal/relay"
+)
+
+// isUpgrade reports whether r asks to switch protocols, as WebSocket and
+// h2c requests do.
+func isUpgrade(r *http.Request) bool {
+	return r.ProtoMajor == 1 && r.Header.Get("Upgrade") != "" && headerHasToken(r.Header, "Connection", "upgrade")
+}
+
+func headerHasToken(h http.Header, name, token string) bool {
+	for _, v := range h.Values(name) {
+		for _, t := range strings.Split(v, ",") {
+			if strings.EqualFold(strings.TrimSpace(t), token) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// handleUpgrade passes an upgrade request to the local server. If it agrees
+// to switch protocols, bytes are relayed both ways untouched from then on,
+// so the two ends negotiate subprotocols and extensions themselves.
+func (ts *TunnelServer) handleUpgrade(w http.ResponseWriter, r *http.Request, tunnel *TunnelConnection, subdomain, pathPrefix string) {
+	stream, err := tunnel.open()
+	if err != nil {
+		log.Printf("Failed to open stream to client: %v", err)
+		ts.renderError(w, r, http.StatusBadGateway, errorBadGateway, subdomain)
+		return
+	}
+	defer stream.Close()
+	tunnel.inflight.Add(1)
+	defer tunnel.inflight.Add(-1)
+
+	if err := r.Write(stream); err != nil {
+		log.Printf("Failed to send upgrade request to client: %v", err)
+		ts.renderError(w, r, http.StatusBadGateway, errorBadGateway, subdomain)
+		return
+	}
+
+	if tunnel.timeouts.header > 0 {
+		stream.SetReadDeadline(time.Now().Add(tunnel.timeouts.header))
+	}
+	header := newHeaderLimiter(stream, tunnel.limits.header)
+	reader := bufio.NewReader(header)
+	resp, err := http.ReadResponse(reader, r)
+	if err != nil {
+		log.Printf("Failed to read upgrade response from client: %v", err)
+		if errors.Is(err, os.ErrDeadlineExceeded) {
+			ts.renderError(w, r, http.StatusGatewayTimeout, errorOriginTimeout, subdomain)
+		} else {
+			ts.renderError(w, r, http.StatusBadGateway, errorBadGateway, subdomain)
+		}
+		return
+	}
+	stream.SetReadDeadline(time.Time{})
+	header.disarmed = true
+
+	if resp.StatusCode != http.StatusSwitchingProtocols {
+		defer resp.Body.Close()
+		ts.writeResponse(w, r, resp, subdomain, pathPrefix)
+		return
+	}
+
+	conn, bufrw, err := http.NewResponseController(w).Hijack()
+	if err != nil {
+		log.Printf("Failed to take over visitor connection: %v", err)
+		return
+	}
+	defer conn.Close()
+
+	var head bytes.Buffer
+	fmt.Fprintf(&head, "HTTP/1.1 %s\r\n", resp.Status)
+	resp.Header.Write(&head)
+	head.WriteString("\r\n")
+	if _, err := conn.Write(head.Bytes()); err != nil {
+		log.Printf("Failed to send upgrade response to visitor: %v", err)
+		return
+	}
+
+	protocol := resp.Header.Get("Upgrade")
+	log.Printf("Relaying %s connection for subdomain %s: %s", protocol, subdomain, r.URL.Path)
+	// We stand in for the server towards the visitor and for the client
+	// towards the tunnel, so only frames to the latter are masked
+	result := relay.Relay(
+		relay.Side{Name: "visitor", Conn: conn, Reader: bufrw.Reader},
+		relay.Side{Name: "tunnel", Conn: stream, Reader: reader, Mask: true},
+		relay.Options{WebSocket: strings.EqualFold(protocol, "websocket"), Limit: tunnel.limits.message},
+	)
+	log.Printf("%s connection for subdomain %s %s", protocol, subdomain, result)
+}
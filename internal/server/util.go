@@ -1,7 +1,11 @@
 package server
 
 import (
+	"fmt"
 	"math/rand"
+	"net"
+	"net/http"
+	"strings"
 	"time"
 )
 
@@ -13,4 +17,49 @@ func GenerateRandomSubdomain(length int) string {
 		subdomain[i] = charset[rand.Intn(len(charset))]
 	}
 	return string(subdomain)
-}
\ No newline at end of file
+}
+
+// parseCIDRs accepts CIDR ranges or bare IP addresses.
+func parseCIDRs(values []string) ([]*net.IPNet, error) {
+	var nets []*net.IPNet
+	for _, v := range values {
+		v = strings.TrimSpace(v)
+		if v == "" {
+			continue
+		}
+		if !strings.Contains(v, "/") {
+			ip := net.ParseIP(v)
+			if ip == nil {
+				return nil, fmt.Errorf("invalid address %q", v)
+			}
+			bits := 128
+			if ip.To4() != nil {
+				ip = ip.To4()
+				bits = 32
+			}
+			nets = append(nets, &net.IPNet{IP: ip, Mask: net.CIDRMask(bits, bits)})
+			continue
+		}
+		_, n, err := net.ParseCIDR(v)
+		if err != nil {
+			return nil, fmt.Errorf("invalid CIDR %q: %v", v, err)
+		}
+		nets = append(nets, n)
+	}
+	return nets, nil
+}
+
+// replayable reports whether r can be sent again after a failed attempt:
+// it must be safe to repeat and have no body that was already consumed.
+// PUT and DELETE are idempotent on paper, but origins can't tell a replay
+// from a second request unless the sender marks it with an Idempotency-Key.
+func replayable(r *http.Request) bool {
+	switch r.Method {
+	case http.MethodGet, http.MethodHead, http.MethodOptions:
+	default:
+		if r.Header.Get("Idempotency-Key") == "" {
+			return false
+		}
+	}
+	return r.Body == nil || r.Body == http.NoBody || r.ContentLength == 0
+}
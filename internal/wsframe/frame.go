@@ -0,0 +1,124 @@
+// Package wsframe reads and writes WebSocket frames as specified by RFC 6455.
+//
+// A Reader reassembles fragmented messages and hands back control frames
+// that arrive between the fragments as soon as they are read. A Tracker
+// follows the frames of a relayed byte stream, using a Reader to check the
+// control frames in it. Both reject anything the RFC forbids with an *Error
+// carrying the close code to send to the peer. A Writer can be shared by
+// goroutines, so control frames can be written while a fragmented message
+// is in progress.
+package wsframe
+
+import (
+	"fmt"
+	"unicode/utf8"
+)
+
+// Opcode is the type of a frame.
+type Opcode byte
+
+const (
+	OpContinuation Opcode = 0x0
+	OpText         Opcode = 0x1
+	OpBinary       Opcode = 0x2
+	OpClose        Opcode = 0x8
+	OpPing         Opcode = 0x9
+	OpPong         Opcode = 0xA
+)
+
+// IsControl reports whether op is a close, ping or pong frame.
+func (op Opcode) IsControl() bool {
+	return op&0x8 != 0
+}
+
+func (op Opcode) valid() bool {
+	switch op {
+	case OpContinuation, OpText, OpBinary, OpClose, OpPing, OpPong:
+		return true
+	}
+	return false
+}
+
+// Close codes from RFC 6455 section 7.4.1.
+const (
+	CloseNormal          = 1000
+	CloseGoingAway       = 1001
+	CloseProtocolError   = 1002
+	CloseUnsupportedData = 1003
+	CloseNoStatus        = 1005
+	CloseAbnormal        = 1006
+	CloseInvalidPayload  = 1007
+	ClosePolicyViolation = 1008
+	CloseMessageTooBig   = 1009
+	CloseInternalError   = 1011
+)
+
+// maxControlPayload is the largest payload a control frame may carry.
+const maxControlPayload = 125
+
+// Frame is a single WebSocket frame.
+type Frame struct {
+	Fin     bool
+	Opcode  Opcode
+	Payload []byte
+}
+
+// Error is a violation of the protocol by the peer. Code is the close code
+// to answer it with.
+type Error struct {
+	Code int
+	Text string
+}
+
+func (e *Error) Error() string {
+	return fmt.Sprintf("websocket: %s (close %d)", e.Text, e.Code)
+}
+
+// ErrMessageTooBig is returned for a message over the reader's limit.
+var ErrMessageTooBig = &Error{Code: CloseMessageTooBig, Text: "message too big"}
+
+func protocolError(format string, args ...any) error {
+	return &Error{Code: CloseProtocolError, Text: fmt.Sprintf(format, args...)}
+}
+
+// ClosePayload builds the payload of a close frame. CloseNoStatus gives an
+// empty payload, as that code must not be sent.
+func ClosePayload(code int, text string) []byte {
+	if code == CloseNoStatus {
+		return nil
+	}
+	payload := make([]byte, 2, 2+len(text))
+	payload[0], payload[1] = byte(code>>8), byte(code)
+	return append(payload, text...)
+}
+
+// ParseClose returns the code and reason of a close frame. An empty payload
+// gives CloseNoStatus.
+func ParseClose(payload []byte) (int, string, error) {
+	if len(payload) == 0 {
+		return CloseNoStatus, "", nil
+	}
+	if len(payload) == 1 {
+		return 0, "", protocolError("truncated close code")
+	}
+	code := int(payload[0])<<8 | int(payload[1])
+	if !validCloseCode(code) {
+		return 0, "", protocolError("invalid close code %d", code)
+	}
+	text := payload[2:]
+	if !utf8.Valid(text) {
+		return 0, "", &Error{Code: CloseInvalidPayload, Text: "invalid UTF-8 in close reason"}
+	}
+	return code, string(text), nil
+}
+
+// validCloseCode reports whether code may appear in a close frame.
+func validCloseCode(code int) bool {
+	switch {
+	case code >= 1000 && code <= 1003, code >= 1007 && code <= 1014:
+		return true
+	case code >= 3000 && code <= 4999:
+		return true
+	}
+	return false
+}
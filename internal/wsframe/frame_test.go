@@ -0,0 +1,96 @@
+package wsframe
+
+import (
+	"bytes"
+	"errors"
+	"testing"
+)
+
+func TestParseCloseCodes(t *testing.T) {
+	tests := []struct {
+		code int
+		want int // close code of the error, or 0 if the code is valid
+	}{
+		{999, CloseProtocolError},
+		{CloseNormal, 0},
+		{CloseGoingAway, 0},
+		{CloseProtocolError, 0},
+		{CloseUnsupportedData, 0},
+		{1004, CloseProtocolError},
+		{CloseNoStatus, CloseProtocolError},
+		{CloseAbnormal, CloseProtocolError},
+		{CloseInvalidPayload, 0},
+		{CloseMessageTooBig, 0},
+		{CloseInternalError, 0},
+		{1014, 0},
+		{1015, CloseProtocolError},
+		{2999, CloseProtocolError},
+		{3000, 0},
+		{4999, 0},
+		{5000, CloseProtocolError},
+	}
+	for _, tt := range tests {
+		payload := []byte{byte(tt.code >> 8), byte(tt.code), 'o', 'k'}
+		code, reason, err := ParseClose(payload)
+		if tt.want == 0 {
+			if err != nil || code != tt.code || reason != "ok" {
+				t.Errorf("ParseClose(%d) = %d, %q, %v; want %d, \"ok\", nil", tt.code, code, reason, err, tt.code)
+			}
+			continue
+		}
+		var e *Error
+		if !errors.As(err, &e) || e.Code != tt.want {
+			t.Errorf("ParseClose(%d) error = %v; want close %d", tt.code, err, tt.want)
+		}
+	}
+}
+
+func TestParseCloseMalformed(t *testing.T) {
+	code, _, err := ParseClose(nil)
+	if err != nil || code != CloseNoStatus {
+		t.Errorf("empty payload = %d, %v; want %d", code, err, CloseNoStatus)
+	}
+
+	var e *Error
+	if _, _, err := ParseClose([]byte{0x03}); !errors.As(err, &e) || e.Code != CloseProtocolError {
+		t.Errorf("truncated code error = %v; want close %d", err, CloseProtocolError)
+	}
+	if _, _, err := ParseClose([]byte{0x03, 0xE8, 0xFF}); !errors.As(err, &e) || e.Code != CloseInvalidPayload {
+		t.Errorf("invalid UTF-8 reason error = %v; want close %d", err, CloseInvalidPayload)
+	}
+}
+
+func TestClosePayloadNoStatus(t *testing.T) {
+	if payload := ClosePayload(CloseNoStatus, "ignored"); len(payload) != 0 {
+		t.Errorf("ClosePayload(CloseNoStatus) = %x; want empty", payload)
+	}
+}
+
+func FuzzParseClose(f *testing.F) {
+	f.Add([]byte{})
+	f.Add([]byte{0x03})
+	f.Add(ClosePayload(CloseNormal, ""))
+	f.Add(ClosePayload(CloseGoingAway, "bye"))
+	f.Add(ClosePayload(4001, "custom"))
+	f.Add([]byte{0x03, 0xE8, 0xC3, 0x28})
+
+	f.Fuzz(func(t *testing.T, payload []byte) {
+		code, reason, err := ParseClose(payload)
+		if err != nil {
+			var e *Error
+			if !errors.As(err, &e) {
+				t.Fatalf("error %v is not an *Error", err)
+			}
+			return
+		}
+
+		again := ClosePayload(code, reason)
+		if code != CloseNoStatus && !bytes.Equal(again, payload) {
+			t.Fatalf("ClosePayload(%d, %q) = %x; want %x", code, reason, again, payload)
+		}
+		code2, reason2, err := ParseClose(again)
+		if err != nil || code2 != code || reason2 != reason {
+			t.Fatalf("round trip = %d, %q, %v; want %d, %q", code2, reason2, err, code, reason)
+		}
+	})
+}
@@ -0,0 +1,208 @@
+package wsframe
+
+import (
+	"encoding/binary"
+	"io"
+	"math"
+	"unicode/utf8"
+)
+
+// Reader reads frames and messages from a connection.
+type Reader struct {
+	r io.Reader
+	// masked is whether the peer must mask its frames, which is the case
+	// when it is the client of the connection.
+	masked bool
+	limit  int64
+
+	// The fragmented message being read, if any
+	op  Opcode
+	buf []byte
+
+	header [8]byte
+}
+
+// NewReader returns a reader of frames sent by a peer that masks them if
+// masked is set. Messages over limit bytes fail with ErrMessageTooBig; zero
+// means no limit.
+func NewReader(r io.Reader, masked bool, limit int64) *Reader {
+	return &Reader{r: r, masked: masked, limit: limit}
+}
+
+type frameHeader struct {
+	fin    bool
+	op     Opcode
+	length uint64
+	mask   [4]byte
+}
+
+func (r *Reader) readHeader() (frameHeader, error) {
+	var h frameHeader
+	b := r.header[:2]
+	if _, err := io.ReadFull(r.r, b); err != nil {
+		return h, err
+	}
+	h.fin = b[0]&0x80 != 0
+	h.op = Opcode(b[0] & 0x0F)
+	masked := b[1]&0x80 != 0
+	h.length = uint64(b[1] & 0x7F)
+
+	// No extensions are negotiated, so the reserved bits must be clear
+	if b[0]&0x70 != 0 {
+		return h, protocolError("reserved bits set")
+	}
+	if !h.op.valid() {
+		return h, protocolError("unknown opcode %d", h.op)
+	}
+	if h.op.IsControl() {
+		if !h.fin {
+			return h, protocolError("fragmented control frame")
+		}
+		if h.length > maxControlPayload {
+			return h, protocolError("control frame too long")
+		}
+	}
+	if masked != r.masked {
+		if r.masked {
+			return h, protocolError("unmasked frame from client")
+		}
+		return h, protocolError("masked frame from server")
+	}
+
+	switch h.length {
+	case 126:
+		b = r.header[:2]
+		if _, err := io.ReadFull(r.r, b); err != nil {
+			return h, io.ErrUnexpectedEOF
+		}
+		h.length = uint64(binary.BigEndian.Uint16(b))
+		if h.length < 126 {
+			return h, protocolError("length not minimally encoded")
+		}
+	case 127:
+		b = r.header[:8]
+		if _, err := io.ReadFull(r.r, b); err != nil {
+			return h, io.ErrUnexpectedEOF
+		}
+		h.length = binary.BigEndian.Uint64(b)
+		if h.length>>63 != 0 {
+			return h, protocolError("length too large")
+		}
+		if h.length <= math.MaxUint16 {
+			return h, protocolError("length not minimally encoded")
+		}
+	}
+
+	if masked {
+		if _, err := io.ReadFull(r.r, h.mask[:]); err != nil {
+			return h, io.ErrUnexpectedEOF
+		}
+	}
+	return h, nil
+}
+
+// readPayload appends the payload of the frame to dst.
+func (r *Reader) readPayload(dst []byte, h frameHeader) ([]byte, error) {
+	start := len(dst)
+	dst = append(dst, make([]byte, h.length)...)
+	if _, err := io.ReadFull(r.r, dst[start:]); err != nil {
+		if err == io.EOF {
+			err = io.ErrUnexpectedEOF
+		}
+		return nil, err
+	}
+	if r.masked {
+		payload := dst[start:]
+		for i := range payload {
+			payload[i] ^= h.mask[i&3]
+		}
+	}
+	return dst, nil
+}
+
+// tooBig reports whether a message of n bytes exceeds the limit. Without a
+// limit, lengths are still capped so a header can't make us allocate
+// arbitrary amounts.
+func (r *Reader) tooBig(n uint64) bool {
+	if r.limit > 0 {
+		return n > uint64(r.limit)
+	}
+	return n > math.MaxInt32
+}
+
+// ReadFrame reads a single frame and unmasks its payload. It checks the
+// frame but not how frames make up messages, and close frames are not
+// parsed.
+func (r *Reader) ReadFrame() (Frame, error) {
+	h, err := r.readHeader()
+	if err != nil {
+		return Frame{}, err
+	}
+	if r.tooBig(h.length) {
+		return Frame{}, ErrMessageTooBig
+	}
+	payload, err := r.readPayload(nil, h)
+	if err != nil {
+		return Frame{}, err
+	}
+	return Frame{Fin: h.fin, Opcode: h.op, Payload: payload}, nil
+}
+
+// ReadMessage reads the next message. Control frames are returned as
+// messages of their own, including those that arrive between the fragments
+// of another message; reading then continues with the remaining fragments.
+// Text messages are checked to be valid UTF-8 and close frames to carry a
+// valid code.
+func (r *Reader) ReadMessage() (Opcode, []byte, error) {
+	for {
+		h, err := r.readHeader()
+		if err != nil {
+			return 0, nil, err
+		}
+
+		if h.op.IsControl() {
+			payload, err := r.readPayload(nil, h)
+			if err != nil {
+				return 0, nil, err
+			}
+			if h.op == OpClose {
+				if _, _, err := ParseClose(payload); err != nil {
+					return 0, nil, err
+				}
+			}
+			return h.op, payload, nil
+		}
+
+		if h.op == OpContinuation {
+			if r.op == 0 {
+				return 0, nil, protocolError("continuation frame without a message")
+			}
+		} else {
+			if r.op != 0 {
+				return 0, nil, protocolError("new message before the previous one ended")
+			}
+			r.op = h.op
+			r.buf = nil
+		}
+
+		if r.tooBig(uint64(len(r.buf)) + h.length) {
+			return 0, nil, ErrMessageTooBig
+		}
+		if r.buf, err = r.readPayload(r.buf, h); err != nil {
+			return 0, nil, err
+		}
+		if !h.fin {
+			continue
+		}
+
+		op, payload := r.op, r.buf
+		r.op, r.buf = 0, nil
+		if op == OpText && !utf8.Valid(payload) {
+			return 0, nil, &Error{Code: CloseInvalidPayload, Text: "invalid UTF-8 in text message"}
+		}
+		if payload == nil {
+			payload = []byte{}
+		}
+		return op, payload, nil
+	}
+}
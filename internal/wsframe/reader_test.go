@@ -0,0 +1,244 @@
+package wsframe
+
+import (
+	"bytes"
+	"errors"
+	"io"
+	"strings"
+	"testing"
+	"unicode/utf8"
+)
+
+// The single-frame examples from RFC 6455 section 5.7.
+var (
+	unmaskedHello = []byte{0x81, 0x05, 0x48, 0x65, 0x6c, 0x6c, 0x6f}
+	maskedHello   = []byte{0x81, 0x85, 0x37, 0xfa, 0x21, 0x3d, 0x7f, 0x9f, 0x4d, 0x51, 0x58}
+)
+
+func readFrame(data []byte, masked bool) (Frame, error) {
+	return NewReader(bytes.NewReader(data), masked, 0).ReadFrame()
+}
+
+func writeFrame(t testing.TB, f Frame, mask bool) []byte {
+	t.Helper()
+	var buf bytes.Buffer
+	if err := NewWriter(&buf, mask).WriteFrame(f); err != nil {
+		t.Fatalf("WriteFrame: %v", err)
+	}
+	return buf.Bytes()
+}
+
+func wantError(t *testing.T, err error, code int) {
+	t.Helper()
+	var e *Error
+	if !errors.As(err, &e) || e.Code != code {
+		t.Errorf("error = %v; want close %d", err, code)
+	}
+}
+
+func TestReadFrameMasking(t *testing.T) {
+	for _, tt := range []struct {
+		data   []byte
+		masked bool
+	}{
+		{unmaskedHello, false},
+		{maskedHello, true},
+	} {
+		f, err := readFrame(tt.data, tt.masked)
+		if err != nil {
+			t.Fatalf("ReadFrame(%x): %v", tt.data, err)
+		}
+		if !f.Fin || f.Opcode != OpText || string(f.Payload) != "Hello" {
+			t.Errorf("ReadFrame(%x) = %+v; want a final text frame with Hello", tt.data, f)
+		}
+	}
+
+	// Clients must mask their frames and servers must not
+	_, err := readFrame(unmaskedHello, true)
+	wantError(t, err, CloseProtocolError)
+	_, err = readFrame(maskedHello, false)
+	wantError(t, err, CloseProtocolError)
+}
+
+func TestWriterMasking(t *testing.T) {
+	payload := bytes.Repeat([]byte("masked"), 50)
+	data := writeFrame(t, Frame{Fin: true, Opcode: OpBinary, Payload: payload}, true)
+	if data[1]&0x80 == 0 {
+		t.Fatal("mask bit not set")
+	}
+	if bytes.Contains(data, payload) {
+		t.Error("payload written in the clear")
+	}
+	f, err := readFrame(data, true)
+	if err != nil || !bytes.Equal(f.Payload, payload) {
+		t.Errorf("ReadFrame = %x, %v; want the original payload", f.Payload, err)
+	}
+
+	data = writeFrame(t, Frame{Fin: true, Opcode: OpText, Payload: []byte("Hello")}, false)
+	if !bytes.Equal(data, unmaskedHello) {
+		t.Errorf("unmasked frame = %x; want %x", data, unmaskedHello)
+	}
+}
+
+func TestReadFrameLengths(t *testing.T) {
+	for _, n := range []int{0, 125, 126, 0xFFFF, 0x10000} {
+		payload := bytes.Repeat([]byte{'x'}, n)
+		f, err := readFrame(writeFrame(t, Frame{Fin: true, Opcode: OpBinary, Payload: payload}, false), false)
+		if err != nil || len(f.Payload) != n {
+			t.Errorf("%d byte frame: read %d bytes, %v", n, len(f.Payload), err)
+		}
+	}
+
+	// A 16-bit length below 126 is not minimally encoded
+	_, err := readFrame([]byte{0x82, 126, 0x00, 0x05, 1, 2, 3, 4, 5}, false)
+	wantError(t, err, CloseProtocolError)
+
+	data := writeFrame(t, Frame{Fin: true, Opcode: OpBinary, Payload: make([]byte, 200)}, false)
+	_, err = NewReader(bytes.NewReader(data), false, 100).ReadFrame()
+	wantError(t, err, CloseMessageTooBig)
+}
+
+func TestControlFrameLimits(t *testing.T) {
+	var buf bytes.Buffer
+	w := NewWriter(&buf, false)
+	if err := w.WriteFrame(Frame{Fin: true, Opcode: OpPing, Payload: make([]byte, 126)}); err == nil {
+		t.Error("wrote a 126 byte ping")
+	}
+	if err := w.WriteFrame(Frame{Opcode: OpPing}); err == nil {
+		t.Error("wrote a fragmented ping")
+	}
+
+	data := writeFrame(t, Frame{Fin: true, Opcode: OpPing, Payload: make([]byte, 125)}, false)
+	if f, err := readFrame(data, false); err != nil || len(f.Payload) != 125 {
+		t.Errorf("125 byte ping: read %d bytes, %v", len(f.Payload), err)
+	}
+
+	long := append([]byte{0x89, 126, 0x00, 126}, make([]byte, 126)...)
+	_, err := readFrame(long, false)
+	wantError(t, err, CloseProtocolError)
+
+	fragmented := []byte{0x09, 0x00}
+	_, err = readFrame(fragmented, false)
+	wantError(t, err, CloseProtocolError)
+}
+
+func TestReadFrameInvalidHeaders(t *testing.T) {
+	for _, data := range [][]byte{
+		{0xC1, 0x00}, // reserved bit set
+		{0x83, 0x00}, // reserved data opcode
+		{0x8B, 0x00}, // reserved control opcode
+	} {
+		_, err := readFrame(data, false)
+		wantError(t, err, CloseProtocolError)
+	}
+}
+
+func TestReadMessage(t *testing.T) {
+	stream, _, _ := fragmented(t)
+	// A rune split across fragments is only checked once they are joined
+	stream = append(stream, writeFrame(t, Frame{Opcode: OpText, Payload: []byte{0xE2, 0x82}}, true)...)
+	stream = append(stream, writeFrame(t, Frame{Fin: true, Opcode: OpContinuation, Payload: []byte{0xAC}}, true)...)
+	stream = append(stream, writeFrame(t, Frame{Fin: true, Opcode: OpBinary}, true)...)
+	r := NewReader(bytes.NewReader(stream), true, 30)
+
+	for _, want := range []struct {
+		op      Opcode
+		payload string
+	}{
+		{OpPing, "ping"},
+		{OpText, strings.Repeat("a", 10) + strings.Repeat("b", 10) + strings.Repeat("c", 10)},
+		{OpText, "€"},
+		{OpBinary, ""},
+	} {
+		op, payload, err := r.ReadMessage()
+		if err != nil {
+			t.Fatalf("ReadMessage: %v; want %v %q", err, want.op, want.payload)
+		}
+		if op != want.op || string(payload) != want.payload || payload == nil {
+			t.Errorf("ReadMessage = %v %q; want %v %q", op, payload, want.op, want.payload)
+		}
+	}
+	if _, _, err := r.ReadMessage(); err != io.EOF {
+		t.Errorf("ReadMessage at the end = %v; want EOF", err)
+	}
+}
+
+func TestReadMessageErrors(t *testing.T) {
+	text := func(fin bool, payload string) Frame {
+		return Frame{Fin: fin, Opcode: OpText, Payload: []byte(payload)}
+	}
+	continuation := func(fin bool, payload string) Frame {
+		return Frame{Fin: fin, Opcode: OpContinuation, Payload: []byte(payload)}
+	}
+	for _, tt := range []struct {
+		name   string
+		frames []Frame
+		code   int
+	}{
+		{"continuation without a message", []Frame{continuation(true, "x")}, CloseProtocolError},
+		{"new message mid-message", []Frame{text(false, "x"), text(true, "y")}, CloseProtocolError},
+		{"invalid UTF-8", []Frame{text(true, "\xff")}, CloseInvalidPayload},
+		{"truncated rune", []Frame{text(false, "\xe2\x82"), continuation(true, "")}, CloseInvalidPayload},
+		{"fragments over the limit", []Frame{text(false, "0123456789"), continuation(true, "0123456789x")}, CloseMessageTooBig},
+		{"invalid close code", []Frame{{Fin: true, Opcode: OpClose, Payload: []byte{0x03, 0xE7}}}, CloseProtocolError},
+	} {
+		var stream []byte
+		for _, f := range tt.frames {
+			stream = append(stream, writeFrame(t, f, false)...)
+		}
+		r := NewReader(bytes.NewReader(stream), false, 20)
+		var err error
+		for err == nil {
+			_, _, err = r.ReadMessage()
+		}
+		t.Run(tt.name, func(t *testing.T) { wantError(t, err, tt.code) })
+	}
+}
+
+func FuzzReadMessage(f *testing.F) {
+	f.Add(unmaskedHello)
+	f.Add([]byte{0x01, 0x03, 'H', 'e', 'l', 0x89, 0x00, 0x80, 0x02, 'l', 'o'})
+	f.Add([]byte{0x01, 0x01, 0xE2, 0x80, 0x02, 0x82, 0xAC})
+	f.Add([]byte{0x81, 0x01, 0xFF})
+
+	f.Fuzz(func(t *testing.T, data []byte) {
+		r := NewReader(bytes.NewReader(data), false, 1<<20)
+		for {
+			op, payload, err := r.ReadMessage()
+			if err != nil {
+				return
+			}
+			if op == OpContinuation {
+				t.Fatal("ReadMessage returned a continuation frame")
+			}
+			if op == OpText && !utf8.Valid(payload) {
+				t.Fatalf("ReadMessage returned invalid text %q", payload)
+			}
+		}
+	})
+}
+
+func FuzzReadFrame(f *testing.F) {
+	f.Add(unmaskedHello, false)
+	f.Add(maskedHello, true)
+	f.Add([]byte{0x88, 0x02, 0x03, 0xE8}, false)
+	f.Add([]byte{0x01, 0x03, 'H', 'e', 'l', 0x80, 0x02, 'l', 'o'}, false)
+	f.Add([]byte{0x82, 126, 0x01, 0x00}, false)
+	f.Add([]byte{0x82, 127, 0, 0, 0, 0, 0, 1, 0, 0}, false)
+
+	f.Fuzz(func(t *testing.T, data []byte, masked bool) {
+		frame, err := NewReader(bytes.NewReader(data), masked, 1<<20).ReadFrame()
+		if err != nil {
+			return
+		}
+
+		// Whatever was read can be written and read back unchanged
+		again, err := readFrame(writeFrame(t, frame, masked), masked)
+		if err != nil {
+			t.Fatalf("reading back %+v: %v", frame, err)
+		}
+		if again.Fin != frame.Fin || again.Opcode != frame.Opcode || !bytes.Equal(again.Payload, frame.Payload) {
+			t.Fatalf("round trip = %+v; want %+v", again, frame)
+		}
+	})
+}
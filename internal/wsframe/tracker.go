@@ -0,0 +1,169 @@
+package wsframe
+
+import (
+	"bytes"
+	"encoding/binary"
+)
+
+// Tracker follows the frames in a raw WebSocket byte stream without
+// buffering the payloads of data frames, so a relay can forward the bytes
+// untouched and still know where frames begin and how large messages get.
+// Data frames are only checked for their length and for fragments arriving
+// in order, as the endpoints may have negotiated extensions the tracker
+// doesn't know about. Extensions
+// leave control frames alone, so those are read with a Reader and must
+// follow the RFC.
+type Tracker struct {
+	// Limit is the largest message size allowed; zero means no limit.
+	Limit int64
+	// OnControl, if set, is called with every complete control frame.
+	OnControl func(op Opcode, payload []byte)
+
+	header    [14]byte
+	headerLen int
+
+	op        Opcode
+	remaining uint64
+	inPayload bool
+	masked    bool
+	// control is the control frame being read, header included
+	control []byte
+
+	message uint64
+	// fragmented is set between the first and the last frame of a message
+	fragmented bool
+	// torn is set when frames were cut off mid-frame
+	torn bool
+}
+
+// Write feeds the next bytes of the stream to the tracker. If a frame
+// would take its message over the limit, Write reports ErrMessageTooBig
+// and how many bytes precede that frame's header. A malformed control
+// frame or a fragment out of order is reported the same way with an *Error.
+func (t *Tracker) Write(p []byte) (int, error) {
+	for i := 0; i < len(p); {
+		if t.inPayload {
+			n := uint64(len(p) - i)
+			if n > t.remaining {
+				n = t.remaining
+			}
+			if t.op.IsControl() {
+				t.control = append(t.control, p[i:i+int(n)]...)
+			}
+			t.remaining -= n
+			i += int(n)
+			if t.remaining == 0 {
+				if err := t.endFrame(); err != nil {
+					return t.frameStart(i, len(t.control)), err
+				}
+			}
+			continue
+		}
+
+		t.header[t.headerLen] = p[i]
+		t.headerLen++
+		i++
+		if t.headerLen < 2 || t.headerLen < t.headerSize() {
+			continue
+		}
+		size := t.headerLen
+		if err := t.startFrame(); err != nil {
+			return t.frameStart(i, size), err
+		}
+	}
+	return len(p), nil
+}
+
+// frameStart returns where a frame of size bytes ending at end began in
+// the current write, or 0 if it began in an earlier one.
+func (t *Tracker) frameStart(end, size int) int {
+	start := end - size
+	if start < 0 {
+		t.torn = true
+		start = 0
+	}
+	return start
+}
+
+// AtBoundary reports whether the bytes written so far end with a whole
+// frame, so another frame can be inserted.
+func (t *Tracker) AtBoundary() bool {
+	return t.headerLen == 0 && !t.inPayload && !t.torn
+}
+
+func (t *Tracker) headerSize() int {
+	n := 2
+	switch t.header[1] & 0x7F {
+	case 126:
+		n += 2
+	case 127:
+		n += 8
+	}
+	if t.header[1]&0x80 != 0 {
+		n += 4
+	}
+	return n
+}
+
+func (t *Tracker) startFrame() error {
+	h := t.header[:t.headerLen]
+	t.headerLen = 0
+	t.op = Opcode(h[0] & 0x0F)
+	t.masked = h[1]&0x80 != 0
+	t.remaining = uint64(h[1] & 0x7F)
+	switch t.remaining {
+	case 126:
+		t.remaining = uint64(binary.BigEndian.Uint16(h[2:]))
+	case 127:
+		t.remaining = binary.BigEndian.Uint64(h[2:])
+	}
+
+	if t.op.IsControl() {
+		// Checking the header first keeps an oversized control frame from
+		// being buffered
+		if _, err := NewReader(bytes.NewReader(h), t.masked, 0).readHeader(); err != nil {
+			return err
+		}
+		t.control = append(t.control[:0], h...)
+	} else {
+		switch {
+		case t.op == OpContinuation && !t.fragmented:
+			return protocolError("continuation frame without a message")
+		case t.op != OpContinuation && t.fragmented:
+			return protocolError("new message before the previous one ended")
+		case t.op != OpContinuation:
+			t.message = 0
+		}
+		t.fragmented = h[0]&0x80 == 0
+		t.message += t.remaining
+		if t.Limit > 0 && t.message > uint64(t.Limit) {
+			return ErrMessageTooBig
+		}
+	}
+
+	t.inPayload = t.remaining > 0
+	if !t.inPayload {
+		return t.endFrame()
+	}
+	return nil
+}
+
+func (t *Tracker) endFrame() error {
+	t.inPayload = false
+	if !t.op.IsControl() {
+		return nil
+	}
+	f, err := NewReader(bytes.NewReader(t.control), t.masked, 0).ReadFrame()
+	if err != nil {
+		return err
+	}
+	if f.Opcode == OpClose {
+		if _, _, err := ParseClose(f.Payload); err != nil {
+			return err
+		}
+	}
+	if t.OnControl != nil {
+		t.OnControl(f.Opcode, f.Payload)
+	}
+	return nil
+}
@@ -0,0 +1,151 @@
+package wsframe
+
+import (
+	"bytes"
+	"testing"
+)
+
+type control struct {
+	op      Opcode
+	payload string
+}
+
+func newTracker(limit int64) (*Tracker, *[]control) {
+	var seen []control
+	t := &Tracker{Limit: limit}
+	t.OnControl = func(op Opcode, payload []byte) {
+		seen = append(seen, control{op, string(payload)})
+	}
+	return t, &seen
+}
+
+// fragmented is a 30 byte text message in three masked fragments with a
+// ping between the first two. It also returns where each frame ends.
+func fragmented(t *testing.T) (stream []byte, ends map[int]bool, thirdFragment int) {
+	ends = make(map[int]bool)
+	for _, f := range []Frame{
+		{Opcode: OpText, Payload: bytes.Repeat([]byte{'a'}, 10)},
+		{Fin: true, Opcode: OpPing, Payload: []byte("ping")},
+		{Opcode: OpContinuation, Payload: bytes.Repeat([]byte{'b'}, 10)},
+		{Fin: true, Opcode: OpContinuation, Payload: bytes.Repeat([]byte{'c'}, 10)},
+	} {
+		if f.Fin && f.Opcode == OpContinuation {
+			thirdFragment = len(stream)
+		}
+		stream = append(stream, writeFrame(t, f, true)...)
+		ends[len(stream)] = true
+	}
+	return stream, ends, thirdFragment
+}
+
+func TestTrackerFragmentation(t *testing.T) {
+	stream, ends, _ := fragmented(t)
+
+	tracker, seen := newTracker(30)
+	if n, err := tracker.Write(stream); err != nil || n != len(stream) {
+		t.Fatalf("Write = %d, %v; want %d, nil", n, err, len(stream))
+	}
+	if len(*seen) != 1 || (*seen)[0] != (control{OpPing, "ping"}) {
+		t.Errorf("control frames = %v; want the unmasked ping", *seen)
+	}
+	if !tracker.AtBoundary() {
+		t.Error("not at a boundary after whole frames")
+	}
+
+	// Byte by byte, the tracker is only at a boundary between frames
+	tracker, seen = newTracker(30)
+	for i := range stream {
+		if _, err := tracker.Write(stream[i : i+1]); err != nil {
+			t.Fatalf("Write of byte %d: %v", i, err)
+		}
+		if tracker.AtBoundary() != ends[i+1] {
+			t.Errorf("after byte %d: at boundary = %v; want %v", i, tracker.AtBoundary(), ends[i+1])
+		}
+	}
+	if len(*seen) != 1 {
+		t.Errorf("byte by byte: control frames = %v; want the ping", *seen)
+	}
+}
+
+func TestTrackerMessageLimit(t *testing.T) {
+	stream, _, third := fragmented(t)
+
+	// The limit applies to the whole message, not to each fragment
+	tracker, _ := newTracker(25)
+	n, err := tracker.Write(stream)
+	if err != ErrMessageTooBig || n != third {
+		t.Fatalf("Write = %d, %v; want %d, %v", n, err, third, ErrMessageTooBig)
+	}
+
+	// A new message starts counting again
+	tracker, _ = newTracker(25)
+	msg := writeFrame(t, Frame{Fin: true, Opcode: OpBinary, Payload: make([]byte, 20)}, false)
+	for i := 0; i < 3; i++ {
+		if _, err := tracker.Write(msg); err != nil {
+			t.Fatalf("message %d: %v", i, err)
+		}
+	}
+}
+
+func TestTrackerControlFrames(t *testing.T) {
+	ping := writeFrame(t, Frame{Fin: true, Opcode: OpPing}, false)
+
+	for name, frame := range map[string][]byte{
+		"invalid close code": {0x88, 0x02, 0x03, 0xE7},
+		"truncated close":    {0x88, 0x01, 0x03},
+		"fragmented ping":    {0x09, 0x00},
+		"oversized ping":     append([]byte{0x89, 126, 0x00, 126}, make([]byte, 126)...),
+	} {
+		tracker, _ := newTracker(0)
+		n, err := tracker.Write(append(ping, frame...))
+		if n != len(ping) {
+			t.Errorf("%s: %d bytes precede the frame; want %d", name, n, len(ping))
+		}
+		wantError(t, err, CloseProtocolError)
+	}
+
+	// A close frame split across writes is still checked, and the bad frame
+	// is reported as starting in an earlier write
+	tracker, _ := newTracker(0)
+	tracker.Write([]byte{0x88, 0x02, 0x03})
+	n, err := tracker.Write([]byte{0xE7})
+	if n != 0 || tracker.AtBoundary() {
+		t.Errorf("split close: n = %d, at boundary = %v; want 0, false", n, tracker.AtBoundary())
+	}
+	wantError(t, err, CloseProtocolError)
+
+	// Extensions may set reserved bits on data frames, so those pass
+	tracker, _ = newTracker(0)
+	if _, err := tracker.Write([]byte{0xC1, 0x01, 'x'}); err != nil {
+		t.Errorf("compressed data frame: %v", err)
+	}
+}
+
+func TestTrackerFragmentOrder(t *testing.T) {
+	first := writeFrame(t, Frame{Opcode: OpText, Payload: []byte("a")}, false)
+	whole := writeFrame(t, Frame{Fin: true, Opcode: OpText, Payload: []byte("a")}, false)
+	for _, tt := range []struct {
+		name   string
+		before []byte
+		frame  Frame
+	}{
+		{"new message mid-message", first, Frame{Fin: true, Opcode: OpBinary, Payload: []byte("b")}},
+		{"continuation without a message", whole, Frame{Fin: true, Opcode: OpContinuation, Payload: []byte("b")}},
+	} {
+		tracker, _ := newTracker(0)
+		n, err := tracker.Write(append(append([]byte{}, tt.before...), writeFrame(t, tt.frame, false)...))
+		if n != len(tt.before) {
+			t.Errorf("%s: %d bytes precede the frame; want %d", tt.name, n, len(tt.before))
+		}
+		wantError(t, err, CloseProtocolError)
+	}
+
+	// Control frames may come between fragments
+	tracker, _ := newTracker(0)
+	stream := append(append([]byte{}, first...), writeFrame(t, Frame{Fin: true, Opcode: OpPing}, false)...)
+	stream = append(stream, writeFrame(t, Frame{Fin: true, Opcode: OpContinuation, Payload: []byte("b")}, false)...)
+	stream = append(stream, whole...)
+	if _, err := tracker.Write(stream); err != nil {
+		t.Errorf("ordered fragments: %v", err)
+	}
+}
@@ -0,0 +1,84 @@
+package wsframe
+
+import (
+	"crypto/rand"
+	"encoding/binary"
+	"errors"
+	"io"
+	"sync"
+)
+
+// Writer writes frames to a connection. It is safe for concurrent use, and
+// every frame goes out in a single write.
+type Writer struct {
+	w io.Writer
+	// mask is whether frames are masked, which clients must do.
+	mask bool
+	mu   sync.Mutex
+}
+
+// NewWriter returns a writer that masks its frames if mask is set.
+func NewWriter(w io.Writer, mask bool) *Writer {
+	return &Writer{w: w, mask: mask}
+}
+
+// WriteFrame writes a single frame.
+func (w *Writer) WriteFrame(f Frame) error {
+	if !f.Opcode.valid() {
+		return errors.New("wsframe: invalid opcode")
+	}
+	if f.Opcode.IsControl() && (!f.Fin || len(f.Payload) > maxControlPayload) {
+		return errors.New("wsframe: control frames must be unfragmented and at most 125 bytes")
+	}
+
+	buf := make([]byte, 14, 14+len(f.Payload))
+	buf[0] = byte(f.Opcode)
+	if f.Fin {
+		buf[0] |= 0x80
+	}
+	n := 2
+	switch length := len(f.Payload); {
+	case length < 126:
+		buf[1] = byte(length)
+	case length <= 0xFFFF:
+		buf[1] = 126
+		binary.BigEndian.PutUint16(buf[2:], uint16(length))
+		n += 2
+	default:
+		buf[1] = 127
+		binary.BigEndian.PutUint64(buf[2:], uint64(length))
+		n += 8
+	}
+
+	var key [4]byte
+	if w.mask {
+		buf[1] |= 0x80
+		if _, err := rand.Read(key[:]); err != nil {
+			return err
+		}
+		copy(buf[n:], key[:])
+		n += 4
+	}
+	buf = append(buf[:n], f.Payload...)
+	if w.mask {
+		payload := buf[n:]
+		for i := range payload {
+			payload[i] ^= key[i&3]
+		}
+	}
+
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	_, err := w.w.Write(buf)
+	return err
+}
+
+// WriteMessage writes a message as a single frame.
+func (w *Writer) WriteMessage(op Opcode, payload []byte) error {
+	return w.WriteFrame(Frame{Fin: true, Opcode: op, Payload: payload})
+}
+
+// WriteClose writes a close frame with the given code and reason.
+func (w *Writer) WriteClose(code int, text string) error {
+	return w.WriteMessage(OpClose, ClosePayload(code, text))
+}